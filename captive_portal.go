@@ -0,0 +1,131 @@
+package wifimanager
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// captivePortalProbes are the URLs operating systems fetch to decide whether
+// a network has a captive portal
+var captivePortalProbes = map[string]bool{
+	"/generate_204":                true, // Android, Chrome
+	"/gen_204":                     true, // Android
+	"/hotspot-detect.html":         true, // Apple
+	"/library/test/success.html":   true, // Apple
+	"/connecttest.txt":             true, // Windows 10+
+	"/ncsi.txt":                    true, // Windows 7
+	"/redirect":                    true, // Windows
+	"/canonical.html":              true, // Firefox
+	"/success.txt":                 true, // Firefox
+	"/check_network_status.txt":    true, // Samsung
+	"/kindle-wifi/wifistub.html":   true, // Kindle
+	"/mobile/status.php":           true, // Android (some vendors)
+	"/connectivity-check.html":     true, // Ubuntu
+	"/static/hotspot.txt":          true, // Huawei
+	"/wifi/connectivity-check.txt": true,
+}
+
+// CaptivePortalHandler redirects the captive-portal probe URLs, and any
+// other request that is not for the setup page's host, to setupURL so that
+// clients of the hotspot are prompted to open it. Requests for the setup
+// page's host are passed to next, or answered with 404 if next is nil.
+func CaptivePortalHandler(setupURL string, next http.Handler) http.Handler {
+	setupHost := ""
+	if u, err := url.Parse(setupURL); err == nil {
+		setupHost = u.Host
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !captivePortalProbes[r.URL.Path] && len(setupHost) > 0 && strings.EqualFold(r.Host, setupHost) {
+			if next == nil {
+				http.NotFound(w, r)
+			} else {
+				next.ServeHTTP(w, r)
+			}
+			return
+		}
+		// Probes must not be cached or clients will not notice once the
+		// device is provisioned
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		http.Redirect(w, r, setupURL, http.StatusFound)
+	})
+}
+
+// portalAddr returns the address the built-in captive portal listens on
+func (hc *HotspotConfig) portalAddr(gateway net.IP) string {
+	if len(hc.CaptivePortalAddr) > 0 {
+		return hc.CaptivePortalAddr
+	}
+	return net.JoinHostPort(gateway.String(), "80")
+}
+
+// portalServes reports whether requests for u reach the built-in captive
+// portal. With CaptivePortal set dnsmasq resolves every name to the gateway,
+// so any host name does.
+func (hc *HotspotConfig) portalServes(u *url.URL, gateway net.IP) bool {
+	if u.Scheme != "http" {
+		return false
+	}
+	host, port, err := net.SplitHostPort(hc.portalAddr(gateway))
+	if err != nil {
+		return false
+	}
+	urlPort := u.Port()
+	if len(urlPort) == 0 {
+		urlPort = "80"
+	}
+	if urlPort != port {
+		return false
+	}
+	ip := net.ParseIP(u.Hostname())
+	if ip == nil {
+		return hc.CaptivePortal
+	}
+	portalIP := net.ParseIP(host)
+	return portalIP == nil || portalIP.IsUnspecified() || portalIP.Equal(ip)
+}
+
+// startCaptivePortal serves CaptivePortalHandler on the hotspot if a setup
+// URL is configured
+func (wm *WifiManager) startCaptivePortal(ic *ifaceController, conf HotspotConfig, gateway net.IP) error {
+	if len(conf.SetupURL) == 0 {
+		return nil
+	}
+	listener, err := net.Listen("tcp", conf.portalAddr(gateway))
+	if err != nil {
+		return fmt.Errorf("Failed to listen for captive portal: %v", err)
+	}
+	server := &http.Server{Handler: CaptivePortalHandler(conf.SetupURL, conf.SetupHandler)}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Captive portal failed: %v", err)
+		}
+	}()
+	ic.mutex.Lock()
+	ic.portal = server
+	ic.portalAddr = listener.Addr().String()
+	ic.mutex.Unlock()
+	log.Infof("Serving captive portal on %v", listener.Addr())
+	return nil
+}
+
+func (wm *WifiManager) stopCaptivePortal(ic *ifaceController) {
+	if ic.portal == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := ic.portal.Shutdown(ctx); err != nil {
+		ic.portal.Close()
+	}
+	ic.mutex.Lock()
+	ic.portal = nil
+	ic.portalAddr = ""
+	ic.mutex.Unlock()
+}
@@ -0,0 +1,118 @@
+package wifimanager
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptivePortalHandler(t *testing.T) {
+	require := require.New(t)
+
+	setup := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("setup"))
+	})
+	handler := CaptivePortalHandler("http://10.11.12.1:8080/setup", setup)
+
+	for _, probe := range []string{
+		"http://connectivitycheck.gstatic.com/generate_204",
+		"http://captive.apple.com/hotspot-detect.html",
+		"http://www.msftconnecttest.com/connecttest.txt",
+		"http://example.com/some/page",
+		"http://10.11.12.1:8080/generate_204",
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", probe, nil))
+		require.Equal(http.StatusFound, w.Code, probe)
+		require.Equal("http://10.11.12.1:8080/setup", w.Header().Get("Location"), probe)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://10.11.12.1:8080/setup", nil))
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("setup", w.Body.String())
+
+	w = httptest.NewRecorder()
+	CaptivePortalHandler("http://10.11.12.1:8080/setup", nil).ServeHTTP(w, httptest.NewRequest("GET", "http://10.11.12.1:8080/setup", nil))
+	require.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestCaptivePortalHotspot(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+
+	hc := DefaultHotspotConfig()
+	hc.SSID = "setup"
+	hc.CaptivePortal = true
+	hc.SetupURL = "http://10.11.12.1:8080/"
+	hc.CaptivePortalAddr = "127.0.0.1:0"
+	require.Contains(hc.dnsmasqConf("wlan0"), "address=/#/10.11.12.1\n")
+
+	invalid := hc
+	invalid.SetupURL = "/relative"
+	require.NotNil(invalid.Validate())
+	// The portal would answer these itself
+	invalid.CaptivePortalAddr = ""
+	for _, setupURL := range []string{"http://10.11.12.1/", "http://setup.local/"} {
+		invalid.SetupURL = setupURL
+		require.NotNil(invalid.Validate(), setupURL)
+	}
+	invalid.SetupURL = "https://setup.local/"
+	require.Nil(invalid.Validate())
+	invalid.CaptivePortal = false
+	invalid.SetupURL = "http://setup.local/"
+	require.Nil(invalid.Validate())
+
+	require.Nil(wm.StartHotspotWithConfig("wlan0", hc))
+	require.Equal(1, len(executor.Processes("/usr/sbin/dnsmasq")))
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get("http://" + wm.controller("wlan0").portalAddr + "/generate_204")
+	require.Nil(err)
+	resp.Body.Close()
+	require.Equal(http.StatusFound, resp.StatusCode)
+	require.Equal("http://10.11.12.1:8080/", resp.Header.Get("Location"))
+
+	addr := wm.controller("wlan0").portalAddr
+	require.Nil(wm.StopHotspot("wlan0"))
+	_, err = client.Get("http://" + addr + "/generate_204")
+	require.NotNil(err)
+}
+
+func TestCaptivePortalSetupHandler(t *testing.T) {
+	require := require.New(t)
+
+	wm, _, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+
+	hc := DefaultHotspotConfig()
+	hc.SSID = "setup"
+	hc.CaptivePortal = true
+	hc.CaptivePortalAddr = "127.0.0.1:0"
+	hc.SetupURL = "http://setup.local/"
+	hc.SetupHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("setup"))
+	})
+	require.Nil(wm.StartHotspotWithConfig("wlan0", hc))
+	defer wm.StopHotspot("wlan0")
+
+	req, err := http.NewRequest("GET", "http://"+wm.controller("wlan0").portalAddr+"/", nil)
+	require.Nil(err)
+	req.Host = "setup.local"
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(err)
+	require.Equal(http.StatusOK, resp.StatusCode)
+	require.Equal("setup", string(body))
+}
@@ -0,0 +1,112 @@
+package wifimanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrClosed is returned by methods that would start a daemon once Close
+// has been called
+var ErrClosed = errors.New("wifimanager is closed")
+
+// Close stops everything the manager started and puts the interfaces back
+// the way it found them. Daemons are sent SIGTERM and killed if they have
+// not exited after StopGracePeriod, and are reaped either way. Temporary
+// configuration files are removed and the interfaces that ran a hotspot or
+// wpa_supplicant are reset.
+//
+// Close may be called any number of times and from any goroutine, such as
+// one waiting on os/signal. A TestConnect in progress is aborted. Every call
+// returns once the shutdown is complete, with the same error.
+func (wm *WifiManager) Close() error {
+	wm.closeOnce.Do(func() {
+		close(wm.closedChan())
+		wm.closeErr = wm.shutdown()
+	})
+	return wm.closeErr
+}
+
+func (wm *WifiManager) closedChan() chan struct{} {
+	wm.closeMutex.Lock()
+	defer wm.closeMutex.Unlock()
+	if wm.closed == nil {
+		wm.closed = make(chan struct{})
+	}
+	return wm.closed
+}
+
+func (wm *WifiManager) isClosed() bool {
+	select {
+	case <-wm.closedChan():
+		return true
+	default:
+		return false
+	}
+}
+
+// withClose returns a context that is also cancelled when wm is closed
+func (wm *WifiManager) withClose(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	closed := wm.closedChan()
+	go func() {
+		select {
+		case <-closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (wm *WifiManager) shutdown() error {
+	if sc := wm.runningScanCache(); sc != nil {
+		sc.Stop()
+	}
+
+	errs := make([]string, 0)
+	for _, ic := range wm.controllers() {
+		// Wait for a TestConnect to notice that we are closing and clean up
+		ic.lock(context.Background())
+		hotspot := ic.hostapdCmd != nil || ic.dnsmasqCmd != nil || ic.portal != nil
+		supplicant := ic.wpaSupplicantCmd != nil
+		if hotspot {
+			if err := wm.stopHotspot(context.Background(), ic); err != nil {
+				errs = append(errs, fmt.Sprintf("Failed to stop hotspot on %v: %v", ic.name, err))
+			}
+		}
+		if supplicant {
+			if err := wm.stopWPASupplicant(context.Background(), ic); err != nil {
+				errs = append(errs, fmt.Sprintf("Failed to stop wpa_supplicant on %v: %v", ic.name, err))
+			}
+		}
+		wm.removeHotspotConfs(ic)
+		if hotspot || supplicant {
+			if err := wm.resetWifiInterface(context.Background(), ic.name); err != nil {
+				errs = append(errs, fmt.Sprintf("Failed to restore %v: %v", ic.name, err))
+			}
+		}
+		ic.unlock()
+	}
+	// DHCP clients started for supplicants we do not own
+	wm.dhcpMutex.Lock()
+	dhcpIfaces := make([]string, 0, len(wm.dhcp))
+	for iface := range wm.dhcp {
+		dhcpIfaces = append(dhcpIfaces, iface)
+	}
+	wm.dhcpMutex.Unlock()
+	for _, iface := range dhcpIfaces {
+		if err := wm.StopDHCP(iface); err != nil {
+			errs = append(errs, fmt.Sprintf("Failed to stop DHCP client: %v", err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	log.Infoln("Closed wifimanager")
+	return nil
+}
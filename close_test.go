@@ -0,0 +1,195 @@
+package wifimanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClose(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	wm.StopGracePeriod = 10 * time.Millisecond
+	wm.Hotspot.SSID = "setup"
+
+	require.Nil(wm.StartHotspot("wlan0"))
+	hostapdConf, dnsmasqConf := wm.controller("wlan0").hostapdConf, wm.controller("wlan0").dnsmasqConf
+	hostapd := executor.Processes("/usr/sbin/hostapd")[0]
+	hostapd.IgnoreTerm()
+	require.Nil(wm.StartWPASupplicant("wlan1", wm.WPAConfPath))
+	sc := wm.StartScanCache(context.Background(), ScanCacheConfig{Ifaces: []string{"wlan1"}})
+	links := wm.Links.(*FakeLinks)
+	ops := len(links.Ops())
+
+	// Concurrent calls all wait for the one shutdown
+	wg := sync.WaitGroup{}
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = wm.Close()
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.Nil(err)
+	}
+
+	require.Equal([]os.Signal{syscall.SIGTERM, os.Kill}, hostapd.Signals())
+	for _, name := range []string{"/usr/sbin/hostapd", "/usr/sbin/dnsmasq", "/sbin/wpa_supplicant"} {
+		for _, p := range executor.Processes(name) {
+			require.False(p.Running(), name)
+		}
+	}
+	require.False(wm.IsHostapdRunning())
+	require.False(wm.IsWPASupplicantRunning())
+	require.Empty(wm.Daemons())
+	for _, path := range []string{hostapdConf, dnsmasqConf} {
+		_, err := os.Stat(path)
+		require.True(os.IsNotExist(err), path)
+	}
+	select {
+	case <-sc.Done():
+	default:
+		require.Fail("Scan cache is still running")
+	}
+	require.Subset(links.Ops()[ops:], []string{
+		"link set wlan0 down", "addr flush dev wlan0", "link set wlan0 up",
+		"link set wlan1 down", "addr flush dev wlan1", "link set wlan1 up",
+	})
+
+	// Nothing more happens on later calls, and nothing can be started
+	calls := len(executor.Calls())
+	ops = len(links.Ops())
+	require.Nil(wm.Close())
+	require.Equal(ErrClosed, wm.StartHotspot("wlan0"))
+	require.Equal(ErrClosed, wm.StartWPASupplicant("wlan0", wm.WPAConfPath))
+	require.Equal(calls, len(executor.Calls()))
+	require.Equal(ops, len(links.Ops()))
+}
+
+func TestCloseAbortsTestConnect(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	wm.ConnectTimeout = time.Hour
+	executor.On("/sbin/iwgetid -r wlan0", FakeResult{ExitCode: 255})
+	network := &WPANetwork{SSID: "test", PSK: "8ac9f2d7ae608374d89283164d8fd8a877ddea7743391dffcdd6fd8f5f3a7755"}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- wm.TestConnect("wlan0", network)
+	}()
+	require.Eventually(func() bool {
+		return len(executor.Processes("/sbin/wpa_supplicant")) > 0
+	}, time.Second, time.Millisecond)
+
+	require.Nil(wm.Close())
+	select {
+	case err := <-result:
+		require.True(errors.Is(err, ErrClosed), "%v", err)
+	case <-time.After(time.Second):
+		require.Fail("TestConnect did not return")
+	}
+	require.False(executor.Processes("/sbin/wpa_supplicant")[0].Running())
+	failures, _ := wm.recentFailures("test")
+	require.Zero(failures)
+}
+
+func TestCloseStopsRun(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	wm.Hotspot.SSID = "setup"
+	executor.On("iw dev wlan0 scan", FakeResult{ExitCode: 240})
+
+	result := make(chan error, 1)
+	go func() {
+		result <- wm.Run(context.Background(), "wlan0", RunConfig{
+			MaxFailures:     1,
+			HotspotDuration: time.Hour,
+		})
+	}()
+	require.Eventually(func() bool {
+		return wm.State("wlan0") == StateHotspot && wm.IsHostapdRunning()
+	}, time.Second, time.Millisecond)
+
+	require.Nil(wm.Close())
+	select {
+	case err := <-result:
+		require.Equal(ErrClosed, err)
+	case <-time.After(time.Second):
+		require.Fail("Run did not return")
+	}
+	require.Equal(StateStopped, wm.State("wlan0"))
+	require.False(executor.Processes("/usr/sbin/hostapd")[0].Running())
+}
+
+func TestCloseUnused(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	require.Nil(wm.Close())
+	require.Empty(executor.Calls())
+
+	// A WifiManager that was not created through New can be closed too
+	require.Nil((&WifiManager{}).Close())
+}
+
+func TestCloseDuringOperations(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	wm.StopGracePeriod = 10 * time.Millisecond
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			iface := fmt.Sprintf("wlan%d", i)
+			for {
+				var err error
+				if i%2 == 0 {
+					err = wm.StartHotspot(iface)
+				} else {
+					err = wm.StartWPASupplicant(iface, wm.WPAConfPath)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	require.Eventually(func() bool {
+		return len(executor.Processes("/usr/sbin/hostapd")) > 5 && len(executor.Processes("/sbin/wpa_supplicant")) > 5
+	}, time.Second, time.Millisecond)
+	require.Nil(wm.Close())
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.Equal(ErrClosed, err)
+	}
+
+	// Whatever was started before Close got its turn was stopped by it
+	for _, p := range executor.Processes("") {
+		require.False(p.Running(), p.Cmdline)
+	}
+	require.Empty(wm.Daemons())
+}
@@ -2,28 +2,267 @@ package wifimanager
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"fmt"
 	"io"
+	"os"
+	"os/exec"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	simpleexec "github.com/gurupras/go-simpleexec"
 	log "github.com/sirupsen/logrus"
 )
 
-func runCmd(cmd string) error {
-	_cmd := simpleexec.ParseCmd(cmd)
-	return _cmd.Run()
+// Executor runs the external commands WifiManager depends on. The default
+// runs them for real; FakeExecutor scripts them for tests.
+type Executor interface {
+	// Run runs cmdline to completion and returns what it wrote to stdout.
+	// A non-zero exit status is reported as a *CmdError.
+	Run(cmdline string) (string, error)
+	// Start launches a long-running cmdline. Every line it writes to stdout
+	// or stderr is logged under tag and passed to onLine if it is not nil.
+	Start(cmdline string, tag string, onLine func(line string)) (Process, error)
+}
+
+// ContextExecutor is implemented by Executors whose commands can be
+// cancelled. Commands run by other Executors are abandoned on cancellation.
+type ContextExecutor interface {
+	// RunContext is Run, except that the command is stopped and ctx.Err()
+	// returned if ctx is done before it exits
+	RunContext(ctx context.Context, cmdline string) (string, error)
+}
+
+const (
+	// DefaultStopGracePeriod is how long a process is given to exit after
+	// SIGTERM before it is killed
+	DefaultStopGracePeriod = 5 * time.Second
+	// DefaultConnectTimeout bounds how long TestConnect waits for a connection
+	DefaultConnectTimeout = 10 * time.Second
+)
+
+// Process is a command started by an Executor
+type Process interface {
+	Pid() int
+	Signal(sig os.Signal) error
+	Kill() error
+	// Wait blocks until the process exits and returns its exit error. It
+	// may be called any number of times.
+	Wait() error
+	// Done is closed once the process has exited
+	Done() <-chan struct{}
+}
+
+// CmdError is returned by Executor.Run when a command fails
+type CmdError struct {
+	Cmdline  string
+	ExitCode int
+	Stderr   string
+	Err      error
+}
+
+func (e *CmdError) Error() string {
+	msg := fmt.Sprintf("'%v' failed", e.Cmdline)
+	if e.Err != nil {
+		msg = fmt.Sprintf("%v: %v", msg, e.Err)
+	} else {
+		msg = fmt.Sprintf("%v with exit status %d", msg, e.ExitCode)
+	}
+	if stderr := strings.TrimSpace(e.Stderr); len(stderr) > 0 {
+		msg = fmt.Sprintf("%v (stderr: %v)", msg, stderr)
+	}
+	return msg
+}
+
+func (e *CmdError) Unwrap() error {
+	return e.Err
+}
+
+// DefaultExecutor runs commands on the host
+var DefaultExecutor Executor = &execExecutor{}
+
+type execExecutor struct{}
+
+func (ee *execExecutor) Run(cmdline string) (string, error) {
+	return ee.RunContext(context.Background(), cmdline)
+}
+
+func (ee *execExecutor) RunContext(ctx context.Context, cmdline string) (string, error) {
+	cmd := simpleexec.ParseCmd(cmdline)
+	if cmd == nil {
+		return "", fmt.Errorf("Failed to parse command '%v'", cmdline)
+	}
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return "", &CmdError{Cmdline: cmdline, ExitCode: -1, Err: err}
+	}
+	p := &execProcess{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		p.err = cmd.Wait()
+		close(p.done)
+	}()
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		stopProcess(context.Background(), p, DefaultStopGracePeriod)
+		return "", ctx.Err()
+	}
+	if err := p.err; err != nil {
+		cmdErr := &CmdError{Cmdline: cmdline, Stderr: stderr.String()}
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			cmdErr.ExitCode = exitErr.ExitCode()
+		} else {
+			cmdErr.ExitCode = -1
+			cmdErr.Err = err
+		}
+		return stdout.String(), cmdErr
+	}
+	return stdout.String(), nil
+}
+
+func (ee *execExecutor) Start(cmdline string, tag string, onLine func(line string)) (Process, error) {
+	cmd, drained := wrapCmd(cmdline, tag, onLine)
+	if cmd == nil {
+		return nil, fmt.Errorf("Failed to parse command '%v'", cmdline)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Failed to start '%v': %v", cmdline, err)
+	}
+	p := &execProcess{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		// Wait closes the pipes, so let the output be read first
+		<-drained
+		p.err = cmd.Wait()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+type execProcess struct {
+	cmd  *simpleexec.Cmd
+	err  error
+	done chan struct{}
+}
+
+func (p *execProcess) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+func (p *execProcess) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+func (p *execProcess) Kill() error {
+	return p.cmd.Process.Kill()
+}
+
+func (p *execProcess) Wait() error {
+	<-p.done
+	return p.err
+}
+
+func (p *execProcess) Done() <-chan struct{} {
+	return p.done
+}
+
+// executor returns the Executor to use, so that a WifiManager that was not
+// created through New still works
+func (wm *WifiManager) executor() Executor {
+	if wm.Executor == nil {
+		return DefaultExecutor
+	}
+	return wm.Executor
+}
+
+func (wm *WifiManager) runCmdContext(ctx context.Context, cmd string) error {
+	_, err := runContext(ctx, wm.executor(), cmd)
+	return err
+}
+
+func (wm *WifiManager) gracePeriod() time.Duration {
+	if wm.StopGracePeriod == 0 {
+		return DefaultStopGracePeriod
+	}
+	return wm.StopGracePeriod
+}
+
+// runContext runs cmdline with executor until it exits or ctx is done
+func runContext(ctx context.Context, executor Executor, cmdline string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if ce, ok := executor.(ContextExecutor); ok {
+		return ce.RunContext(ctx, cmdline)
+	}
+	type result struct {
+		stdout string
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		stdout, err := executor.Run(cmdline)
+		results <- result{stdout, err}
+	}()
+	select {
+	case r := <-results:
+		return r.stdout, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// stopProcess sends p SIGTERM and kills it if it has not exited after grace,
+// or right away once ctx is done. It returns when p has exited.
+func stopProcess(ctx context.Context, p Process, grace time.Duration) error {
+	return stopProcessSignal(ctx, p, syscall.SIGTERM, grace)
+}
+
+// stopProcessSignal is stopProcess for daemons that are asked to exit with
+// another signal than SIGTERM
+func stopProcessSignal(ctx context.Context, p Process, sig os.Signal, grace time.Duration) error {
+	if s, ok := p.(*Supervised); ok {
+		s.StopRestarting()
+	}
+	p.Signal(sig)
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-p.Done():
+		return nil
+	case <-timer.C:
+		log.Warnf("Process %d did not exit within %v of %v, killing it", p.Pid(), grace, sig)
+	case <-ctx.Done():
+	}
+	p.Kill()
+	<-p.Done()
+	return ctx.Err()
 }
 
 func WrapCmd(cmd string, tag string) *simpleexec.Cmd {
+	command, _ := wrapCmd(cmd, tag, nil)
+	return command
+}
+
+// wrapCmd is WrapCmd with an optional callback that sees every line the
+// command writes to stdout or stderr. The returned channel is closed once
+// all of the output has been handled.
+func wrapCmd(cmd string, tag string, onLine func(line string)) (*simpleexec.Cmd, <-chan struct{}) {
 	command := simpleexec.ParseCmd(cmd)
 	if command == nil {
 		log.Errorf("Failed to parse command '%v'", cmd)
-		return nil
+		return nil, nil
 	}
 	stdout, _ := command.StdoutPipe()
 	stderr, _ := command.StderrPipe()
 
 	mergedChan := make(chan string, 10)
+	drained := make(chan struct{})
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 	stdHandler := func(stdFile io.ReadCloser) {
@@ -37,8 +276,12 @@ func WrapCmd(cmd string, tag string) *simpleexec.Cmd {
 	go stdHandler(stdout)
 	go stdHandler(stderr)
 	go func() {
+		defer close(drained)
 		for line := range mergedChan {
 			log.Infof("%v: %v", tag, line)
+			if onLine != nil {
+				onLine(line)
+			}
 		}
 	}()
 
@@ -47,5 +290,5 @@ func WrapCmd(cmd string, tag string) *simpleexec.Cmd {
 		close(mergedChan)
 	}()
 
-	return command
+	return command, drained
 }
@@ -0,0 +1,160 @@
+package wifimanager
+
+import (
+	"context"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultExecutor(t *testing.T) {
+	require := require.New(t)
+
+	stdout, err := DefaultExecutor.Run("echo hello")
+	require.Nil(err)
+	require.Equal("hello\n", stdout)
+
+	_, err = DefaultExecutor.Run("false")
+	require.NotNil(err)
+	cmdErr, ok := err.(*CmdError)
+	require.True(ok)
+	require.Equal(1, cmdErr.ExitCode)
+
+	_, err = DefaultExecutor.Run("/path/that/does/not/exist")
+	require.NotNil(err)
+
+	lines := make(chan string, 1)
+	p, err := DefaultExecutor.Start("echo started", "test", func(line string) {
+		lines <- line
+	})
+	require.Nil(err)
+	require.Nil(p.Wait())
+	select {
+	case line := <-lines:
+		require.Equal("started", line)
+	case <-time.After(time.Second):
+		require.Fail("Did not receive output")
+	}
+
+	p, err = DefaultExecutor.Start("sleep 10", "test", nil)
+	require.Nil(err)
+	require.True(p.Pid() > 0)
+	require.Nil(p.Signal(os.Interrupt))
+	select {
+	case <-p.Done():
+	case <-time.After(time.Second):
+		require.Fail("Process did not exit")
+	}
+	require.NotNil(p.Wait())
+}
+
+func TestFakeExecutor(t *testing.T) {
+	require := require.New(t)
+
+	fe := NewFakeExecutor()
+	fe.On("iwgetid", FakeResult{Stdout: "a\n"}, FakeResult{ExitCode: 255, Stderr: "not connected"})
+	fe.On("iwgetid -r wlan1", FakeResult{Stdout: "b\n"})
+
+	stdout, err := fe.Run("iwgetid -r wlan0")
+	require.Nil(err)
+	require.Equal("a\n", stdout)
+	for i := 0; i < 2; i++ {
+		_, err = fe.Run("iwgetid -r wlan0")
+		require.NotNil(err)
+		require.Equal(255, err.(*CmdError).ExitCode)
+		require.Contains(err.Error(), "not connected")
+	}
+	stdout, err = fe.Run("iwgetid -r wlan1")
+	require.Nil(err)
+	require.Equal("b\n", stdout)
+
+	stdout, err = fe.Run("ifconfig wlan0 up")
+	require.Nil(err)
+	require.Equal("", stdout)
+
+	mutex := sync.Mutex{}
+	lines := make([]string, 0)
+	fe.OnStart("hostapd", "wlan0: AP-ENABLED")
+	p, err := fe.Start("hostapd /tmp/hostapd.conf", "hostapd", func(line string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		lines = append(lines, line)
+	})
+	require.Nil(err)
+	require.Equal([]string{"wlan0: AP-ENABLED"}, lines)
+
+	fp := fe.Processes("hostapd")[0]
+	require.True(fp.Running())
+	require.Nil(p.Signal(os.Interrupt))
+	require.NotNil(p.Wait())
+	require.False(fp.Running())
+	require.Equal([]os.Signal{os.Interrupt}, fp.Signals())
+	require.Equal(os.ErrProcessDone, p.Kill())
+
+	p, err = fe.Start("dnsmasq -d", "dnsmasq", nil)
+	require.Nil(err)
+	fe.Processes("dnsmasq")[0].Exit(0)
+	require.Nil(p.Wait())
+
+	require.Equal([]string{
+		"iwgetid -r wlan0", "iwgetid -r wlan0", "iwgetid -r wlan0", "iwgetid -r wlan1",
+		"ifconfig wlan0 up", "hostapd /tmp/hostapd.conf", "dnsmasq -d",
+	}, fe.Calls())
+}
+
+func TestRunContext(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := runContext(ctx, DefaultExecutor, "sleep 10")
+	require.Equal(context.DeadlineExceeded, err)
+	require.True(time.Since(start) < 5*time.Second)
+
+	fe := NewFakeExecutor()
+	fe.On("iw", FakeResult{Delay: time.Hour})
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = runContext(ctx, fe, "iw dev wlan0 scan")
+	require.Equal(context.DeadlineExceeded, err)
+
+	// Executors that cannot cancel are abandoned
+	_, err = runContext(ctx, slowExecutor{fe}, "iw dev wlan0 scan")
+	require.Equal(context.DeadlineExceeded, err)
+}
+
+// slowExecutor hides the RunContext method of the executor it wraps
+type slowExecutor struct {
+	Executor
+}
+
+func TestStopProcess(t *testing.T) {
+	require := require.New(t)
+
+	fe := NewFakeExecutor()
+	p, err := fe.Start("hostapd", "hostapd", nil)
+	require.Nil(err)
+	require.Nil(stopProcess(context.Background(), p, time.Hour))
+	require.Equal([]os.Signal{syscall.SIGTERM}, fe.Processes("hostapd")[0].Signals())
+
+	// A process that ignores SIGTERM is killed after the grace period
+	p, err = fe.Start("hostapd", "hostapd", nil)
+	require.Nil(err)
+	fe.Processes("hostapd")[1].IgnoreTerm()
+	require.Nil(stopProcess(context.Background(), p, 10*time.Millisecond))
+	require.Equal([]os.Signal{syscall.SIGTERM, os.Kill}, fe.Processes("hostapd")[1].Signals())
+
+	// or right away once the context is done
+	p, err = fe.Start("hostapd", "hostapd", nil)
+	require.Nil(err)
+	fe.Processes("hostapd")[2].IgnoreTerm()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(context.Canceled, stopProcess(ctx, p, time.Hour))
+	require.False(fe.Processes("hostapd")[2].Running())
+}
@@ -0,0 +1,353 @@
+package wifimanager
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DHCPClient selects the program that obtains an address once wpa_supplicant
+// has associated
+type DHCPClient string
+
+const (
+	DHCPClientDhclient DHCPClient = "dhclient"
+	DHCPClientUdhcpc   DHCPClient = "udhcpc"
+	DHCPClientDhcpcd   DHCPClient = "dhcpcd"
+)
+
+// resolvConfPath is where the DHCP clients write the DNS servers they obtain
+var resolvConfPath = "/etc/resolv.conf"
+
+// Lease is the IPv4 configuration obtained by the DHCP client on an interface
+type Lease struct {
+	Iface   string
+	Address *net.IPNet
+	Gateway net.IP
+	DNS     []net.IP
+	// Obtained is when the lease was last bound or renewed
+	Obtained time.Time
+	// Expiry is zero if the lease does not expire or the client does not
+	// say when it does
+	Expiry time.Time
+}
+
+var (
+	dhclientBoundRegex  = regexp.MustCompile(`bound to (\S+) -- renewal in \d+ seconds`)
+	udhcpcLeaseRegex    = regexp.MustCompile(`lease of (\S+) obtained.*lease time (\d+)`)
+	dhcpcdLeaseRegex    = regexp.MustCompile(`leased (\S+) for (\d+|infinity)`)
+	dhclientExpireRegex = regexp.MustCompile(`^\s*expire (?:\d+ (\S+ \S+)|never);`)
+)
+
+// dhcpClient is the DHCP client of an interface. It exists from the moment
+// the interface should get one; cmd is set once it is started. Both cmd and
+// starting are guarded by dhcpMutex.
+type dhcpClient struct {
+	wm        *WifiManager
+	client    DHCPClient
+	iface     string
+	cmd       *Supervised
+	starting  bool
+	obtained  time.Time
+	leaseTime time.Duration
+	mutex     sync.Mutex
+}
+
+// StartDHCP runs the DHCP client selected by DHCPClient on iface. This is
+// done automatically when a wpa_supplicant started by this manager
+// associates, so it is only needed for other supplicants. The client is
+// stopped and its lease released by StopDHCP or StopWPASupplicant.
+func (wm *WifiManager) StartDHCP(iface string) error {
+	if wm.isClosed() {
+		return ErrClosed
+	}
+	if len(wm.DHCPClient) == 0 {
+		return fmt.Errorf("No DHCP client configured")
+	}
+	wm.enableDHCP(iface)
+	return wm.startDHCP(iface)
+}
+
+// StopDHCP stops the DHCP client on iface after releasing its lease
+func (wm *WifiManager) StopDHCP(iface string) error {
+	return wm.StopDHCPContext(context.Background(), iface)
+}
+
+// StopDHCPContext is StopDHCP, killing the client right away and returning
+// ctx.Err() once ctx is done
+func (wm *WifiManager) StopDHCPContext(ctx context.Context, iface string) error {
+	wm.dhcpMutex.Lock()
+	dc := wm.dhcp[iface]
+	delete(wm.dhcp, iface)
+	// A client that is still starting is released by startDHCP
+	running := dc != nil && dc.cmd != nil
+	wm.dhcpMutex.Unlock()
+	if !running {
+		return nil
+	}
+	err := dc.release(ctx)
+	log.Infof("Stopped %v on %v", dc.client, iface)
+	return err
+}
+
+// Lease returns the lease held by the DHCP client on iface. The error wraps
+// ErrNoDHCPLease if there is none yet.
+func (wm *WifiManager) Lease(iface string) (*Lease, error) {
+	wm.dhcpMutex.Lock()
+	dc := wm.dhcp[iface]
+	running := dc != nil && dc.cmd != nil
+	wm.dhcpMutex.Unlock()
+	if !running {
+		return nil, fmt.Errorf("No DHCP client on %v: %w", iface, ErrNoDHCPLease)
+	}
+	dc.mutex.Lock()
+	lease := &Lease{Iface: iface, Obtained: dc.obtained}
+	if dc.leaseTime > 0 {
+		lease.Expiry = dc.obtained.Add(dc.leaseTime)
+	}
+	dc.mutex.Unlock()
+	if lease.Obtained.IsZero() {
+		return nil, fmt.Errorf("%v has not obtained a lease: %w", iface, ErrNoDHCPLease)
+	}
+	if dc.client == DHCPClientDhclient {
+		if expiry, err := readDhclientExpiry(dc.leaseFile()); err == nil {
+			lease.Expiry = expiry
+		}
+	}
+
+	// The rest is read back from what the client configured
+	addrs, err := wm.links().Addresses(iface)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get address of %v: %w", iface, err)
+	}
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil && !addr.IP.IsLinkLocalUnicast() {
+			lease.Address = addr
+			break
+		}
+	}
+	if lease.Address == nil {
+		return nil, fmt.Errorf("%v has no address: %w", iface, ErrNoDHCPLease)
+	}
+	if routes, err := wm.links().Routes(iface); err == nil {
+		for _, route := range routes {
+			if route.IsDefault() && route.Gateway.To4() != nil {
+				lease.Gateway = route.Gateway
+				break
+			}
+		}
+	}
+	lease.DNS = readNameservers(resolvConfPath)
+	return lease, nil
+}
+
+// enableDHCP marks iface as one that should run a DHCP client once it is
+// associated
+func (wm *WifiManager) enableDHCP(iface string) {
+	if len(wm.DHCPClient) == 0 {
+		return
+	}
+	wm.dhcpMutex.Lock()
+	defer wm.dhcpMutex.Unlock()
+	if wm.dhcp == nil {
+		wm.dhcp = make(map[string]*dhcpClient)
+	}
+	if wm.dhcp[iface] == nil {
+		wm.dhcp[iface] = &dhcpClient{wm: wm, client: wm.DHCPClient, iface: iface}
+	}
+}
+
+// startDHCP starts the DHCP client of iface if it has one that is not
+// running yet
+func (wm *WifiManager) startDHCP(iface string) error {
+	wm.dhcpMutex.Lock()
+	dc := wm.dhcp[iface]
+	if dc == nil || dc.cmd != nil || dc.starting {
+		wm.dhcpMutex.Unlock()
+		return nil
+	}
+	dc.starting = true
+	wm.dhcpMutex.Unlock()
+
+	// Starting may be slow, so it is done without holding dhcpMutex
+	cmd, err := dc.start()
+
+	wm.dhcpMutex.Lock()
+	dc.starting = false
+	stopped := wm.dhcp[iface] != dc
+	if err == nil {
+		dc.cmd = cmd
+	}
+	wm.dhcpMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if stopped {
+		// StopDHCP was called in the meantime and left the client to us
+		return dc.release(context.Background())
+	}
+	log.Infof("Started %v on %v", dc.client, iface)
+	return nil
+}
+
+func (dc *dhcpClient) start() (*Supervised, error) {
+	cmdline, err := dc.cmdline()
+	if err != nil {
+		return nil, err
+	}
+	cmd, err := dc.wm.supervise(string(dc.client), dc.iface, cmdline, dc.handleLine)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start %v: %v", dc.client, err)
+	}
+	return cmd, nil
+}
+
+// hasLease reports whether the DHCP client of iface has obtained a lease
+func (wm *WifiManager) hasLease(iface string) bool {
+	wm.dhcpMutex.Lock()
+	dc := wm.dhcp[iface]
+	wm.dhcpMutex.Unlock()
+	if dc == nil {
+		return false
+	}
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	return !dc.obtained.IsZero()
+}
+
+func (wm *WifiManager) dhcpEnabled(iface string) bool {
+	wm.dhcpMutex.Lock()
+	defer wm.dhcpMutex.Unlock()
+	return wm.dhcp[iface] != nil
+}
+
+// dhclientDir holds the lease and pid files of dhclient. They are kept out
+// of RunDir itself so that RecoverOrphans does not mistake them for ours.
+func (dc *dhcpClient) dhclientDir() string {
+	return filepath.Join(dc.wm.runDir(), "dhclient")
+}
+
+func (dc *dhcpClient) leaseFile() string {
+	return filepath.Join(dc.dhclientDir(), dc.iface+".leases")
+}
+
+func (dc *dhcpClient) cmdline() (string, error) {
+	switch dc.client {
+	case DHCPClientDhclient:
+		if err := os.MkdirAll(dc.dhclientDir(), 0755); err != nil {
+			return "", fmt.Errorf("Failed to create dhclient directory: %v", err)
+		}
+		return fmt.Sprintf("/sbin/dhclient -d -v -pf %v -lf %v %v",
+			filepath.Join(dc.dhclientDir(), dc.iface+".pid"), dc.leaseFile(), dc.iface), nil
+	case DHCPClientUdhcpc:
+		// -R releases the lease when udhcpc is terminated
+		return fmt.Sprintf("/sbin/udhcpc -f -R -i %v", dc.iface), nil
+	case DHCPClientDhcpcd:
+		return fmt.Sprintf("/sbin/dhcpcd -B -4 %v", dc.iface), nil
+	default:
+		return "", fmt.Errorf("Unknown DHCP client '%v'", dc.client)
+	}
+}
+
+// handleLine notes the leases the client reports in its output
+func (dc *dhcpClient) handleLine(line string) {
+	var leaseTime time.Duration
+	if match := dhclientBoundRegex.FindStringSubmatch(line); match != nil {
+		// The lease time comes from the lease file
+	} else if match = udhcpcLeaseRegex.FindStringSubmatch(line); match != nil {
+		seconds, _ := strconv.Atoi(match[2])
+		leaseTime = time.Duration(seconds) * time.Second
+	} else if match = dhcpcdLeaseRegex.FindStringSubmatch(line); match != nil {
+		seconds, _ := strconv.Atoi(match[2])
+		leaseTime = time.Duration(seconds) * time.Second
+	} else {
+		return
+	}
+	dc.mutex.Lock()
+	dc.obtained = time.Now()
+	dc.leaseTime = leaseTime
+	dc.mutex.Unlock()
+	dc.wm.publish(&Event{Type: EventLeaseObtained, Iface: dc.iface, Level: -1, Raw: line, Time: time.Now()})
+}
+
+// release stops the client such that it gives up its lease first
+func (dc *dhcpClient) release(ctx context.Context) error {
+	grace := dc.wm.gracePeriod()
+	switch dc.client {
+	case DHCPClientDhcpcd:
+		// dhcpcd releases the lease and exits on SIGHUP
+		return stopProcessSignal(ctx, dc.cmd, syscall.SIGHUP, grace)
+	case DHCPClientDhclient:
+		// dhclient does not release on SIGTERM, but dhclient -r releases
+		// the lease in the lease file
+		err := stopProcess(ctx, dc.cmd, grace)
+		cmdline := fmt.Sprintf("/sbin/dhclient -r -pf %v -lf %v %v",
+			filepath.Join(dc.dhclientDir(), dc.iface+".pid"), dc.leaseFile(), dc.iface)
+		if _, releaseErr := runContext(ctx, dc.wm.executor(), cmdline); releaseErr != nil && err == nil {
+			err = fmt.Errorf("Failed to release lease: %v", releaseErr)
+		}
+		return err
+	default:
+		return stopProcess(ctx, dc.cmd, grace)
+	}
+}
+
+// readDhclientExpiry returns the expiry of the newest lease in a dhclient
+// lease file. The times in it are UTC.
+func readDhclientExpiry(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	var expiry time.Time
+	found := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		match := dhclientExpireRegex.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		found = true
+		expiry = time.Time{}
+		if len(match[1]) > 0 {
+			if expiry, err = time.Parse("2006/01/02 15:04:05", match[1]); err != nil {
+				return time.Time{}, fmt.Errorf("Bad expiry in %v: %v", path, err)
+			}
+		}
+	}
+	if !found {
+		return time.Time{}, fmt.Errorf("No lease in %v", path)
+	}
+	return expiry, nil
+}
+
+func readNameservers(path string) []net.IP {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	ret := make([]net.IP, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			if ip := net.ParseIP(fields[1]); ip != nil {
+				ret = append(ret, ip)
+			}
+		}
+	}
+	return ret
+}
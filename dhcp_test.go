@@ -0,0 +1,265 @@
+package wifimanager
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const connectedLine = "wlan0: CTRL-EVENT-CONNECTED - Connection to 00:11:22:33:44:55 completed [id=0 id_str=]"
+
+// newDHCPWifiManager returns a fake WifiManager whose wlan0 associates and
+// reports the address its DHCP client is given
+func newDHCPWifiManager(require *require.Assertions, client DHCPClient) (*WifiManager, *FakeExecutor, func()) {
+	wm, executor, cleanup := newFakeWifiManager(require)
+	wm.DHCPClient = client
+	wm.StopGracePeriod = 10 * time.Millisecond
+	executor.OnStart("/sbin/wpa_supplicant", connectedLine)
+	executor.On("/sbin/iwgetid -r wlan0", FakeResult{Stdout: "test\n"})
+
+	oldResolvConfPath := resolvConfPath
+	resolvConfPath = filepath.Join(wm.CtrlDir, "resolv.conf")
+	require.Nil(ioutil.WriteFile(resolvConfPath, []byte("# Generated\nnameserver 192.168.1.1\nnameserver 8.8.8.8\nsearch lan\n"), 0644))
+	return wm, executor, func() {
+		resolvConfPath = oldResolvConfPath
+		cleanup()
+	}
+}
+
+// configureLease sets wlan0 up the way its DHCP client would
+func configureLease(require *require.Assertions, wm *WifiManager) {
+	links := wm.Links.(*FakeLinks)
+	ip, addr, _ := net.ParseCIDR("192.168.1.23/24")
+	addr.IP = ip
+	require.Nil(links.AddAddress("wlan0", addr))
+	require.Nil(links.ReplaceRoute("wlan0", Route{Gateway: net.ParseIP("192.168.1.1")}))
+}
+
+func TestDHCPUdhcpc(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newDHCPWifiManager(require, DHCPClientUdhcpc)
+	defer cleanup()
+	executor.OnStart("/sbin/udhcpc", "udhcpc: lease of 192.168.1.23 obtained from 192.168.1.1, lease time 3600")
+
+	start := time.Now()
+	require.Nil(wm.StartWPASupplicant("wlan0", wm.WPAConfPath))
+	udhcpc := executor.Processes("/sbin/udhcpc")
+	require.Equal(1, len(udhcpc))
+	require.Equal("/sbin/udhcpc -f -R -i wlan0", udhcpc[0].Cmdline)
+	require.Equal(2, len(wm.Daemons()))
+
+	configureLease(require, wm)
+	lease, err := wm.Lease("wlan0")
+	require.Nil(err)
+	require.Equal("wlan0", lease.Iface)
+	require.Equal("192.168.1.23/24", lease.Address.String())
+	require.Equal("192.168.1.1", lease.Gateway.String())
+	require.Equal([]net.IP{net.ParseIP("192.168.1.1"), net.ParseIP("8.8.8.8")}, lease.DNS)
+	require.False(lease.Obtained.Before(start))
+	require.Equal(time.Hour, lease.Expiry.Sub(lease.Obtained))
+
+	// Another association does not start a second client
+	wm.supplicantLineHandler("wlan0")(connectedLine)
+	require.Equal(1, len(executor.Processes("/sbin/udhcpc")))
+
+	// udhcpc releases the lease on SIGTERM, before wpa_supplicant goes
+	require.Nil(wm.StopWPASupplicant("wlan0"))
+	require.Equal([]os.Signal{syscall.SIGTERM}, udhcpc[0].Signals())
+	_, err = wm.Lease("wlan0")
+	require.True(errors.Is(err, ErrNoDHCPLease), "%v", err)
+}
+
+func TestDHCPDhcpcd(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newDHCPWifiManager(require, DHCPClientDhcpcd)
+	defer cleanup()
+	executor.OnStart("/sbin/wpa_supplicant")
+
+	// Nothing is started before the association
+	require.Nil(wm.StartWPASupplicant("wlan0", wm.WPAConfPath))
+	require.Empty(executor.Processes("/sbin/dhcpcd"))
+	_, err := wm.Lease("wlan0")
+	require.True(errors.Is(err, ErrNoDHCPLease), "%v", err)
+
+	wm.supplicantLineHandler("wlan0")(connectedLine)
+	dhcpcd := executor.Processes("/sbin/dhcpcd -B -4 wlan0")
+	require.Equal(1, len(dhcpcd))
+	_, err = wm.Lease("wlan0")
+	require.True(errors.Is(err, ErrNoDHCPLease), "%v", err)
+
+	dhcpcd[0].Emit("wlan0: leased 192.168.1.23 for infinity")
+	configureLease(require, wm)
+	lease, err := wm.Lease("wlan0")
+	require.Nil(err)
+	require.True(lease.Expiry.IsZero())
+
+	// dhcpcd releases the lease on SIGHUP
+	require.Nil(wm.StopDHCP("wlan0"))
+	require.Equal(syscall.SIGHUP, dhcpcd[0].Signals()[0])
+	require.False(dhcpcd[0].Running())
+	require.Nil(wm.StopWPASupplicant("wlan0"))
+}
+
+func TestDHCPDhclient(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newDHCPWifiManager(require, DHCPClientDhclient)
+	defer cleanup()
+	executor.OnStart("/sbin/dhclient", "DHCPACK of 192.168.1.23 from 192.168.1.1", "bound to 192.168.1.23 -- renewal in 1612 seconds.")
+
+	// The supplicant is not ours, so the client is started by hand
+	require.NotNil((&WifiManager{}).StartDHCP("wlan0"))
+	require.Nil(wm.StartDHCP("wlan0"))
+	dir := filepath.Join(wm.RunDir, "dhclient")
+	require.Equal("/sbin/dhclient -d -v -pf "+dir+"/wlan0.pid -lf "+dir+"/wlan0.leases wlan0", executor.Processes("/sbin/dhclient")[0].Cmdline)
+
+	leases := `lease {
+  interface "wlan0";
+  fixed-address 192.168.1.20;
+  expire 1 2024/01/01 10:00:00;
+}
+lease {
+  interface "wlan0";
+  fixed-address 192.168.1.23;
+  option routers 192.168.1.1;
+  renew 2 2024/01/02 09:00:00;
+  expire 2 2024/01/02 12:00:00;
+}
+`
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, "wlan0.leases"), []byte(leases), 0644))
+	configureLease(require, wm)
+	lease, err := wm.Lease("wlan0")
+	require.Nil(err)
+	require.Equal(time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC), lease.Expiry)
+
+	// dhclient needs to be told to release the lease
+	require.Nil(wm.StopDHCP("wlan0"))
+	calls := executor.Calls()
+	require.Equal("/sbin/dhclient -r -pf "+dir+"/wlan0.pid -lf "+dir+"/wlan0.leases wlan0", calls[len(calls)-1])
+	require.False(executor.Processes("/sbin/dhclient")[0].Running())
+	require.Empty(wm.Daemons())
+}
+
+func TestConnectRequiresLease(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newDHCPWifiManager(require, DHCPClientUdhcpc)
+	defer cleanup()
+	wm.RequireIPAddress = true
+	wm.ConnectTimeout = 100 * time.Millisecond
+	network := &WPANetwork{SSID: "test", PSK: "8ac9f2d7ae608374d89283164d8fd8a877ddea7743391dffcdd6fd8f5f3a7755"}
+
+	executor.OnStart("/sbin/udhcpc")
+	err := wm.TestConnect("wlan0", network)
+	require.True(errors.Is(err, ErrNoDHCPLease), "%v", err)
+
+	executor.OnStart("/sbin/udhcpc", "udhcpc: lease of 192.168.1.23 obtained, lease time 3600")
+	require.Nil(wm.TestConnect("wlan0", network))
+
+	// Both clients were stopped with their supplicants
+	for _, p := range executor.Processes("/sbin/udhcpc") {
+		require.False(p.Running())
+	}
+}
+
+func TestReadDhclientExpiry(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "dhclient-")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "leases")
+
+	_, err = readDhclientExpiry(path)
+	require.NotNil(err)
+	require.Nil(ioutil.WriteFile(path, []byte("lease {\n  expire never;\n}\n"), 0644))
+	expiry, err := readDhclientExpiry(path)
+	require.Nil(err)
+	require.True(expiry.IsZero())
+	require.Nil(ioutil.WriteFile(path, []byte("lease {\n}\n"), 0644))
+	_, err = readDhclientExpiry(path)
+	require.NotNil(err)
+}
+
+// blockingExecutor holds up the start of the processes matching prefix
+// until release is closed
+type blockingExecutor struct {
+	Executor
+	prefix  string
+	started chan struct{}
+	release chan struct{}
+}
+
+func (be *blockingExecutor) Start(cmdline, name string, onLine func(line string)) (Process, error) {
+	if strings.HasPrefix(cmdline, be.prefix) {
+		be.started <- struct{}{}
+		<-be.release
+	}
+	return be.Executor.Start(cmdline, name, onLine)
+}
+
+func TestDHCPSlowStart(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newDHCPWifiManager(require, DHCPClientUdhcpc)
+	defer cleanup()
+	be := &blockingExecutor{Executor: executor, prefix: "/sbin/udhcpc", started: make(chan struct{}), release: make(chan struct{})}
+	wm.Executor = be
+
+	result := make(chan error, 1)
+	go func() {
+		result <- wm.StartDHCP("wlan0")
+	}()
+	<-be.started
+
+	// The getters and a second start do not wait for the client
+	var leaseErr, startErr error
+	var daemons []DaemonStatus
+	var ifaces []InterfaceStatus
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, leaseErr = wm.Lease("wlan0")
+		daemons = wm.Daemons()
+		ifaces = wm.Interfaces()
+		startErr = wm.StartDHCP("wlan0")
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.Fail("Blocked by the starting DHCP client")
+	}
+	require.True(errors.Is(leaseErr, ErrNoDHCPLease), "%v", leaseErr)
+	require.Empty(daemons)
+	require.Equal(1, len(ifaces))
+	require.Nil(startErr)
+	close(be.release)
+	require.Nil(<-result)
+	require.Equal(1, len(executor.Processes("/sbin/udhcpc")))
+	require.Equal(1, len(wm.Daemons()))
+	require.Nil(wm.StopDHCP("wlan0"))
+
+	// A client stopped while it starts is stopped once it is up
+	be.release = make(chan struct{})
+	go func() {
+		result <- wm.StartDHCP("wlan0")
+	}()
+	<-be.started
+	require.Nil(wm.StopDHCP("wlan0"))
+	close(be.release)
+	require.Nil(<-result)
+	udhcpc := executor.Processes("/sbin/udhcpc")
+	require.Equal(2, len(udhcpc))
+	require.False(udhcpc[1].Running())
+	require.Empty(wm.Daemons())
+}
@@ -0,0 +1,146 @@
+package wifimanager
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EAPNetwork describes a WPA-Enterprise (802.1X) network
+type EAPNetwork struct {
+	SSID string
+	// EAP is the outer method, e.g. PEAP, TTLS or TLS
+	EAP               string
+	Identity          string
+	AnonymousIdentity string
+	// Password is the credential for PEAP and TTLS
+	Password string
+	CACert   string
+	// ClientCert and PrivateKey are required for TLS
+	ClientCert         string
+	PrivateKey         string
+	PrivateKeyPassword string
+	// Phase2 is the inner authentication, e.g. "auth=MSCHAPV2"
+	Phase2 string
+}
+
+var eapMethods = map[string]bool{
+	"PEAP": true, "TTLS": true, "TLS": true, "PWD": true, "FAST": true, "LEAP": true,
+}
+
+// eapOptions are the 802.1X options that WPANetwork does not model
+var eapOptions = []string{
+	"phase1", "ca_path", "subject_match", "altsubject_match", "domain_match",
+	"domain_suffix_match", "ca_cert2", "client_cert2", "private_key2",
+	"private_key2_passwd", "pac_file", "fragment_size", "eapol_flags",
+}
+
+// clearEAP removes the 802.1X settings from wn, for when it is turned into
+// a network of another kind
+func (wn *WPANetwork) clearEAP() {
+	wn.EAP = ""
+	wn.Identity = ""
+	wn.AnonymousIdentity = ""
+	wn.EAPPassword = ""
+	wn.CACert = ""
+	wn.ClientCert = ""
+	wn.PrivateKey = ""
+	wn.PrivateKeyPassword = ""
+	wn.Phase2 = ""
+	for _, key := range eapOptions {
+		delete(wn.Options, key)
+	}
+}
+
+// WPANetwork validates en and returns the equivalent network block
+func (en *EAPNetwork) WPANetwork() (*WPANetwork, error) {
+	if err := validateSSID(en.SSID); err != nil {
+		return nil, err
+	}
+	method := strings.ToUpper(en.EAP)
+	if !eapMethods[method] {
+		return nil, fmt.Errorf("Unsupported EAP method '%v'", en.EAP)
+	}
+	if len(en.Identity) == 0 {
+		return nil, fmt.Errorf("EAP network '%v' needs an identity", en.SSID)
+	}
+	switch method {
+	case "TLS":
+		if len(en.ClientCert) == 0 || len(en.PrivateKey) == 0 {
+			return nil, fmt.Errorf("EAP-TLS network '%v' needs a client certificate and private key", en.SSID)
+		}
+	case "PEAP", "TTLS", "PWD", "LEAP":
+		if len(en.Password) == 0 {
+			return nil, fmt.Errorf("EAP-%v network '%v' needs a password", method, en.SSID)
+		}
+	}
+	network := &WPANetwork{
+		SSID:               en.SSID,
+		KeyMgmt:            "WPA-EAP",
+		EAP:                method,
+		Identity:           en.Identity,
+		AnonymousIdentity:  en.AnonymousIdentity,
+		EAPPassword:        en.Password,
+		CACert:             en.CACert,
+		ClientCert:         en.ClientCert,
+		PrivateKey:         en.PrivateKey,
+		PrivateKeyPassword: en.PrivateKeyPassword,
+		Phase2:             en.Phase2,
+	}
+	if err := network.checkCertPaths(); err != nil {
+		return nil, err
+	}
+	return network, nil
+}
+
+// checkCertPaths returns an error if any certificate or key file the network
+// refers to does not exist
+func (wn *WPANetwork) checkCertPaths() error {
+	for _, path := range []string{wn.CACert, wn.ClientCert, wn.PrivateKey} {
+		// wpa_supplicant also accepts blobs and system stores by URI
+		if len(path) == 0 || strings.Contains(path, "://") {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("Certificate for network '%v' is not accessible: %v", wn.SSID, err)
+		}
+	}
+	return nil
+}
+
+// AddEAPNetworkConf adds a WPA-Enterprise network to the WPA conf file. If a
+// network with the same SSID is already present its credentials are replaced
+// instead, and any duplicate blocks for that SSID are removed.
+func (wm *WifiManager) AddEAPNetworkConf(en EAPNetwork) error {
+	network, err := en.WPANetwork()
+	if err != nil {
+		return err
+	}
+	return wm.updateConf(func(conf *WPAConf) error {
+		existing := conf.Network(en.SSID)
+		if existing == nil {
+			conf.Networks = append(conf.Networks, network)
+			return nil
+		}
+		// Credentials of another kind must not linger in the block
+		existing.PSK = ""
+		existing.Password = ""
+		existing.SAEPassword = ""
+		existing.IEEE80211W = network.IEEE80211W
+		existing.clearEAP()
+		existing.KeyMgmt = network.KeyMgmt
+		existing.EAP = network.EAP
+		existing.Identity = network.Identity
+		existing.AnonymousIdentity = network.AnonymousIdentity
+		existing.EAPPassword = network.EAPPassword
+		existing.CACert = network.CACert
+		existing.ClientCert = network.ClientCert
+		existing.PrivateKey = network.PrivateKey
+		existing.PrivateKeyPassword = network.PrivateKeyPassword
+		existing.Phase2 = network.Phase2
+		conf.Networks = removeNetworks(conf.Networks, func(wn *WPANetwork) bool {
+			return wn != existing && wn.SSID == en.SSID
+		})
+		return nil
+	})
+}
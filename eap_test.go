@@ -0,0 +1,145 @@
+package wifimanager
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEAPNetwork(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "eap-")
+	require.Nil(err)
+	caCert := filepath.Join(dir, "ca.pem")
+	require.Nil(ioutil.WriteFile(caCert, []byte("cert"), 0600))
+
+	peap := EAPNetwork{
+		SSID:              "corp",
+		EAP:               "peap",
+		Identity:          "alice",
+		AnonymousIdentity: "anonymous",
+		Password:          `pa"ss`,
+		CACert:            caCert,
+		Phase2:            "auth=MSCHAPV2",
+	}
+	network, err := peap.WPANetwork()
+	require.Nil(err)
+	require.Equal("WPA-EAP", network.KeyMgmt)
+	require.Equal("PEAP", network.EAP)
+
+	block := network.AsConf()
+	for _, line := range []string{
+		`ssid="corp"`, "key_mgmt=WPA-EAP", "eap=PEAP", `identity="alice"`,
+		`anonymous_identity="anonymous"`, "password=7061227373", `ca_cert="` + caCert + `"`,
+		`phase2="auth=MSCHAPV2"`,
+	} {
+		require.Contains(block, "\t"+line+"\n")
+	}
+	parsed := ParseWPANetwork(strings.TrimSpace(block))
+	require.NotNil(parsed)
+	for _, key := range []string{"ssid", "key_mgmt", "eap", "identity", "anonymous_identity", "password", "ca_cert", "phase2"} {
+		expected, _ := network.Get(key)
+		value, _ := parsed.Get(key)
+		require.Equal(expected, value, key)
+	}
+	require.Equal(`pa"ss`, parsed.EAPPassword)
+
+	invalid := []EAPNetwork{
+		{SSID: "corp", EAP: "MD5", Identity: "alice", Password: "secret"},
+		{SSID: "corp", EAP: "PEAP", Password: "secret"},
+		{SSID: "corp", EAP: "PEAP", Identity: "alice"},
+		{SSID: "corp", EAP: "TLS", Identity: "alice", ClientCert: caCert},
+		{SSID: "corp", EAP: "TTLS", Identity: "alice", Password: "secret", CACert: filepath.Join(dir, "missing.pem")},
+	}
+	for _, en := range invalid {
+		_, err = en.WPANetwork()
+		require.NotNil(err, "%v", en)
+	}
+}
+
+func TestAddEAPNetworkConf(t *testing.T) {
+	require := require.New(t)
+
+	wm, _, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+
+	dir := filepath.Dir(wm.WPAConfPath)
+	for _, name := range []string{"ca.pem", "client.pem", "client.key"} {
+		require.Nil(ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0600))
+	}
+
+	tls := EAPNetwork{
+		SSID:               "test",
+		EAP:                "TLS",
+		Identity:           "device@example.com",
+		CACert:             filepath.Join(dir, "ca.pem"),
+		ClientCert:         filepath.Join(dir, "client.pem"),
+		PrivateKey:         filepath.Join(dir, "client.key"),
+		PrivateKeyPassword: "secret",
+	}
+	require.Nil(wm.AddEAPNetworkConf(tls))
+
+	conf, err := ReadWPAConf(wm.WPAConfPath)
+	require.Nil(err)
+	require.Equal(2, len(conf.Networks))
+	network := conf.Network("test")
+	require.Equal("WPA-EAP", network.KeyMgmt)
+	require.Equal("", network.PSK)
+	require.Equal(tls.PrivateKey, network.PrivateKey)
+	require.Equal("secret", network.PrivateKeyPassword)
+
+	original, err := ioutil.ReadFile(wm.WPAConfPath)
+	require.Nil(err)
+
+	// Pointing the network at a missing certificate leaves the file alone
+	err = wm.UpdateNetwork("test", func(network *WPANetwork) error {
+		network.CACert = filepath.Join(dir, "missing.pem")
+		return nil
+	})
+	require.NotNil(err)
+	data, err := ioutil.ReadFile(wm.WPAConfPath)
+	require.Nil(err)
+	require.Equal(original, data)
+
+	require.Nil(wm.SetPriority("test", 5))
+}
+
+func TestAddEAPNetworkConfInPlace(t *testing.T) {
+	require := require.New(t)
+
+	wm, _, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	peap := EAPNetwork{SSID: "test", EAP: "PEAP", Identity: "alice", Password: "secret", Phase2: "auth=MSCHAPV2"}
+	require.Nil(wm.AddEAPNetworkConf(peap))
+	require.Nil(wm.SetPriority("test", 5))
+	require.Nil(wm.SetStaticConfig("test", &StaticConfig{Addresses: []string{"192.168.1.10/24"}}))
+	before, err := ReadWPAConf(wm.WPAConfPath)
+	require.Nil(err)
+	idStr := before.Network("test").IDStr
+	require.NotEmpty(idStr)
+
+	// Saving the network again only changes its credentials
+	peap.Identity = "bob"
+	peap.Phase2 = ""
+	require.Nil(wm.AddEAPNetworkConf(peap))
+	conf, err := ReadWPAConf(wm.WPAConfPath)
+	require.Nil(err)
+	require.Equal(len(before.Networks), len(conf.Networks))
+	for idx, network := range before.Networks {
+		require.Equal(network.SSID, conf.Networks[idx].SSID)
+	}
+	network := conf.Network("test")
+	require.Equal("", network.PSK)
+	require.Equal("WPA-EAP", network.KeyMgmt)
+	require.Equal("bob", network.Identity)
+	require.Equal("", network.Phase2)
+	require.Equal(5, network.Priority)
+	require.Equal(idStr, network.IDStr)
+	static, err := wm.StaticConfig("test")
+	require.Nil(err)
+	require.Equal([]string{"192.168.1.10/24"}, static.Addresses)
+}
@@ -0,0 +1,83 @@
+package wifimanager
+
+import (
+	"errors"
+)
+
+// Errors returned by TestConnect, wrapped with the interface and SSID.
+// Use errors.Is to tell them apart.
+var (
+	// ErrNetworkNotFound means the SSID did not appear in any scan
+	ErrNetworkNotFound = errors.New("network not found")
+	// ErrAuthFailed means the access point rejected our credentials,
+	// usually because the password is wrong
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrAssocTimeout means the network was visible but we did not manage to
+	// associate with it in time
+	ErrAssocTimeout = errors.New("association timed out")
+	// ErrNoDHCPLease means we associated but the interface never got an
+	// IPv4 address
+	ErrNoDHCPLease = errors.New("no DHCP lease")
+)
+
+// connectAttempt collects what supplicant events and scan results tell us
+// about a connection attempt to ssid
+type connectAttempt struct {
+	ssid string
+	// scanned is set once we have seen at least one set of scan results
+	scanned bool
+	// seen is set if ssid was in any of those scan results
+	seen      bool
+	connected bool
+	err       error
+}
+
+func (ca *connectAttempt) handleEvent(e *Event) {
+	switch e.Type {
+	case EventConnected:
+		ca.connected = true
+	case EventDisconnected:
+		ca.connected = false
+	case EventWrongKey, EventAuthReject:
+		ca.err = ErrAuthFailed
+	case EventSSIDTempDisabled:
+		if e.ReasonText == "WRONG_KEY" || e.ReasonText == "AUTH_FAILED" {
+			ca.err = ErrAuthFailed
+		}
+	}
+}
+
+func (ca *connectAttempt) handleScanResults(results []*WPAScanResult) {
+	ca.scanned = true
+	for _, result := range results {
+		if result.SSID == ca.ssid {
+			ca.seen = true
+		}
+	}
+}
+
+// failure returns the error to report when the attempt did not succeed
+// before the timeout
+func (ca *connectAttempt) failure() error {
+	if ca.err != nil {
+		return ca.err
+	}
+	if ca.scanned && !ca.seen {
+		return ErrNetworkNotFound
+	}
+	return ErrAssocTimeout
+}
+
+// hasIPv4Address reports whether iface has a non-link-local IPv4 address
+func (wm *WifiManager) hasIPv4Address(iface string) bool {
+	addrs, err := wm.links().Addresses(iface)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ip := addr.IP.To4(); ip != nil && !ip.IsLinkLocalUnicast() {
+			return true
+		}
+	}
+	return false
+}
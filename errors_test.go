@@ -0,0 +1,56 @@
+package wifimanager
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectAttemptFailure(t *testing.T) {
+	require := require.New(t)
+
+	// Nothing learned at all
+	attempt := &connectAttempt{ssid: "home"}
+	require.Equal(ErrAssocTimeout, attempt.failure())
+
+	// Scanned but never saw the network
+	attempt.handleEvent(ParseEvent("wlan0", "<3>CTRL-EVENT-SCAN-RESULTS "))
+	attempt.handleScanResults([]*WPAScanResult{{SSID: "neighbour"}})
+	require.Equal(ErrNetworkNotFound, attempt.failure())
+
+	// Saw it but could not associate
+	attempt.handleScanResults([]*WPAScanResult{{SSID: "home"}})
+	require.Equal(ErrAssocTimeout, attempt.failure())
+
+	// Wrong password
+	attempt.handleEvent(ParseEvent("wlan0", `<3>CTRL-EVENT-SSID-TEMP-DISABLED id=0 ssid="home" auth_failures=1 duration=10 reason=WRONG_KEY`))
+	require.Equal(ErrAuthFailed, attempt.failure())
+
+	attempt = &connectAttempt{ssid: "home"}
+	attempt.handleEvent(ParseEvent("wlan0", `<3>CTRL-EVENT-SSID-TEMP-DISABLED id=0 ssid="home" auth_failures=1 duration=10 reason=CONN_FAILED`))
+	require.Nil(attempt.err)
+	attempt.handleEvent(ParseEvent("wlan0", "wlan0: WPA: 4-Way Handshake failed - pre-shared key may be incorrect"))
+	require.Equal(ErrAuthFailed, attempt.err)
+}
+
+func TestConnectAttemptConnected(t *testing.T) {
+	require := require.New(t)
+
+	attempt := &connectAttempt{ssid: "home"}
+	attempt.handleEvent(ParseEvent("wlan0", "<3>CTRL-EVENT-CONNECTED - Connection to 00:11:22:33:44:55 completed [id=0 id_str=]"))
+	require.True(attempt.connected)
+	attempt.handleEvent(ParseEvent("wlan0", "<3>CTRL-EVENT-DISCONNECTED bssid=00:11:22:33:44:55 reason=3"))
+	require.False(attempt.connected)
+}
+
+func TestConnectErrorsIs(t *testing.T) {
+	require := require.New(t)
+
+	err := fmt.Errorf("Failed to connect '%v' to SSID %v: %w", "wlan0", "home", ErrAuthFailed)
+	require.True(errors.Is(err, ErrAuthFailed))
+	require.False(errors.Is(err, ErrNetworkNotFound))
+
+	require.False((&WifiManager{}).hasIPv4Address("does-not-exist0"))
+}
@@ -0,0 +1,206 @@
+package wifimanager
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type EventType string
+
+const (
+	EventConnected        EventType = "CTRL-EVENT-CONNECTED"
+	EventDisconnected     EventType = "CTRL-EVENT-DISCONNECTED"
+	EventSSIDTempDisabled EventType = "CTRL-EVENT-SSID-TEMP-DISABLED"
+	EventScanResults      EventType = "CTRL-EVENT-SCAN-RESULTS"
+	EventAuthReject       EventType = "CTRL-EVENT-AUTH-REJECT"
+	// EventWrongKey is reported when the 4-way handshake fails, which
+	// almost always means the passphrase is wrong
+	EventWrongKey EventType = "WRONG_KEY"
+	// EventKnownNetworkAppeared is published by a ScanCache when a network
+	// from the WPA conf file comes into range
+	EventKnownNetworkAppeared EventType = "KNOWN_NETWORK_APPEARED"
+	// EventLeaseObtained is published when the DHCP client of an interface
+	// obtains or renews a lease
+	EventLeaseObtained EventType = "LEASE_OBTAINED"
+)
+
+// Event is a connection state change reported by wpa_supplicant
+type Event struct {
+	Type  EventType
+	Iface string
+	// Level is the message priority from the <N> prefix of control socket
+	// messages, or -1 for messages read from stdout
+	Level     int
+	BSSID     string
+	SSID      string
+	NetworkID int
+	IDStr     string
+	// Reason is the IEEE 802.11 reason code of a disconnect or the status
+	// code of an authentication rejection
+	Reason int
+	// ReasonText is the symbolic reason of CTRL-EVENT-SSID-TEMP-DISABLED,
+	// e.g. WRONG_KEY or CONN_FAILED
+	ReasonText       string
+	LocallyGenerated bool
+	Raw              string
+	Time             time.Time
+}
+
+var eventLevelRegex = regexp.MustCompile(`^<(?P<level>\d+)>`)
+var connectedRegex = regexp.MustCompile(`Connection to (?P<bssid>[0-9a-fA-F:]{17}) completed`)
+var eventArgRegex = regexp.MustCompile(`(\w+)=("[^"]*"|[^\s\]]*)`)
+
+const wrongKeyMessage = "4-Way Handshake failed - pre-shared key may be incorrect"
+
+// ParseEvent parses a wpa_supplicant message, either as received on the
+// control socket ("<3>CTRL-EVENT-...") or as printed to stdout
+// ("wlan0: CTRL-EVENT-..."). It returns nil for messages that are not
+// connection events.
+func ParseEvent(iface, msg string) *Event {
+	e := &Event{
+		Iface:     iface,
+		Level:     -1,
+		NetworkID: -1,
+		Raw:       msg,
+		Time:      time.Now(),
+	}
+	line := strings.TrimSpace(msg)
+	if match := eventLevelRegex.FindStringSubmatch(line); len(match) > 0 {
+		m := mapSubexpNames(match, eventLevelRegex.SubexpNames())
+		e.Level, _ = strconv.Atoi(m["level"])
+		line = line[len(match[0]):]
+	}
+	if idx := strings.Index(line, ": "); idx > 0 && !strings.ContainsAny(line[:idx], " \t") && line[:idx] != "WPA" {
+		// Messages on stdout are prefixed with the interface name
+		e.Iface = line[:idx]
+		line = line[idx+2:]
+	}
+
+	if strings.Contains(line, wrongKeyMessage) {
+		e.Type = EventWrongKey
+		return e
+	}
+
+	fields := strings.SplitN(line, " ", 2)
+	args := ""
+	if len(fields) == 2 {
+		args = fields[1]
+	}
+	switch EventType(fields[0]) {
+	case EventConnected:
+		if match := connectedRegex.FindStringSubmatch(args); len(match) > 0 {
+			e.BSSID = mapSubexpNames(match, connectedRegex.SubexpNames())["bssid"]
+		}
+	case EventDisconnected, EventSSIDTempDisabled, EventScanResults:
+	case EventAuthReject:
+		// The BSSID is the first, unnamed argument
+		if parts := strings.Fields(args); len(parts) > 0 && !strings.Contains(parts[0], "=") {
+			e.BSSID = parts[0]
+		}
+	default:
+		return nil
+	}
+	e.Type = EventType(fields[0])
+	e.parseArgs(args)
+	return e
+}
+
+func (e *Event) parseArgs(args string) {
+	for _, match := range eventArgRegex.FindAllStringSubmatch(args, -1) {
+		key, value := match[1], match[2]
+		switch key {
+		case "bssid":
+			e.BSSID = value
+		case "ssid":
+			e.SSID, _ = parseString(value)
+		case "id":
+			e.NetworkID, _ = strconv.Atoi(value)
+		case "id_str":
+			e.IDStr = value
+		case "reason":
+			if n, err := strconv.Atoi(value); err == nil {
+				e.Reason = n
+			} else {
+				e.ReasonText = value
+			}
+		case "status_code":
+			e.Reason, _ = strconv.Atoi(value)
+		case "locally_generated":
+			e.LocallyGenerated = value == "1"
+		}
+	}
+}
+
+// Subscribe returns a channel on which every event from the wpa_supplicant
+// instances this manager started or monitors is delivered, and a function
+// that cancels the subscription. Events are dropped for subscribers that do
+// not keep up.
+func (wm *WifiManager) Subscribe() (<-chan *Event, func()) {
+	ch := make(chan *Event, 32)
+	wm.eventMutex.Lock()
+	if wm.subscribers == nil {
+		wm.subscribers = make(map[chan *Event]struct{})
+	}
+	wm.subscribers[ch] = struct{}{}
+	wm.eventMutex.Unlock()
+
+	cancel := func() {
+		wm.eventMutex.Lock()
+		defer wm.eventMutex.Unlock()
+		if _, ok := wm.subscribers[ch]; ok {
+			delete(wm.subscribers, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+func (wm *WifiManager) publish(e *Event) {
+	log.Debugf("Event %v on %v: %v", e.Type, e.Iface, e.Raw)
+	wm.eventMutex.Lock()
+	defer wm.eventMutex.Unlock()
+	for ch := range wm.subscribers {
+		select {
+		case ch <- e:
+		default:
+			log.Warnf("Dropping %v event for slow subscriber", e.Type)
+		}
+	}
+}
+
+// publishLine publishes the event in a line of wpa_supplicant output, if any
+func (wm *WifiManager) publishLine(iface, line string) {
+	if e := ParseEvent(iface, line); e != nil {
+		wm.publish(e)
+	}
+}
+
+// MonitorSupplicant attaches to the control socket of the wpa_supplicant
+// running on iface and publishes its events to subscribers. This is only
+// needed for a supplicant this manager did not start; the output of those
+// started by StartWPASupplicant is monitored already. Call the returned
+// function to stop monitoring.
+func (wm *WifiManager) MonitorSupplicant(iface string) (func(), error) {
+	ctrl, err := wm.DialSupplicant(iface)
+	if err != nil {
+		return nil, err
+	}
+	if err = ctrl.Attach(); err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	go func() {
+		for msg := range ctrl.Messages() {
+			wm.publishLine(iface, msg)
+		}
+	}()
+	stop := func() {
+		ctrl.Detach()
+		ctrl.Close()
+	}
+	return stop, nil
+}
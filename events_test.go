@@ -0,0 +1,105 @@
+package wifimanager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEvent(t *testing.T) {
+	require := require.New(t)
+
+	e := ParseEvent("wlan0", "<3>CTRL-EVENT-CONNECTED - Connection to 00:11:22:33:44:55 completed [id=2 id_str=home]")
+	require.NotNil(e)
+	require.Equal(EventConnected, e.Type)
+	require.Equal(3, e.Level)
+	require.Equal("wlan0", e.Iface)
+	require.Equal("00:11:22:33:44:55", e.BSSID)
+	require.Equal(2, e.NetworkID)
+	require.Equal("home", e.IDStr)
+
+	e = ParseEvent("", "wlan1: CTRL-EVENT-DISCONNECTED bssid=00:11:22:33:44:55 reason=3 locally_generated=1")
+	require.NotNil(e)
+	require.Equal(EventDisconnected, e.Type)
+	require.Equal(-1, e.Level)
+	require.Equal("wlan1", e.Iface)
+	require.Equal("00:11:22:33:44:55", e.BSSID)
+	require.Equal(3, e.Reason)
+	require.True(e.LocallyGenerated)
+
+	e = ParseEvent("wlan0", `<3>CTRL-EVENT-SSID-TEMP-DISABLED id=0 ssid="my home" auth_failures=1 duration=10 reason=WRONG_KEY`)
+	require.NotNil(e)
+	require.Equal(EventSSIDTempDisabled, e.Type)
+	require.Equal("my home", e.SSID)
+	require.Equal(0, e.NetworkID)
+	require.Equal("WRONG_KEY", e.ReasonText)
+
+	e = ParseEvent("wlan0", "<3>CTRL-EVENT-AUTH-REJECT 00:11:22:33:44:55 auth_type=0 auth_transaction=2 status_code=1")
+	require.NotNil(e)
+	require.Equal(EventAuthReject, e.Type)
+	require.Equal("00:11:22:33:44:55", e.BSSID)
+	require.Equal(1, e.Reason)
+
+	e = ParseEvent("wlan0", "wlan0: WPA: 4-Way Handshake failed - pre-shared key may be incorrect")
+	require.NotNil(e)
+	require.Equal(EventWrongKey, e.Type)
+
+	e = ParseEvent("wlan0", "<3>CTRL-EVENT-SCAN-RESULTS ")
+	require.NotNil(e)
+	require.Equal(EventScanResults, e.Type)
+
+	require.Nil(ParseEvent("wlan0", "<3>CTRL-EVENT-BSS-ADDED 0 00:11:22:33:44:55"))
+	require.Nil(ParseEvent("wlan0", "Successfully initialized wpa_supplicant"))
+}
+
+func TestSubscribe(t *testing.T) {
+	require := require.New(t)
+
+	wm := &WifiManager{}
+	ch1, cancel1 := wm.Subscribe()
+	ch2, cancel2 := wm.Subscribe()
+	defer cancel2()
+
+	wm.publishLine("wlan0", "wlan0: CTRL-EVENT-SCAN-RESULTS ")
+	wm.publishLine("wlan0", "wlan0: Trying to associate with 00:11:22:33:44:55")
+	require.Equal(EventScanResults, (<-ch1).Type)
+	require.Equal(EventScanResults, (<-ch2).Type)
+
+	cancel1()
+	cancel1()
+	_, ok := <-ch1
+	require.False(ok)
+	require.Equal(0, len(ch2))
+}
+
+func TestMonitorSupplicant(t *testing.T) {
+	require := require.New(t)
+
+	fs := newFakeSupplicant(require, map[string]string{
+		"ATTACH": "OK\n",
+		"DETACH": "OK\n",
+	})
+	defer fs.Close()
+
+	wm := &WifiManager{CtrlDir: fs.dir}
+	events, cancel := wm.Subscribe()
+	defer cancel()
+
+	stop, err := wm.MonitorSupplicant("wlan0")
+	require.Nil(err)
+	defer stop()
+
+	fs.send("<3>CTRL-EVENT-DISCONNECTED bssid=00:11:22:33:44:55 reason=15")
+	select {
+	case e := <-events:
+		require.Equal(EventDisconnected, e.Type)
+		require.Equal("wlan0", e.Iface)
+		require.Equal(15, e.Reason)
+	case <-time.After(time.Second):
+		require.Fail("Did not receive event")
+	}
+
+	_, err = wm.MonitorSupplicant("wlan1")
+	require.NotNil(err)
+}
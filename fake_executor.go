@@ -0,0 +1,276 @@
+package wifimanager
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FakeResult is the canned outcome of a command run by a FakeExecutor
+type FakeResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	// Err, if set, is returned as though the command could not be started
+	Err error
+	// Delay is how long the command takes to run
+	Delay time.Duration
+}
+
+// FakeExecutor is an Executor for tests. It records every command and
+// answers from a script instead of running anything, so WifiManager can be
+// exercised without root or a radio.
+type FakeExecutor struct {
+	// Default is the result of commands that have no script. Zero means
+	// success with no output.
+	Default FakeResult
+
+	calls     []string
+	scripts   []*fakeScript
+	processes []*FakeProcess
+	nextPid   int
+	sync.Mutex
+}
+
+type fakeScript struct {
+	prefix  string
+	start   bool
+	results []FakeResult
+	lines   []string
+}
+
+func NewFakeExecutor() *FakeExecutor {
+	return &FakeExecutor{nextPid: 1000}
+}
+
+// On scripts the results of commands starting with prefix. Each call
+// consumes one result; the last one is repeated once the others are used up.
+// Scripts added later take precedence.
+func (fe *FakeExecutor) On(prefix string, results ...FakeResult) {
+	if len(results) == 0 {
+		results = []FakeResult{{}}
+	}
+	fe.Lock()
+	defer fe.Unlock()
+	fe.scripts = append([]*fakeScript{{prefix: prefix, results: results}}, fe.scripts...)
+}
+
+// OnStart scripts the output of long-running commands starting with prefix.
+// The lines are delivered as soon as the process is started.
+func (fe *FakeExecutor) OnStart(prefix string, lines ...string) {
+	fe.Lock()
+	defer fe.Unlock()
+	fe.scripts = append([]*fakeScript{{prefix: prefix, start: true, lines: lines}}, fe.scripts...)
+}
+
+func (fe *FakeExecutor) script(cmdline string, start bool) *fakeScript {
+	for _, script := range fe.scripts {
+		if strings.HasPrefix(cmdline, script.prefix) && script.start == start {
+			return script
+		}
+	}
+	return nil
+}
+
+func (fe *FakeExecutor) Run(cmdline string) (string, error) {
+	return fe.RunContext(context.Background(), cmdline)
+}
+
+func (fe *FakeExecutor) RunContext(ctx context.Context, cmdline string) (string, error) {
+	fe.Lock()
+	fe.calls = append(fe.calls, cmdline)
+	result := fe.Default
+	if script := fe.script(cmdline, false); script != nil {
+		result = script.results[0]
+		if len(script.results) > 1 {
+			script.results = script.results[1:]
+		}
+	}
+	fe.Unlock()
+
+	if result.Delay > 0 {
+		timer := time.NewTimer(result.Delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	if result.Err != nil {
+		return "", &CmdError{Cmdline: cmdline, ExitCode: -1, Err: result.Err}
+	}
+	if result.ExitCode != 0 {
+		return result.Stdout, &CmdError{Cmdline: cmdline, ExitCode: result.ExitCode, Stderr: result.Stderr}
+	}
+	return result.Stdout, nil
+}
+
+func (fe *FakeExecutor) Start(cmdline string, tag string, onLine func(line string)) (Process, error) {
+	fe.Lock()
+	fe.calls = append(fe.calls, cmdline)
+	p := &FakeProcess{
+		Cmdline: cmdline,
+		pid:     fe.nextPid,
+		onLine:  onLine,
+		done:    make(chan struct{}),
+	}
+	fe.nextPid++
+	fe.processes = append(fe.processes, p)
+	var lines []string
+	if script := fe.script(cmdline, true); script != nil {
+		lines = script.lines
+	}
+	fe.Unlock()
+
+	for _, line := range lines {
+		p.Emit(line)
+	}
+	return p, nil
+}
+
+// FindProcess returns a process this executor started, as long as it is
+// still running cmdline, so that a new WifiManager can find the daemons of
+// an earlier one
+func (fe *FakeExecutor) FindProcess(pid int, cmdline string) (Process, error) {
+	fe.Lock()
+	defer fe.Unlock()
+	for _, p := range fe.processes {
+		if p.pid == pid && p.Cmdline == cmdline && p.Running() {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("No process %d running '%v'", pid, cmdline)
+}
+
+// Calls returns every command line run or started so far
+func (fe *FakeExecutor) Calls() []string {
+	fe.Lock()
+	defer fe.Unlock()
+	return append([]string(nil), fe.calls...)
+}
+
+// Processes returns the processes started with a command line beginning
+// with prefix, oldest first
+func (fe *FakeExecutor) Processes(prefix string) []*FakeProcess {
+	fe.Lock()
+	defer fe.Unlock()
+	ret := make([]*FakeProcess, 0)
+	for _, p := range fe.processes {
+		if strings.HasPrefix(p.Cmdline, prefix) {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// FakeProcess is a Process started by a FakeExecutor. It runs until it is
+// signalled or the test calls Exit.
+type FakeProcess struct {
+	Cmdline string
+
+	pid     int
+	onLine  func(line string)
+	signals []os.Signal
+	// ignoreTerm makes the process survive SIGINT and SIGTERM
+	ignoreTerm bool
+	err        error
+	exited     bool
+	done       chan struct{}
+	sync.Mutex
+}
+
+func (p *FakeProcess) Pid() int {
+	return p.pid
+}
+
+// Emit delivers line as though the process had printed it
+func (p *FakeProcess) Emit(line string) {
+	if p.onLine != nil {
+		p.onLine(line)
+	}
+}
+
+// Exit makes the process exit with the given status
+func (p *FakeProcess) Exit(code int) {
+	var err error
+	if code != 0 {
+		err = fmt.Errorf("exit status %d", code)
+	}
+	p.exit(err)
+}
+
+func (p *FakeProcess) exit(err error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.exited {
+		return
+	}
+	p.exited = true
+	p.err = err
+	close(p.done)
+}
+
+// Signal records sig. SIGINT, SIGTERM and SIGKILL make the process exit,
+// unless IgnoreTerm was called.
+func (p *FakeProcess) Signal(sig os.Signal) error {
+	p.Lock()
+	if p.exited {
+		p.Unlock()
+		return os.ErrProcessDone
+	}
+	p.signals = append(p.signals, sig)
+	ignoreTerm := p.ignoreTerm
+	p.Unlock()
+
+	switch sig {
+	case os.Interrupt, syscall.SIGTERM:
+		if !ignoreTerm {
+			p.exit(fmt.Errorf("signal: %v", sig))
+		}
+	case os.Kill:
+		p.exit(fmt.Errorf("signal: %v", sig))
+	}
+	return nil
+}
+
+func (p *FakeProcess) Kill() error {
+	return p.Signal(os.Kill)
+}
+
+func (p *FakeProcess) Wait() error {
+	<-p.done
+	p.Lock()
+	defer p.Unlock()
+	return p.err
+}
+
+func (p *FakeProcess) Done() <-chan struct{} {
+	return p.done
+}
+
+// IgnoreTerm makes the process ignore SIGINT and SIGTERM, so that only
+// SIGKILL stops it
+func (p *FakeProcess) IgnoreTerm() {
+	p.Lock()
+	defer p.Unlock()
+	p.ignoreTerm = true
+}
+
+// Signals returns the signals sent to the process
+func (p *FakeProcess) Signals() []os.Signal {
+	p.Lock()
+	defer p.Unlock()
+	return append([]os.Signal(nil), p.signals...)
+}
+
+// Running reports whether the process has not exited yet
+func (p *FakeProcess) Running() bool {
+	p.Lock()
+	defer p.Unlock()
+	return !p.exited
+}
@@ -0,0 +1,183 @@
+package wifimanager
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// FakeLinks is a LinkController for tests. Interfaces spring into existence
+// the first time they are used and are only changed in memory. Every change
+// is recorded in the style of ip(8), e.g. "addr add 10.0.0.1/24 dev wlan0".
+type FakeLinks struct {
+	links    map[string]*fakeLink
+	ops      []string
+	failures map[string]error
+	sync.Mutex
+}
+
+type fakeLink struct {
+	up     bool
+	addrs  []*net.IPNet
+	routes []Route
+}
+
+func NewFakeLinks() *FakeLinks {
+	return &FakeLinks{
+		links:    make(map[string]*fakeLink),
+		failures: make(map[string]error),
+	}
+}
+
+// Fail makes the changes whose recorded form starts with prefix fail with
+// err, e.g. syscall.ENODEV. A nil err lets them succeed again.
+func (fl *FakeLinks) Fail(prefix string, err error) {
+	fl.Lock()
+	defer fl.Unlock()
+	if err == nil {
+		delete(fl.failures, prefix)
+	} else {
+		fl.failures[prefix] = err
+	}
+}
+
+// Ops returns the changes made so far, failed ones included
+func (fl *FakeLinks) Ops() []string {
+	fl.Lock()
+	defer fl.Unlock()
+	return append([]string(nil), fl.ops...)
+}
+
+// op records a change to iface and returns the link to apply it to, or the
+// error it was scripted to fail with
+func (fl *FakeLinks) op(name, iface, format string, args ...interface{}) (*fakeLink, error) {
+	op := fmt.Sprintf(format, args...)
+	fl.ops = append(fl.ops, op)
+	for prefix, err := range fl.failures {
+		if strings.HasPrefix(op, prefix) {
+			return nil, linkError(name, iface, err)
+		}
+	}
+	return fl.link(iface), nil
+}
+
+func (fl *FakeLinks) link(iface string) *fakeLink {
+	link := fl.links[iface]
+	if link == nil {
+		link = &fakeLink{}
+		fl.links[iface] = link
+	}
+	return link
+}
+
+func (fl *FakeLinks) LinkState(iface string) (*LinkState, error) {
+	fl.Lock()
+	defer fl.Unlock()
+	link := fl.link(iface)
+	return &LinkState{Name: iface, Up: link.up, Running: link.up, MTU: 1500}, nil
+}
+
+func (fl *FakeLinks) SetLinkUp(iface string) error {
+	fl.Lock()
+	defer fl.Unlock()
+	link, err := fl.op("bring up", iface, "link set %v up", iface)
+	if err == nil {
+		link.up = true
+	}
+	return err
+}
+
+func (fl *FakeLinks) SetLinkDown(iface string) error {
+	fl.Lock()
+	defer fl.Unlock()
+	link, err := fl.op("bring down", iface, "link set %v down", iface)
+	if err == nil {
+		link.up = false
+	}
+	return err
+}
+
+func (fl *FakeLinks) Addresses(iface string) ([]*net.IPNet, error) {
+	fl.Lock()
+	defer fl.Unlock()
+	return append([]*net.IPNet{}, fl.link(iface).addrs...), nil
+}
+
+func (fl *FakeLinks) AddAddress(iface string, addr *net.IPNet) error {
+	fl.Lock()
+	defer fl.Unlock()
+	link, err := fl.op("add address to", iface, "addr add %v dev %v", addr, iface)
+	if err != nil {
+		return err
+	}
+	addr = normalizeIPNet(addr)
+	for _, existing := range link.addrs {
+		if existing.String() == addr.String() {
+			return linkError("add address to", iface, syscall.EEXIST)
+		}
+	}
+	link.addrs = append(link.addrs, addr)
+	return nil
+}
+
+func (fl *FakeLinks) FlushAddresses(iface string) error {
+	fl.Lock()
+	defer fl.Unlock()
+	link, err := fl.op("flush addresses of", iface, "addr flush dev %v", iface)
+	if err == nil {
+		// The kernel drops the routes that went through the addresses
+		link.addrs = nil
+		link.routes = nil
+	}
+	return err
+}
+
+func (fl *FakeLinks) Routes(iface string) ([]Route, error) {
+	fl.Lock()
+	defer fl.Unlock()
+	return append([]Route{}, fl.link(iface).routes...), nil
+}
+
+func (fl *FakeLinks) ReplaceRoute(iface string, route Route) error {
+	fl.Lock()
+	defer fl.Unlock()
+	link, err := fl.op("replace route on", iface, "route replace %v dev %v", route, iface)
+	if err != nil {
+		return err
+	}
+	for i, r := range link.routes {
+		if sameDst(r, route) {
+			link.routes[i] = route
+			return nil
+		}
+	}
+	link.routes = append(link.routes, route)
+	return nil
+}
+
+func (fl *FakeLinks) DeleteRoute(iface string, route Route) error {
+	fl.Lock()
+	defer fl.Unlock()
+	link, err := fl.op("delete route on", iface, "route del %v dev %v", route, iface)
+	if err != nil {
+		return err
+	}
+	for i, r := range link.routes {
+		if sameDst(r, route) {
+			link.routes = append(link.routes[:i], link.routes[i+1:]...)
+			return nil
+		}
+	}
+	return linkError("delete route on", iface, syscall.ESRCH)
+}
+
+// sameDst reports whether a and b go to the same destination, counting
+// default routes of the two address families apart
+func sameDst(a, b Route) bool {
+	if a.IsDefault() && b.IsDefault() {
+		return (a.Gateway.To4() == nil) == (b.Gateway.To4() == nil)
+	}
+	return a.Dst != nil && b.Dst != nil && a.Dst.String() == b.Dst.String()
+}
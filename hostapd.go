@@ -1,72 +1,206 @@
 package wifimanager
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// StartHotspot brings up an access point on iface as described by wm.Hotspot
 func (wm *WifiManager) StartHotspot(iface string) error {
-	wm.StopWPASupplicant(iface)
+	return wm.StartHotspotContext(context.Background(), iface)
+}
+
+// StartHotspotContext is StartHotspot, giving up with ctx.Err() once ctx is
+// done
+func (wm *WifiManager) StartHotspotContext(ctx context.Context, iface string) error {
+	conf := wm.Hotspot
+	if conf == (HotspotConfig{}) {
+		conf = DefaultHotspotConfig()
+	}
+	return wm.StartHotspotWithConfigContext(ctx, iface, conf)
+}
+
+// StartHotspotWithConfig brings up an access point on iface as described by
+// conf. The configuration is validated before the interface is touched.
+func (wm *WifiManager) StartHotspotWithConfig(iface string, conf HotspotConfig) error {
+	return wm.StartHotspotWithConfigContext(context.Background(), iface, conf)
+}
+
+// StartHotspotWithConfigContext is StartHotspotWithConfig, giving up with
+// ctx.Err() once ctx is done. Anything started by then is stopped again.
+func (wm *WifiManager) StartHotspotWithConfigContext(ctx context.Context, iface string, conf HotspotConfig) error {
+	if wm.isClosed() {
+		return ErrClosed
+	}
+	if err := conf.Validate(); err != nil {
+		return fmt.Errorf("Invalid hotspot configuration: %v", err)
+	}
+	ic := wm.controller(iface)
+	if err := ic.lock(ctx); err != nil {
+		return err
+	}
+	defer ic.unlock()
+	if wm.isClosed() {
+		return ErrClosed
+	}
+	return wm.startHotspot(ctx, ic, conf)
+}
 
-	err := wm.ResetWifiInterface(iface)
+func (wm *WifiManager) startHotspot(ctx context.Context, ic *ifaceController, conf HotspotConfig) error {
+	iface := ic.name
+	gateway, subnet, _ := conf.network()
+
+	// The hotspot replaces whatever ran on the interface
+	if err := wm.stopWPASupplicant(ctx, ic); err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := wm.stopHotspot(ctx, ic); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Warnf("Failed to stop the running hotspot on %v: %v", iface, err)
+	}
+
+	err := wm.resetWifiInterface(ctx, iface)
 	if err != nil {
-		return fmt.Errorf("Failed to reset wifi interface: %v", err)
+		return fmt.Errorf("Failed to reset wifi interface: %w", err)
 	}
 
-	if err = runCmd(fmt.Sprintf("ifconfig %s up 10.11.12.1 netmask 255.255.255.0", iface)); err != nil {
-		return fmt.Errorf("StartHotspot: Failed to bring up wifi interface")
+	if err = wm.links().AddAddress(iface, &net.IPNet{IP: gateway, Mask: subnet.Mask}); err != nil {
+		return fmt.Errorf("StartHotspot: Failed to bring up wifi interface: %w", err)
 	}
 
 	// Now that the interface is set up, run hostapd and dnsmasq
-	hostapdCmdline := "/usr/sbin/hostapd /etc/hostapd/hostapd.conf"
-	wm.hostapdCmd = WrapCmd(hostapdCmdline, "hostapd")
-	if wm.hostapdCmd == nil {
-		return fmt.Errorf("Failed to create hostapdCmd")
-	}
-	wm.hostapdCmd.Start()
-
-	dnsmasqConf := fmt.Sprintf(`
-no-resolv
-bind-interfaces
-interface=%v
-dhcp-authoritative
-dhcp-range=10.11.12.10,10.11.12.20,12h
-`, iface)
-	tmpConf, _ := ioutil.TempFile("/tmp", "dnsmasq-")
-	ioutil.WriteFile(tmpConf.Name(), []byte(dnsmasqConf), 0664)
-	wm.dnsmasqConf = tmpConf.Name()
-
-	dnsmasqCmdline := fmt.Sprintf("/usr/sbin/dnsmasq --no-resolv --bind-interfaces -i %v --dhcp-authoritative --dhcp-range=10.11.12.10,10.11.12.20,12h -d -C %v", iface, tmpConf.Name())
-	wm.dnsmasqCmd = WrapCmd(dnsmasqCmdline, "dnsmasq")
-	if wm.dnsmasqCmd == nil {
-		return fmt.Errorf("Failed to create dnsmasqCmd")
-	}
-	wm.dnsmasqCmd.Start()
-
-	log.Infoln("Started hotspot")
+	hostapdConfPath := conf.HostapdConfPath
+	if len(conf.SSID) > 0 {
+		if hostapdConfPath, err = writeTempConf("hostapd-", conf.hostapdConf(iface)); err != nil {
+			return fmt.Errorf("Failed to write hostapd configuration: %v", err)
+		}
+		ic.mutex.Lock()
+		ic.hostapdConf = hostapdConfPath
+		ic.mutex.Unlock()
+	}
+	hostapdCmdline := fmt.Sprintf("/usr/sbin/hostapd %v", hostapdConfPath)
+	hostapdCmd, err := wm.supervise("hostapd", iface, hostapdCmdline, nil)
+	if err != nil {
+		wm.removeHotspotConfs(ic)
+		return fmt.Errorf("Failed to create hostapdCmd: %v", err)
+	}
+	ic.mutex.Lock()
+	ic.hostapdCmd = hostapdCmd
+	ic.role = RoleHotspot
+	ic.mutex.Unlock()
+
+	dnsmasqConf, err := writeTempConf("dnsmasq-", conf.dnsmasqConf(iface))
+	if err != nil {
+		wm.stopHotspot(context.Background(), ic)
+		return fmt.Errorf("Failed to write dnsmasq configuration: %v", err)
+	}
+	ic.mutex.Lock()
+	ic.dnsmasqConf = dnsmasqConf
+	ic.mutex.Unlock()
+
+	dnsmasqCmdline := fmt.Sprintf("/usr/sbin/dnsmasq -d -C %v", dnsmasqConf)
+	dnsmasqCmd, err := wm.supervise("dnsmasq", iface, dnsmasqCmdline, nil)
+	if err != nil {
+		wm.stopHotspot(context.Background(), ic)
+		return fmt.Errorf("Failed to create dnsmasqCmd: %v", err)
+	}
+	ic.mutex.Lock()
+	ic.dnsmasqCmd = dnsmasqCmd
+	ic.hotspotConf = conf
+	ic.mutex.Unlock()
+
+	if err = wm.startCaptivePortal(ic, conf, gateway); err != nil {
+		wm.stopHotspot(context.Background(), ic)
+		return err
+	}
+
+	if ctx.Err() != nil {
+		wm.stopHotspot(context.Background(), ic)
+		return ctx.Err()
+	}
+
+	log.Infof("Started hotspot on %v", iface)
 	return nil
 }
 
+// StopHotspot stops hostapd and dnsmasq on iface. They are sent SIGTERM and
+// killed if they have not exited after StopGracePeriod.
 func (wm *WifiManager) StopHotspot(iface string) error {
-	if wm.hostapdCmd == nil && wm.dnsmasqCmd == nil {
+	return wm.StopHotspotContext(context.Background(), iface)
+}
+
+// StopHotspotContext is StopHotspot, killing the daemons right away and
+// returning ctx.Err() once ctx is done
+func (wm *WifiManager) StopHotspotContext(ctx context.Context, iface string) error {
+	ic := wm.controller(iface)
+	if err := ic.lock(ctx); err != nil {
+		return err
+	}
+	defer ic.unlock()
+	return wm.stopHotspot(ctx, ic)
+}
+
+func (wm *WifiManager) stopHotspot(ctx context.Context, ic *ifaceController) error {
+	wm.stopCaptivePortal(ic)
+	if ic.hostapdCmd == nil && ic.dnsmasqCmd == nil {
 		return nil
 	}
 
-	wm.hostapdCmd.Process.Signal(os.Interrupt)
-	wm.dnsmasqCmd.Process.Signal(os.Interrupt)
+	errs := make(chan error, 2)
+	for _, cmd := range []*Supervised{ic.hostapdCmd, ic.dnsmasqCmd} {
+		if cmd == nil {
+			errs <- nil
+			continue
+		}
+		go func(cmd *Supervised) {
+			errs <- stopProcess(ctx, cmd, wm.gracePeriod())
+		}(cmd)
+	}
+	err := <-errs
+	if err2 := <-errs; err == nil {
+		err = err2
+	}
 
-	wm.hostapdCmd.Wait()
-	wm.dnsmasqCmd.Wait()
+	ic.mutex.Lock()
+	ic.hostapdCmd = nil
+	ic.dnsmasqCmd = nil
+	ic.role = RoleIdle
+	ic.mutex.Unlock()
 
-	wm.hostapdCmd = nil
-	wm.dnsmasqCmd = nil
+	defer wm.removeHotspotConfs(ic)
 
-	defer os.Remove(wm.dnsmasqConf)
-	wm.dnsmasqConf = ""
+	log.Infof("Stopped hotspot on %v", ic.name)
+	return err
+}
 
-	log.Infoln("Stopped hotspot")
-	return nil
+func (wm *WifiManager) removeHotspotConfs(ic *ifaceController) {
+	for _, path := range []string{ic.hostapdConf, ic.dnsmasqConf} {
+		if len(path) > 0 {
+			os.Remove(path)
+		}
+	}
+	ic.mutex.Lock()
+	ic.hostapdConf = ""
+	ic.dnsmasqConf = ""
+	ic.mutex.Unlock()
+}
+
+func writeTempConf(prefix, data string) (string, error) {
+	f, err := ioutil.TempFile(tempConfDir, prefix)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err = f.WriteString(data); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
 }
@@ -1,7 +1,12 @@
 package wifimanager
 
 import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -9,13 +14,73 @@ import (
 func TestHotspot(t *testing.T) {
 	require := require.New(t)
 
-	wm, err := New("/etc/wpa_supplicant/wpa_supplicant.conf")
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+
+	err := wm.StartHotspot("wlan0")
 	require.Nil(err)
-	require.NotNil(wm)
+	require.True(wm.IsHostapdRunning())
 
-	err = wm.StartHotspot("wlan0")
+	hostapd := executor.Processes("/usr/sbin/hostapd")
+	require.Equal(1, len(hostapd))
+	dnsmasq := executor.Processes("/usr/sbin/dnsmasq")
+	require.Equal(1, len(dnsmasq))
+	links := wm.Links.(*FakeLinks)
+	require.Contains(links.Ops(), "addr add 10.11.12.1/24 dev wlan0")
+	state, err := links.LinkState("wlan0")
 	require.Nil(err)
+	require.True(state.Up)
 
 	err = wm.StopHotspot("wlan0")
 	require.Nil(err)
+	require.False(wm.IsHostapdRunning())
+	require.False(hostapd[0].Running())
+	require.False(dnsmasq[0].Running())
+}
+
+func TestHotspotInterfaceFailure(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+
+	wm.Links.(*FakeLinks).Fail("link set wlan0 down", syscall.ENODEV)
+	err := wm.StartHotspot("wlan0")
+	require.True(errors.Is(err, syscall.ENODEV), "%v", err)
+	require.Contains(err.Error(), "wlan0: no such device (errno 19)")
+	require.False(wm.IsHostapdRunning())
+	require.Equal(0, len(executor.Processes("/usr/sbin/hostapd")))
+}
+
+func TestStopHotspotContext(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	wm.StopGracePeriod = 10 * time.Millisecond
+
+	require.Nil(wm.StartHotspot("wlan0"))
+	hostapd := executor.Processes("/usr/sbin/hostapd")[0]
+	hostapd.IgnoreTerm()
+	require.Nil(wm.StopHotspot("wlan0"))
+	require.Equal([]os.Signal{syscall.SIGTERM, os.Kill}, hostapd.Signals())
+	require.Equal([]os.Signal{syscall.SIGTERM}, executor.Processes("/usr/sbin/dnsmasq")[0].Signals())
+
+	wm.StopGracePeriod = time.Hour
+	require.Nil(wm.StartHotspot("wlan0"))
+	executor.Processes("/usr/sbin/hostapd")[1].IgnoreTerm()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(context.DeadlineExceeded, wm.StopHotspotContext(ctx, "wlan0"))
+	require.False(wm.IsHostapdRunning())
+	require.False(executor.Processes("/usr/sbin/hostapd")[1].Running())
+
+	// A cancelled start leaves the interface alone
+	ops := len(wm.Links.(*FakeLinks).Ops())
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	err := wm.StartHotspotContext(ctx, "wlan0")
+	require.True(errors.Is(err, context.Canceled), "%v", err)
+	require.Equal(ops, len(wm.Links.(*FakeLinks).Ops()))
+	require.Equal(2, len(executor.Processes("/usr/sbin/hostapd")))
 }
@@ -0,0 +1,280 @@
+package wifimanager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// DefaultHostapdConfPath is the system hostapd configuration used when
+// HotspotConfig.SSID is empty
+const DefaultHostapdConfPath = "/etc/hostapd/hostapd.conf"
+
+type HotspotSecurity string
+
+const (
+	HotspotOpen HotspotSecurity = "open"
+	HotspotWPA2 HotspotSecurity = "wpa2"
+	HotspotWPA3 HotspotSecurity = "wpa3"
+	// HotspotWPA3Transition accepts both WPA2 and WPA3 clients
+	HotspotWPA3Transition HotspotSecurity = "wpa2-wpa3"
+)
+
+// HotspotConfig describes the access point StartHotspot brings up
+type HotspotConfig struct {
+	// SSID of the access point. If empty, hostapd is run with
+	// HostapdConfPath unchanged and the radio settings below are ignored.
+	SSID            string
+	HostapdConfPath string
+	// Security defaults to HotspotWPA2 if Passphrase is set and to
+	// HotspotOpen otherwise
+	Security   HotspotSecurity
+	Passphrase string
+	// Channel defaults to 6 in the 2.4GHz band and 36 in the 5GHz band
+	Channel int
+	// HWMode is hostapd's hw_mode: "g" (2.4GHz, the default), "b" or "a" (5GHz)
+	HWMode string
+	// CountryCode is the ISO 3166-1 country the AP operates in, e.g. "US"
+	CountryCode string
+	Hidden      bool
+
+	// Address is the gateway address and prefix of the interface, e.g. "10.11.12.1/24"
+	Address string
+	// DHCPStart and DHCPEnd bound the addresses handed out to clients
+	DHCPStart string
+	DHCPEnd   string
+	LeaseTime time.Duration
+
+	// CaptivePortal makes dnsmasq resolve every name to the gateway so that
+	// clients detect a captive portal
+	CaptivePortal bool
+	// SetupURL, if set, is where the built-in captive portal redirects the
+	// probe URLs to. Leave it empty to mount CaptivePortalHandler yourself.
+	SetupURL string
+	// SetupHandler serves the setup page when SetupURL points at the
+	// built-in captive portal itself. Such a SetupURL is rejected without it.
+	SetupHandler http.Handler
+	// CaptivePortalAddr is the address the built-in captive portal listens
+	// on. It defaults to port 80 on the gateway.
+	CaptivePortalAddr string
+}
+
+// DefaultHotspotConfig returns the configuration StartHotspot uses unless
+// WifiManager.Hotspot is changed
+func DefaultHotspotConfig() HotspotConfig {
+	return HotspotConfig{
+		HostapdConfPath: DefaultHostapdConfPath,
+		Address:         "10.11.12.1/24",
+		DHCPStart:       "10.11.12.10",
+		DHCPEnd:         "10.11.12.20",
+		LeaseTime:       12 * time.Hour,
+	}
+}
+
+var countryCodeRegex = regexp.MustCompile(`^[A-Z]{2}$`)
+
+func (hc *HotspotConfig) security() HotspotSecurity {
+	if len(hc.Security) > 0 {
+		return hc.Security
+	}
+	if len(hc.Passphrase) > 0 {
+		return HotspotWPA2
+	}
+	return HotspotOpen
+}
+
+func (hc *HotspotConfig) hwMode() string {
+	if len(hc.HWMode) == 0 {
+		return "g"
+	}
+	return hc.HWMode
+}
+
+func (hc *HotspotConfig) channel() int {
+	if hc.Channel != 0 {
+		return hc.Channel
+	}
+	if hc.hwMode() == "a" {
+		return 36
+	}
+	return 6
+}
+
+func (hc *HotspotConfig) leaseTime() time.Duration {
+	if hc.LeaseTime == 0 {
+		return 12 * time.Hour
+	}
+	return hc.LeaseTime
+}
+
+// Validate checks the configuration without touching any interface
+func (hc *HotspotConfig) Validate() error {
+	if len(hc.SSID) == 0 {
+		if len(hc.HostapdConfPath) == 0 {
+			return fmt.Errorf("Hotspot needs either an SSID or a hostapd.conf")
+		}
+	} else if err := hc.validateRadio(); err != nil {
+		return err
+	}
+	gateway, _, err := hc.network()
+	if err != nil {
+		return err
+	}
+	if len(hc.SetupURL) > 0 {
+		u, err := url.Parse(hc.SetupURL)
+		if err != nil || !u.IsAbs() {
+			return fmt.Errorf("Invalid setup URL '%v'", hc.SetupURL)
+		}
+		if hc.SetupHandler == nil && hc.portalServes(u, gateway) {
+			return fmt.Errorf("Setup URL '%v' is served by the captive portal itself; set SetupHandler", hc.SetupURL)
+		}
+	}
+	return nil
+}
+
+func (hc *HotspotConfig) validateRadio() error {
+	if len(hc.SSID) > 32 {
+		return fmt.Errorf("Hotspot SSID '%v' is longer than 32 bytes", hc.SSID)
+	}
+	switch hc.security() {
+	case HotspotOpen:
+		if len(hc.Passphrase) > 0 {
+			return fmt.Errorf("Open hotspot must not have a passphrase")
+		}
+	case HotspotWPA2, HotspotWPA3Transition:
+		if len(hc.Passphrase) < 8 || len(hc.Passphrase) > 63 {
+			return fmt.Errorf("Hotspot WPA2 passphrase must be 8 to 63 characters")
+		}
+	case HotspotWPA3:
+		if len(hc.Passphrase) < 8 {
+			return fmt.Errorf("Hotspot WPA3 passphrase must be at least 8 characters")
+		}
+	default:
+		return fmt.Errorf("Unknown hotspot security '%v'", hc.Security)
+	}
+	for _, c := range hc.Passphrase {
+		if c < 32 || c > 126 {
+			return fmt.Errorf("Hotspot passphrase must be printable ASCII")
+		}
+	}
+
+	channel := hc.channel()
+	switch hc.hwMode() {
+	case "b", "g":
+		if channel < 1 || channel > 14 {
+			return fmt.Errorf("Channel %d is not in the 2.4GHz band", channel)
+		}
+	case "a":
+		if channel < 36 || channel > 177 {
+			return fmt.Errorf("Channel %d is not in the 5GHz band", channel)
+		}
+	default:
+		return fmt.Errorf("Unknown hw_mode '%v'", hc.HWMode)
+	}
+	if len(hc.CountryCode) > 0 && !countryCodeRegex.MatchString(hc.CountryCode) {
+		return fmt.Errorf("Invalid country code '%v'", hc.CountryCode)
+	}
+	return nil
+}
+
+// network returns the gateway address and subnet after checking that the
+// DHCP range lies within the subnet and does not include the gateway
+func (hc *HotspotConfig) network() (net.IP, *net.IPNet, error) {
+	gateway, subnet, err := net.ParseCIDR(hc.Address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid hotspot address '%v': %v", hc.Address, err)
+	}
+	if gateway.To4() == nil {
+		return nil, nil, fmt.Errorf("Hotspot address '%v' is not IPv4", hc.Address)
+	}
+	start := net.ParseIP(hc.DHCPStart)
+	end := net.ParseIP(hc.DHCPEnd)
+	if start == nil || end == nil {
+		return nil, nil, fmt.Errorf("Invalid DHCP range %v-%v", hc.DHCPStart, hc.DHCPEnd)
+	}
+	if !subnet.Contains(start) || !subnet.Contains(end) {
+		return nil, nil, fmt.Errorf("DHCP range %v-%v is outside %v", hc.DHCPStart, hc.DHCPEnd, subnet)
+	}
+	if ipToInt(start) > ipToInt(end) {
+		return nil, nil, fmt.Errorf("DHCP range %v-%v is empty", hc.DHCPStart, hc.DHCPEnd)
+	}
+	if g := ipToInt(gateway); g >= ipToInt(start) && g <= ipToInt(end) {
+		return nil, nil, fmt.Errorf("DHCP range %v-%v includes the gateway %v", hc.DHCPStart, hc.DHCPEnd, gateway)
+	}
+	if hc.LeaseTime != 0 && hc.LeaseTime < 2*time.Minute {
+		return nil, nil, fmt.Errorf("DHCP lease time must be at least 2m")
+	}
+	return gateway.To4(), subnet, nil
+}
+
+func ipToInt(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+// hostapdConf generates a hostapd configuration for iface
+func (hc *HotspotConfig) hostapdConf(iface string) string {
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "interface=%v\n", iface)
+	fmt.Fprintf(buf, "driver=nl80211\n")
+	fmt.Fprintf(buf, "ssid2=%v\n", quoteString(hc.SSID))
+	fmt.Fprintf(buf, "hw_mode=%v\n", hc.hwMode())
+	fmt.Fprintf(buf, "channel=%d\n", hc.channel())
+	if hc.hwMode() == "a" {
+		fmt.Fprintf(buf, "ieee80211n=1\nieee80211ac=1\n")
+	} else {
+		fmt.Fprintf(buf, "ieee80211n=1\n")
+	}
+	if len(hc.CountryCode) > 0 {
+		fmt.Fprintf(buf, "country_code=%v\nieee80211d=1\n", hc.CountryCode)
+	}
+	if hc.Hidden {
+		fmt.Fprintf(buf, "ignore_broadcast_ssid=1\n")
+	}
+	switch hc.security() {
+	case HotspotWPA2:
+		fmt.Fprintf(buf, "wpa=2\nwpa_key_mgmt=WPA-PSK\nrsn_pairwise=CCMP\n")
+		fmt.Fprintf(buf, "wpa_passphrase=%v\n", hc.Passphrase)
+	case HotspotWPA3:
+		fmt.Fprintf(buf, "wpa=2\nwpa_key_mgmt=SAE\nrsn_pairwise=CCMP\nieee80211w=2\n")
+		fmt.Fprintf(buf, "sae_password=%v\n", hc.Passphrase)
+	case HotspotWPA3Transition:
+		fmt.Fprintf(buf, "wpa=2\nwpa_key_mgmt=WPA-PSK SAE\nrsn_pairwise=CCMP\nieee80211w=1\n")
+		fmt.Fprintf(buf, "wpa_passphrase=%v\n", hc.Passphrase)
+		fmt.Fprintf(buf, "sae_password=%v\n", hc.Passphrase)
+	}
+	return buf.String()
+}
+
+// dnsmasqConf generates a dnsmasq configuration serving DHCP on iface
+func (hc *HotspotConfig) dnsmasqConf(iface string) string {
+	conf := fmt.Sprintf(`
+no-resolv
+bind-interfaces
+interface=%v
+dhcp-authoritative
+dhcp-range=%v,%v,%v
+`, iface, hc.DHCPStart, hc.DHCPEnd, formatLeaseTime(hc.leaseTime()))
+	if hc.CaptivePortal {
+		if gateway, _, err := net.ParseCIDR(hc.Address); err == nil {
+			conf += fmt.Sprintf("address=/#/%v\n", gateway)
+		}
+	}
+	return conf
+}
+
+// formatLeaseTime formats d the way dnsmasq expects, e.g. 12h or 90m
+func formatLeaseTime(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%d", d/time.Second)
+	}
+}
@@ -0,0 +1,136 @@
+package wifimanager
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHotspotConfigValidate(t *testing.T) {
+	require := require.New(t)
+
+	valid := DefaultHotspotConfig()
+	valid.SSID = "setup"
+	valid.Passphrase = "password123"
+	require.Nil(valid.Validate())
+
+	def := DefaultHotspotConfig()
+	require.Nil(def.Validate())
+
+	invalid := map[string]func(hc *HotspotConfig){
+		"no ssid or conf":      func(hc *HotspotConfig) { hc.SSID = ""; hc.HostapdConfPath = "" },
+		"long ssid":            func(hc *HotspotConfig) { hc.SSID = strings.Repeat("a", 33) },
+		"short passphrase":     func(hc *HotspotConfig) { hc.Passphrase = "short" },
+		"long passphrase":      func(hc *HotspotConfig) { hc.Passphrase = strings.Repeat("a", 64) },
+		"open with password":   func(hc *HotspotConfig) { hc.Security = HotspotOpen },
+		"unknown security":     func(hc *HotspotConfig) { hc.Security = "wep" },
+		"unprintable":          func(hc *HotspotConfig) { hc.Passphrase = "password\n123" },
+		"2.4GHz channel":       func(hc *HotspotConfig) { hc.Channel = 36 },
+		"5GHz channel":         func(hc *HotspotConfig) { hc.HWMode = "a"; hc.Channel = 6 },
+		"hw_mode":              func(hc *HotspotConfig) { hc.HWMode = "x" },
+		"country":              func(hc *HotspotConfig) { hc.CountryCode = "usa" },
+		"address":              func(hc *HotspotConfig) { hc.Address = "10.11.12.1" },
+		"ipv6 address":         func(hc *HotspotConfig) { hc.Address = "fd00::1/64" },
+		"range outside":        func(hc *HotspotConfig) { hc.DHCPEnd = "10.11.13.20" },
+		"range reversed":       func(hc *HotspotConfig) { hc.DHCPStart = "10.11.12.30" },
+		"range has gateway":    func(hc *HotspotConfig) { hc.DHCPStart = "10.11.12.1" },
+		"range not an ip":      func(hc *HotspotConfig) { hc.DHCPStart = "start" },
+		"lease time too short": func(hc *HotspotConfig) { hc.LeaseTime = time.Minute },
+	}
+	for name, mutate := range invalid {
+		hc := valid
+		mutate(&hc)
+		require.NotNil(hc.Validate(), name)
+	}
+}
+
+func TestHotspotConfigGenerate(t *testing.T) {
+	require := require.New(t)
+
+	hc := DefaultHotspotConfig()
+	hc.SSID = "setup"
+	hc.Passphrase = "password123"
+	hc.HWMode = "a"
+	hc.CountryCode = "DE"
+	hc.Hidden = true
+	hc.LeaseTime = 90 * time.Minute
+
+	conf := hc.hostapdConf("wlan1")
+	for _, line := range []string{
+		"interface=wlan1", `ssid2="setup"`, "hw_mode=a", "channel=36", "country_code=DE",
+		"ignore_broadcast_ssid=1", "wpa=2", "wpa_key_mgmt=WPA-PSK", "wpa_passphrase=password123",
+	} {
+		require.Contains(conf, line+"\n")
+	}
+
+	hc.Security = HotspotWPA3
+	conf = hc.hostapdConf("wlan1")
+	require.Contains(conf, "wpa_key_mgmt=SAE\n")
+	require.Contains(conf, "ieee80211w=2\n")
+	require.Contains(conf, "sae_password=password123\n")
+	require.NotContains(conf, "wpa_passphrase")
+
+	hc.Security = HotspotWPA3Transition
+	conf = hc.hostapdConf("wlan1")
+	require.Contains(conf, "wpa_key_mgmt=WPA-PSK SAE\n")
+	require.Contains(conf, "ieee80211w=1\n")
+	require.Contains(conf, "wpa_passphrase=password123\n")
+	require.Contains(conf, "sae_password=password123\n")
+
+	hc.Security = HotspotOpen
+	hc.Passphrase = ""
+	conf = hc.hostapdConf("wlan1")
+	require.NotContains(conf, "wpa=")
+
+	require.Contains(hc.dnsmasqConf("wlan1"), "dhcp-range=10.11.12.10,10.11.12.20,90m\n")
+}
+
+func TestStartHotspotWithConfig(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+
+	hc := HotspotConfig{
+		SSID:       "setup",
+		Passphrase: "password123",
+		Address:    "192.168.50.1/24",
+		DHCPStart:  "192.168.50.100",
+		DHCPEnd:    "192.168.50.150",
+	}
+
+	// An invalid configuration is rejected before anything runs
+	invalid := hc
+	invalid.Passphrase = "short"
+	require.NotNil(wm.StartHotspotWithConfig("wlan0", invalid))
+	require.Equal(0, len(executor.Calls()))
+
+	err := wm.StartHotspotWithConfig("wlan0", hc)
+	require.Nil(err)
+	require.Contains(wm.Links.(*FakeLinks).Ops(), "addr add 192.168.50.1/24 dev wlan0")
+
+	hostapd := executor.Processes("/usr/sbin/hostapd")
+	require.Equal(1, len(hostapd))
+	confPath := strings.Fields(hostapd[0].Cmdline)[1]
+	data, err := ioutil.ReadFile(confPath)
+	require.Nil(err)
+	require.Contains(string(data), `ssid2="setup"`)
+
+	dnsmasq := executor.Processes("/usr/sbin/dnsmasq")
+	require.Equal(1, len(dnsmasq))
+	dnsmasqConfPath := strings.Fields(dnsmasq[0].Cmdline)[3]
+	data, err = ioutil.ReadFile(dnsmasqConfPath)
+	require.Nil(err)
+	require.Contains(string(data), "dhcp-range=192.168.50.100,192.168.50.150,12h")
+
+	err = wm.StopHotspot("wlan0")
+	require.Nil(err)
+	_, err = os.Stat(confPath)
+	require.True(os.IsNotExist(err))
+	_, err = os.Stat(dnsmasqConfPath)
+	require.True(os.IsNotExist(err))
+}
@@ -0,0 +1,189 @@
+package wifimanager
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Role is what an interface is being used for
+type Role string
+
+const (
+	RoleIdle Role = "idle"
+	// RoleClient interfaces run wpa_supplicant
+	RoleClient Role = "client"
+	// RoleHotspot interfaces run hostapd and dnsmasq
+	RoleHotspot Role = "hotspot"
+	// RoleTesting interfaces are trying a network for TestConnect
+	RoleTesting Role = "testing"
+)
+
+// InterfaceStatus describes an interface and what runs on it. State is the
+// state of the Run loop on the interface.
+type InterfaceStatus struct {
+	Name    string
+	Role    Role
+	State   State
+	Daemons []DaemonStatus
+}
+
+// ifaceController holds what runs on one interface. mode is held by the
+// operations that change that, so that they happen one after the other on
+// each interface while different interfaces are left alone. The other fields
+// are only changed with mode held and under mutex, so they can be read with
+// either. state is only changed by Run, under mutex. addressMutex is held
+// while the address of the interface is configured.
+type ifaceController struct {
+	name             string
+	role             Role
+	state            State
+	wpaSupplicantCmd *Supervised
+	hostapdCmd       *Supervised
+	dnsmasqCmd       *Supervised
+	hostapdConf      string
+	dnsmasqConf      string
+	portal           *http.Server
+	portalAddr       string
+	hotspotConf      HotspotConfig
+	mode             chan struct{}
+	mutex            sync.Mutex
+	addressMutex     sync.Mutex
+}
+
+func newIfaceController(name string) *ifaceController {
+	return &ifaceController{name: name, role: RoleIdle, state: StateStopped, mode: make(chan struct{}, 1)}
+}
+
+// lock takes mode, giving up with ctx.Err() once ctx is done
+func (ic *ifaceController) lock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case ic.mode <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ic *ifaceController) unlock() {
+	<-ic.mode
+}
+
+// daemons returns the daemons running on the interface
+func (ic *ifaceController) daemons() []*Supervised {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	ret := make([]*Supervised, 0, 3)
+	for _, s := range []*Supervised{ic.wpaSupplicantCmd, ic.hostapdCmd, ic.dnsmasqCmd} {
+		if s != nil {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+func (ic *ifaceController) hostapdRunning() bool {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	return ic.hostapdCmd != nil && ic.hostapdCmd.Running() &&
+		ic.dnsmasqCmd != nil && ic.dnsmasqCmd.Running()
+}
+
+// runningHotspot returns the configuration of the hotspot on the interface,
+// if one runs
+func (ic *ifaceController) runningHotspot() (HotspotConfig, bool) {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	return ic.hotspotConf, ic.role == RoleHotspot
+}
+
+func (ic *ifaceController) supplicantRunning() bool {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	return ic.wpaSupplicantCmd != nil && ic.wpaSupplicantCmd.Running()
+}
+
+// controller returns the controller of iface, creating it on first use
+func (wm *WifiManager) controller(iface string) *ifaceController {
+	wm.ifaceMutex.Lock()
+	defer wm.ifaceMutex.Unlock()
+	if wm.ifaces == nil {
+		wm.ifaces = make(map[string]*ifaceController)
+	}
+	ic := wm.ifaces[iface]
+	if ic == nil {
+		ic = newIfaceController(iface)
+		wm.ifaces[iface] = ic
+	}
+	return ic
+}
+
+// controllers returns the controllers of every interface used so far,
+// ordered by name
+func (wm *WifiManager) controllers() []*ifaceController {
+	wm.ifaceMutex.Lock()
+	defer wm.ifaceMutex.Unlock()
+	ret := make([]*ifaceController, 0, len(wm.ifaces))
+	for _, ic := range wm.ifaces {
+		ret = append(ret, ic)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].name < ret[j].name
+	})
+	return ret
+}
+
+// Interfaces returns the interfaces the manager has been asked to use,
+// ordered by name, with what they are used for
+func (wm *WifiManager) Interfaces() []InterfaceStatus {
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, ic := range wm.controllers() {
+		names = append(names, ic.name)
+		seen[ic.name] = true
+	}
+	// DHCP clients can run on interfaces whose supplicant is not ours
+	wm.dhcpMutex.Lock()
+	for iface := range wm.dhcp {
+		if !seen[iface] {
+			names = append(names, iface)
+		}
+	}
+	wm.dhcpMutex.Unlock()
+	sort.Strings(names)
+
+	ret := make([]InterfaceStatus, 0, len(names))
+	for _, name := range names {
+		ret = append(ret, wm.Interface(name))
+	}
+	return ret
+}
+
+// Interface returns the status of iface. An interface that was never used
+// is idle.
+func (wm *WifiManager) Interface(iface string) InterfaceStatus {
+	status := InterfaceStatus{Name: iface, Role: RoleIdle, State: StateStopped, Daemons: make([]DaemonStatus, 0)}
+	wm.ifaceMutex.Lock()
+	ic := wm.ifaces[iface]
+	wm.ifaceMutex.Unlock()
+	if ic != nil {
+		ic.mutex.Lock()
+		status.Role = ic.role
+		status.State = ic.state
+		ic.mutex.Unlock()
+		for _, s := range ic.daemons() {
+			status.Daemons = append(status.Daemons, s.Status())
+		}
+	}
+
+	wm.dhcpMutex.Lock()
+	defer wm.dhcpMutex.Unlock()
+	if dc := wm.dhcp[iface]; dc != nil && dc.cmd != nil {
+		status.Daemons = append(status.Daemons, dc.cmd.Status())
+	}
+	return status
+}
@@ -0,0 +1,86 @@
+package wifimanager
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterfaces(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	require.Empty(wm.Interfaces())
+	require.Equal(InterfaceStatus{Name: "wlan0", Role: RoleIdle, State: StateStopped, Daemons: []DaemonStatus{}}, wm.Interface("wlan0"))
+
+	// A hotspot and a supplicant run side by side
+	wm.Hotspot.SSID = "setup"
+	require.Nil(wm.StartHotspot("wlan1"))
+	require.Nil(wm.StartWPASupplicant("wlan0", wm.WPAConfPath))
+	require.Nil(wm.StartHotspot("wlan2"))
+	roles := make(map[string]Role)
+	for _, status := range wm.Interfaces() {
+		roles[status.Name] = status.Role
+	}
+	require.Equal(map[string]Role{"wlan0": RoleClient, "wlan1": RoleHotspot, "wlan2": RoleHotspot}, roles)
+	require.Equal(1, len(wm.Interface("wlan0").Daemons))
+	require.Equal(2, len(wm.Interface("wlan1").Daemons))
+	require.Equal(5, len(wm.Daemons()))
+
+	// Each hotspot has configuration files of its own
+	wlan1, wlan2 := wm.controller("wlan1"), wm.controller("wlan2")
+	require.NotEqual(wlan1.hostapdConf, wlan2.hostapdConf)
+	require.NotEqual(wlan1.dnsmasqConf, wlan2.dnsmasqConf)
+
+	// Stopping one interface leaves the others alone
+	require.Nil(wm.StopHotspot("wlan0"))
+	require.True(wm.controller("wlan1").hostapdRunning())
+	require.True(wm.IsWPASupplicantRunning())
+	require.Nil(wm.StopHotspot("wlan1"))
+	require.Equal(RoleIdle, wm.Interface("wlan1").Role)
+	require.Empty(wm.Interface("wlan1").Daemons)
+	_, err := os.Stat(wlan1.hostapdConf)
+	require.True(os.IsNotExist(err))
+	require.FileExists(wlan2.hostapdConf)
+	require.True(wm.controller("wlan2").hostapdRunning())
+	require.Equal(2, len(executor.Processes("/usr/sbin/hostapd")))
+
+	// Starting a supplicant where the hotspot runs replaces it
+	require.Nil(wm.StartWPASupplicant("wlan2", wm.WPAConfPath))
+	require.Equal(RoleClient, wm.Interface("wlan2").Role)
+	require.False(wm.IsHostapdRunning())
+	require.Nil(wm.StopWPASupplicant("wlan0"))
+	require.Equal(RoleIdle, wm.Interface("wlan0").Role)
+	require.True(wm.IsWPASupplicantRunning())
+
+	require.Nil(wm.Close())
+	for _, status := range wm.Interfaces() {
+		require.Equal(RoleIdle, status.Role, status.Name)
+	}
+}
+
+func TestInterfaceTesting(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	wm.ConnectTimeout = time.Hour
+	executor.On("/sbin/iwgetid -r wlan0", FakeResult{ExitCode: 255})
+	network := &WPANetwork{SSID: "test", PSK: "8ac9f2d7ae608374d89283164d8fd8a877ddea7743391dffcdd6fd8f5f3a7755"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- wm.TestConnectContext(ctx, "wlan0", network)
+	}()
+	require.Eventually(func() bool {
+		return wm.Interface("wlan0").Role == RoleTesting
+	}, time.Second, time.Millisecond)
+	cancel()
+	require.Equal(context.Canceled, <-result)
+	require.Equal(RoleIdle, wm.Interface("wlan0").Role)
+}
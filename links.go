@@ -0,0 +1,109 @@
+package wifimanager
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// LinkController configures network interfaces. The default talks to the
+// kernel over rtnetlink; FakeLinks keeps the state in memory for tests.
+type LinkController interface {
+	LinkState(iface string) (*LinkState, error)
+	SetLinkUp(iface string) error
+	SetLinkDown(iface string) error
+	// Addresses returns the IPv4 and IPv6 addresses of iface
+	Addresses(iface string) ([]*net.IPNet, error)
+	AddAddress(iface string, addr *net.IPNet) error
+	// FlushAddresses removes every address from iface
+	FlushAddresses(iface string) error
+	// Routes returns the routes of the main table that go through iface
+	Routes(iface string) ([]Route, error)
+	// ReplaceRoute adds route through iface, replacing any route to the
+	// same destination
+	ReplaceRoute(iface string, route Route) error
+	DeleteRoute(iface string, route Route) error
+}
+
+// LinkState describes a network interface
+type LinkState struct {
+	Name  string
+	Index int
+	// Up is set if the interface is administratively up
+	Up bool
+	// Running is set if it is up and has carrier
+	Running      bool
+	MTU          int
+	HardwareAddr net.HardwareAddr
+}
+
+// Route is a route through an interface. A nil Dst is the default route of
+// the address family of Gateway.
+type Route struct {
+	Dst     *net.IPNet
+	Gateway net.IP
+}
+
+// IsDefault reports whether r is a default route
+func (r Route) IsDefault() bool {
+	if r.Dst == nil {
+		return true
+	}
+	ones, _ := r.Dst.Mask.Size()
+	return ones == 0
+}
+
+func (r Route) String() string {
+	dst := "default"
+	if !r.IsDefault() {
+		dst = r.Dst.String()
+	}
+	if r.Gateway == nil {
+		return dst
+	}
+	return fmt.Sprintf("%v via %v", dst, r.Gateway)
+}
+
+// LinkError is returned by LinkController operations. Err is usually a
+// syscall.Errno, so errors.Is(err, syscall.ENODEV) and the like work.
+type LinkError struct {
+	Op    string
+	Iface string
+	Err   error
+}
+
+func (e *LinkError) Error() string {
+	if errno, ok := e.Err.(syscall.Errno); ok {
+		return fmt.Sprintf("Failed to %v %v: %v (errno %d)", e.Op, e.Iface, errno, int(errno))
+	}
+	return fmt.Sprintf("Failed to %v %v: %v", e.Op, e.Iface, e.Err)
+}
+
+func (e *LinkError) Unwrap() error {
+	return e.Err
+}
+
+// links returns the LinkController to use, so that a WifiManager that was
+// not created through New still works
+func (wm *WifiManager) links() LinkController {
+	if wm.Links == nil {
+		return DefaultLinks
+	}
+	return wm.Links
+}
+
+func linkError(op, iface string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &LinkError{Op: op, Iface: iface, Err: err}
+}
+
+// normalizeIPNet returns addr with a 4 byte IP if it is an IPv4 address, so
+// that its length matches that of its mask
+func normalizeIPNet(addr *net.IPNet) *net.IPNet {
+	if ip4 := addr.IP.To4(); ip4 != nil && len(addr.Mask) == net.IPv4len {
+		return &net.IPNet{IP: ip4, Mask: addr.Mask}
+	}
+	return addr
+}
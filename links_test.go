@@ -0,0 +1,65 @@
+package wifimanager
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkError(t *testing.T) {
+	require := require.New(t)
+
+	err := fmt.Errorf("Failed to reset wifi interface: %w", linkError("bring up", "wlan0", syscall.ENODEV))
+	require.True(errors.Is(err, syscall.ENODEV))
+	require.Equal("Failed to reset wifi interface: Failed to bring up wlan0: no such device (errno 19)", err.Error())
+	var linkErr *LinkError
+	require.True(errors.As(err, &linkErr))
+	require.Equal("wlan0", linkErr.Iface)
+	require.Nil(linkError("bring up", "wlan0", nil))
+}
+
+func TestRouteString(t *testing.T) {
+	require := require.New(t)
+
+	_, dst, _ := net.ParseCIDR("10.20.0.0/16")
+	require.Equal("default via 192.168.1.1", Route{Gateway: net.ParseIP("192.168.1.1")}.String())
+	require.Equal("10.20.0.0/16", Route{Dst: dst}.String())
+	_, dst, _ = net.ParseCIDR("::/0")
+	require.True(Route{Dst: dst}.IsDefault())
+}
+
+func TestFakeLinks(t *testing.T) {
+	require := require.New(t)
+
+	fl := NewFakeLinks()
+	require.Nil(fl.SetLinkUp("wlan0"))
+	_, addr, _ := net.ParseCIDR("10.0.0.0/24")
+	require.Nil(fl.AddAddress("wlan0", addr))
+	require.True(errors.Is(fl.AddAddress("wlan0", addr), syscall.EEXIST))
+	require.Nil(fl.ReplaceRoute("wlan0", Route{Gateway: net.ParseIP("10.0.0.1")}))
+	require.Nil(fl.ReplaceRoute("wlan0", Route{Gateway: net.ParseIP("10.0.0.2")}))
+	routes, err := fl.Routes("wlan0")
+	require.Nil(err)
+	require.Equal([]Route{{Gateway: net.ParseIP("10.0.0.2")}}, routes)
+
+	fl.Fail("addr flush", syscall.EPERM)
+	require.True(errors.Is(fl.FlushAddresses("wlan0"), syscall.EPERM))
+	fl.Fail("addr flush", nil)
+	require.Nil(fl.FlushAddresses("wlan0"))
+	addrs, err := fl.Addresses("wlan0")
+	require.Nil(err)
+	require.Empty(addrs)
+	require.Equal([]string{
+		"link set wlan0 up",
+		"addr add 10.0.0.0/24 dev wlan0",
+		"addr add 10.0.0.0/24 dev wlan0",
+		"route replace default via 10.0.0.1 dev wlan0",
+		"route replace default via 10.0.0.2 dev wlan0",
+		"addr flush dev wlan0",
+		"addr flush dev wlan0",
+	}, fl.Ops())
+}
@@ -0,0 +1,331 @@
+//go:build linux
+
+package wifimanager
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// DefaultLinks configures interfaces over rtnetlink
+var DefaultLinks LinkController = &netlinkLinks{}
+
+// netlinkLinks talks NETLINK_ROUTE to the kernel directly, the way ip(8)
+// does, so no external program is needed
+type netlinkLinks struct {
+	seq uint32
+}
+
+func (nl *netlinkLinks) LinkState(iface string) (*LinkState, error) {
+	ifi, err := interfaceByName("get state of", iface)
+	if err != nil {
+		return nil, err
+	}
+	return &LinkState{
+		Name:         ifi.Name,
+		Index:        ifi.Index,
+		Up:           ifi.Flags&net.FlagUp != 0,
+		Running:      ifi.Flags&net.FlagRunning != 0,
+		MTU:          ifi.MTU,
+		HardwareAddr: ifi.HardwareAddr,
+	}, nil
+}
+
+func (nl *netlinkLinks) SetLinkUp(iface string) error {
+	return nl.setLinkFlags("bring up", iface, syscall.IFF_UP)
+}
+
+func (nl *netlinkLinks) SetLinkDown(iface string) error {
+	return nl.setLinkFlags("bring down", iface, 0)
+}
+
+func (nl *netlinkLinks) setLinkFlags(op, iface string, flags uint32) error {
+	ifi, err := interfaceByName(op, iface)
+	if err != nil {
+		return err
+	}
+	msg := make([]byte, syscall.SizeofIfInfomsg)
+	msg[0] = syscall.AF_UNSPEC
+	binary.NativeEndian.PutUint32(msg[4:], uint32(ifi.Index))
+	binary.NativeEndian.PutUint32(msg[8:], flags)
+	binary.NativeEndian.PutUint32(msg[12:], syscall.IFF_UP)
+	return linkError(op, iface, nl.request(syscall.RTM_NEWLINK, 0, msg))
+}
+
+func (nl *netlinkLinks) Addresses(iface string) ([]*net.IPNet, error) {
+	ifi, err := interfaceByName("list addresses of", iface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, linkError("list addresses of", iface, err)
+	}
+	ret := make([]*net.IPNet, 0, len(addrs))
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			ret = append(ret, normalizeIPNet(ipnet))
+		}
+	}
+	return ret, nil
+}
+
+func (nl *netlinkLinks) AddAddress(iface string, addr *net.IPNet) error {
+	ifi, err := interfaceByName("add address to", iface)
+	if err != nil {
+		return err
+	}
+	addr = normalizeIPNet(addr)
+	attrs := [][]byte{
+		rtattr(syscall.IFA_LOCAL, addr.IP),
+		rtattr(syscall.IFA_ADDRESS, addr.IP),
+	}
+	if ones, bits := addr.Mask.Size(); bits == 32 && ones < 31 {
+		broadcast := make(net.IP, 4)
+		for i := range broadcast {
+			broadcast[i] = addr.IP[i] | ^addr.Mask[i]
+		}
+		attrs = append(attrs, rtattr(syscall.IFA_BROADCAST, broadcast))
+	}
+	msg := ifAddrmsg(ifi.Index, addr)
+	err = nl.request(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, append([][]byte{msg}, attrs...)...)
+	return linkError("add address to", iface, err)
+}
+
+func (nl *netlinkLinks) FlushAddresses(iface string) error {
+	addrs, err := nl.Addresses(iface)
+	if err != nil {
+		return err
+	}
+	ifi, err := interfaceByName("flush addresses of", iface)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		err := nl.request(syscall.RTM_DELADDR, 0, ifAddrmsg(ifi.Index, addr),
+			rtattr(syscall.IFA_LOCAL, addr.IP), rtattr(syscall.IFA_ADDRESS, addr.IP))
+		// Deleting the primary address of a subnet removes its secondaries
+		if err != nil && err != syscall.EADDRNOTAVAIL {
+			return linkError("flush addresses of", iface, err)
+		}
+	}
+	return nil
+}
+
+func (nl *netlinkLinks) Routes(iface string) ([]Route, error) {
+	ifi, err := interfaceByName("list routes of", iface)
+	if err != nil {
+		return nil, err
+	}
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, linkError("list routes of", iface, err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, linkError("list routes of", iface, err)
+	}
+	ret := make([]Route, 0)
+	for i := range msgs {
+		m := &msgs[i]
+		if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		family, dstLen, table, typ := m.Data[0], m.Data[1], m.Data[4], m.Data[7]
+		if typ != syscall.RTN_UNICAST {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(m)
+		if err != nil {
+			continue
+		}
+		oif := 0
+		route := Route{}
+		tableID := uint32(table)
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_OIF:
+				oif = int(binary.NativeEndian.Uint32(attr.Value))
+			case syscall.RTA_TABLE:
+				tableID = binary.NativeEndian.Uint32(attr.Value)
+			case syscall.RTA_DST:
+				route.Dst = &net.IPNet{IP: net.IP(attr.Value), Mask: net.CIDRMask(int(dstLen), 8*len(attr.Value))}
+			case syscall.RTA_GATEWAY:
+				route.Gateway = net.IP(attr.Value)
+			}
+		}
+		if oif != ifi.Index || tableID != syscall.RT_TABLE_MAIN {
+			continue
+		}
+		if route.Dst == nil {
+			size := net.IPv4len
+			if family == syscall.AF_INET6 {
+				size = net.IPv6len
+			}
+			route.Dst = &net.IPNet{IP: make(net.IP, size), Mask: net.CIDRMask(0, 8*size)}
+		}
+		ret = append(ret, route)
+	}
+	return ret, nil
+}
+
+func (nl *netlinkLinks) ReplaceRoute(iface string, route Route) error {
+	return nl.route("replace route on", iface, syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, route)
+}
+
+func (nl *netlinkLinks) DeleteRoute(iface string, route Route) error {
+	return nl.route("delete route on", iface, syscall.RTM_DELROUTE, 0, route)
+}
+
+func (nl *netlinkLinks) route(op, iface string, typ, flags int, route Route) error {
+	ifi, err := interfaceByName(op, iface)
+	if err != nil {
+		return err
+	}
+	var dst *net.IPNet
+	if route.Dst != nil {
+		dst = normalizeIPNet(route.Dst)
+	}
+	gateway := route.Gateway
+	if ip4 := gateway.To4(); ip4 != nil {
+		gateway = ip4
+	}
+	var family byte
+	switch {
+	case dst != nil && len(dst.IP) == net.IPv4len, dst == nil && len(gateway) == net.IPv4len:
+		family = syscall.AF_INET
+	case dst != nil, len(gateway) == net.IPv6len:
+		family = syscall.AF_INET6
+	default:
+		return linkError(op, iface, syscall.EINVAL)
+	}
+	if gateway != nil && (family == syscall.AF_INET) != (len(gateway) == net.IPv4len) {
+		return linkError(op, iface, syscall.EINVAL)
+	}
+
+	msg := make([]byte, syscall.SizeofRtMsg)
+	msg[0] = family
+	if dst != nil {
+		ones, _ := dst.Mask.Size()
+		msg[1] = byte(ones)
+	}
+	msg[4] = syscall.RT_TABLE_MAIN
+	msg[5] = syscall.RTPROT_BOOT
+	switch {
+	case typ == syscall.RTM_DELROUTE:
+		// Matches the route whatever its scope
+		msg[6] = syscall.RT_SCOPE_NOWHERE
+	case gateway == nil:
+		msg[6] = syscall.RT_SCOPE_LINK
+	default:
+		msg[6] = syscall.RT_SCOPE_UNIVERSE
+	}
+	msg[7] = syscall.RTN_UNICAST
+
+	oif := make([]byte, 4)
+	binary.NativeEndian.PutUint32(oif, uint32(ifi.Index))
+	data := [][]byte{msg, rtattr(syscall.RTA_OIF, oif)}
+	if msg[1] > 0 {
+		data = append(data, rtattr(syscall.RTA_DST, dst.IP.Mask(dst.Mask)))
+	}
+	if gateway != nil {
+		data = append(data, rtattr(syscall.RTA_GATEWAY, gateway))
+	}
+	return linkError(op, iface, nl.request(typ, flags, data...))
+}
+
+// request sends a message of type typ made up of data to the kernel and
+// waits for it to be acknowledged
+func (nl *netlinkLinks) request(typ, flags int, data ...[]byte) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	seq := atomic.AddUint32(&nl.seq, 1)
+	length := syscall.SizeofNlMsghdr
+	for _, d := range data {
+		length += len(d)
+	}
+	buf := make([]byte, syscall.SizeofNlMsghdr, length)
+	binary.NativeEndian.PutUint32(buf[0:], uint32(length))
+	binary.NativeEndian.PutUint16(buf[4:], uint16(typ))
+	binary.NativeEndian.PutUint16(buf[6:], uint16(flags|syscall.NLM_F_REQUEST|syscall.NLM_F_ACK))
+	binary.NativeEndian.PutUint32(buf[8:], seq)
+	for _, d := range data {
+		buf = append(buf, d...)
+	}
+	if err = syscall.Sendto(fd, buf, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	rb := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, rb, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(rb[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return syscall.EBADMSG
+				}
+				if errno := int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+					return syscall.Errno(-errno)
+				}
+				return nil
+			case syscall.NLMSG_DONE:
+				return nil
+			}
+		}
+	}
+}
+
+// rtattr encodes a route attribute, padded to the netlink alignment
+func rtattr(typ int, value []byte) []byte {
+	length := syscall.SizeofRtAttr + len(value)
+	buf := make([]byte, (length+syscall.RTA_ALIGNTO-1) & ^(syscall.RTA_ALIGNTO-1))
+	binary.NativeEndian.PutUint16(buf[0:], uint16(length))
+	binary.NativeEndian.PutUint16(buf[2:], uint16(typ))
+	copy(buf[syscall.SizeofRtAttr:], value)
+	return buf
+}
+
+func ifAddrmsg(index int, addr *net.IPNet) []byte {
+	msg := make([]byte, syscall.SizeofIfAddrmsg)
+	msg[0] = syscall.AF_INET6
+	if len(addr.IP) == net.IPv4len {
+		msg[0] = syscall.AF_INET
+	}
+	ones, _ := addr.Mask.Size()
+	msg[1] = byte(ones)
+	binary.NativeEndian.PutUint32(msg[4:], uint32(index))
+	return msg
+}
+
+// interfaceByName looks up iface, failing with ENODEV if it does not exist
+func interfaceByName(op, iface string) (*net.Interface, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such network interface") {
+			err = syscall.ENODEV
+		}
+		return nil, linkError(op, iface, err)
+	}
+	return ifi, nil
+}
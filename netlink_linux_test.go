@@ -0,0 +1,142 @@
+//go:build linux
+
+package wifimanager
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// netnsEnv marks the copy of the test binary that runs inside the namespaces
+const netnsEnv = "WIFIMANAGER_TEST_NETNS"
+
+// inNetns runs the calling test again in a child process with its own user
+// and network namespaces, where it may configure interfaces without root. It
+// returns true in that child, and false in the parent once the child is done.
+func inNetns(t *testing.T) bool {
+	if os.Getenv(netnsEnv) == t.Name() {
+		return true
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), netnsEnv+"="+t.Name())
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+	out, err := cmd.CombinedOutput()
+	if _, ok := err.(*exec.ExitError); !ok && err != nil {
+		t.Skipf("Cannot create namespaces: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("Test failed in namespaces: %v\n%s", err, out)
+	}
+	return false
+}
+
+// addDummyLink creates a dummy interface, the way
+// ip link add <name> type dummy does
+func addDummyLink(nl *netlinkLinks, name string) error {
+	const (
+		iflaLinkinfo = 18
+		iflaInfoKind = 1
+		nlaFNested   = 1 << 15
+	)
+	linkinfo := rtattr(iflaLinkinfo|nlaFNested, rtattr(iflaInfoKind, []byte("dummy")))
+	return nl.request(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL,
+		make([]byte, syscall.SizeofIfInfomsg), rtattr(syscall.IFLA_IFNAME, append([]byte(name), 0)), linkinfo)
+}
+
+func TestNetlinkLinks(t *testing.T) {
+	if !inNetns(t) {
+		return
+	}
+	require := require.New(t)
+
+	nl := &netlinkLinks{}
+	iface := "wm0"
+	if err := addDummyLink(nl, iface); err != nil {
+		// Not every kernel has the dummy driver; loopback will do
+		t.Logf("Using lo, no dummy interface: %v", err)
+		iface = "lo"
+	}
+
+	state, err := nl.LinkState(iface)
+	require.Nil(err)
+	require.Equal(iface, state.Name)
+	require.False(state.Up)
+	require.Nil(nl.SetLinkUp(iface))
+	state, err = nl.LinkState(iface)
+	require.Nil(err)
+	require.True(state.Up)
+
+	ip, addr, _ := net.ParseCIDR("10.11.12.1/24")
+	addr.IP = ip
+	require.Nil(nl.AddAddress(iface, addr))
+	ip6, addr6, _ := net.ParseCIDR("2001:db8::1/64")
+	addr6.IP = ip6
+	require.Nil(nl.AddAddress(iface, addr6))
+	err = nl.AddAddress(iface, addr)
+	require.True(errors.Is(err, syscall.EEXIST), "%v", err)
+	addrs, err := nl.Addresses(iface)
+	require.Nil(err)
+	found := make([]string, 0)
+	for _, a := range addrs {
+		found = append(found, a.String())
+	}
+	require.Subset(found, []string{"10.11.12.1/24", "2001:db8::1/64"})
+
+	_, dst, _ := net.ParseCIDR("10.20.0.0/16")
+	routes := []Route{
+		{Dst: dst, Gateway: net.ParseIP("10.11.12.2")},
+		{Gateway: net.ParseIP("10.11.12.254")},
+	}
+	for _, route := range routes {
+		require.Nil(nl.ReplaceRoute(iface, route))
+		require.Nil(nl.ReplaceRoute(iface, route))
+	}
+	found = found[:0]
+	rs, err := nl.Routes(iface)
+	require.Nil(err)
+	for _, r := range rs {
+		found = append(found, r.String())
+	}
+	require.Subset(found, []string{"10.20.0.0/16 via 10.11.12.2", "default via 10.11.12.254"})
+	for _, route := range routes {
+		require.Nil(nl.DeleteRoute(iface, route))
+	}
+	err = nl.DeleteRoute(iface, routes[0])
+	require.True(errors.Is(err, syscall.ESRCH), "%v", err)
+
+	require.Nil(nl.FlushAddresses(iface))
+	addrs, err = nl.Addresses(iface)
+	require.Nil(err)
+	for _, a := range addrs {
+		// The kernel may add a link-local address of its own
+		require.True(a.IP.IsLinkLocalUnicast(), "%v", a)
+	}
+	require.Nil(nl.SetLinkDown(iface))
+	state, err = nl.LinkState(iface)
+	require.Nil(err)
+	require.False(state.Up)
+
+	// Errors name the interface and carry the errno
+	for _, err := range []error{
+		nl.SetLinkUp("missing0"),
+		nl.AddAddress("missing0", addr),
+		nl.FlushAddresses("missing0"),
+		nl.ReplaceRoute("missing0", routes[0]),
+	} {
+		require.True(errors.Is(err, syscall.ENODEV), "%v", err)
+		require.Contains(err.Error(), "missing0")
+		require.Contains(err.Error(), "errno 19")
+	}
+	_, err = nl.LinkState("missing0")
+	require.True(errors.Is(err, syscall.ENODEV), "%v", err)
+}
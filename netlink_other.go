@@ -0,0 +1,51 @@
+//go:build !linux
+
+package wifimanager
+
+import (
+	"errors"
+	"net"
+)
+
+// DefaultLinks fails everywhere but on Linux, where it uses rtnetlink
+var DefaultLinks LinkController = unsupportedLinks{}
+
+type unsupportedLinks struct{}
+
+var errLinksUnsupported = errors.New("interface control is only supported on Linux")
+
+func (unsupportedLinks) LinkState(iface string) (*LinkState, error) {
+	return nil, linkError("get state of", iface, errLinksUnsupported)
+}
+
+func (unsupportedLinks) SetLinkUp(iface string) error {
+	return linkError("bring up", iface, errLinksUnsupported)
+}
+
+func (unsupportedLinks) SetLinkDown(iface string) error {
+	return linkError("bring down", iface, errLinksUnsupported)
+}
+
+func (unsupportedLinks) Addresses(iface string) ([]*net.IPNet, error) {
+	return nil, linkError("list addresses of", iface, errLinksUnsupported)
+}
+
+func (unsupportedLinks) AddAddress(iface string, addr *net.IPNet) error {
+	return linkError("add address to", iface, errLinksUnsupported)
+}
+
+func (unsupportedLinks) FlushAddresses(iface string) error {
+	return linkError("flush addresses of", iface, errLinksUnsupported)
+}
+
+func (unsupportedLinks) Routes(iface string) ([]Route, error) {
+	return nil, linkError("list routes of", iface, errLinksUnsupported)
+}
+
+func (unsupportedLinks) ReplaceRoute(iface string, route Route) error {
+	return linkError("replace route on", iface, errLinksUnsupported)
+}
+
+func (unsupportedLinks) DeleteRoute(iface string, route Route) error {
+	return linkError("delete route on", iface, errLinksUnsupported)
+}
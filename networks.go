@@ -0,0 +1,238 @@
+package wifimanager
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// NetworkOption selects how AddNetworkConf secures a network
+type NetworkOption func(opts *networkOptions)
+
+type networkOptions struct {
+	sae        bool
+	transition bool
+}
+
+// WPA3 makes AddNetworkConf save a WPA3-Personal (SAE only) network. SAE
+// needs the plaintext password, so it is stored as sae_password.
+func WPA3() NetworkOption {
+	return func(opts *networkOptions) {
+		opts.sae = true
+	}
+}
+
+// WPA3Transition makes AddNetworkConf save a network that connects with
+// WPA3-Personal where the access point offers it and WPA2 otherwise
+func WPA3Transition() NetworkOption {
+	return func(opts *networkOptions) {
+		opts.transition = true
+	}
+}
+
+// newNetwork builds the network block AddNetworkConf saves
+func newNetwork(ssid, password string, opts ...NetworkOption) (*WPANetwork, error) {
+	options := &networkOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	if options.sae && !options.transition {
+		if err := validateSSID(ssid); err != nil {
+			return nil, err
+		}
+		if len(password) < 8 {
+			return nil, fmt.Errorf("WPA3 password must be at least 8 characters")
+		}
+		return &WPANetwork{SSID: ssid, KeyMgmt: "SAE", IEEE80211W: 2, SAEPassword: password}, nil
+	}
+
+	data, err := WPAPassphrase(ssid, password)
+	if err != nil {
+		return nil, err
+	}
+	network := ParseWPANetwork(data)
+	if network == nil {
+		return nil, fmt.Errorf("Failed to parse network block for SSID '%v'", ssid)
+	}
+	if options.transition {
+		if len(network.Password) == 0 {
+			return nil, fmt.Errorf("WPA2/WPA3 transition mode needs a passphrase")
+		}
+		network.KeyMgmt = "WPA-PSK SAE"
+		network.IEEE80211W = 1
+		network.SAEPassword = password
+	}
+	return network, nil
+}
+
+// AddNetworkConf adds a network to the WPA conf file. If a network with the
+// same SSID is already present its credentials are replaced instead, and any
+// duplicate blocks for that SSID are removed.
+func (wm *WifiManager) AddNetworkConf(ssid, password string, opts ...NetworkOption) error {
+	network, err := newNetwork(ssid, password, opts...)
+	if err != nil {
+		return err
+	}
+
+	return wm.updateConf(func(conf *WPAConf) error {
+		existing := conf.Network(ssid)
+		if existing == nil {
+			conf.Networks = append(conf.Networks, network)
+			return nil
+		}
+		existing.PSK = network.PSK
+		existing.Password = network.Password
+		existing.KeyMgmt = network.KeyMgmt
+		existing.SAEPassword = network.SAEPassword
+		existing.IEEE80211W = network.IEEE80211W
+		existing.clearEAP()
+		conf.Networks = removeNetworks(conf.Networks, func(wn *WPANetwork) bool {
+			return wn != existing && wn.SSID == ssid
+		})
+		return nil
+	})
+}
+
+// RemoveNetwork removes every network with the given SSID from the WPA conf
+// file, along with their static configurations
+func (wm *WifiManager) RemoveNetwork(ssid string) error {
+	return wm.updateConf(func(conf *WPAConf) error {
+		removed := make([]*WPANetwork, 0)
+		remaining := removeNetworks(conf.Networks, func(wn *WPANetwork) bool {
+			if wn.SSID == ssid {
+				removed = append(removed, wn)
+				return true
+			}
+			return false
+		})
+		if len(removed) == 0 {
+			return fmt.Errorf("No network with SSID '%v' in %v", ssid, wm.WPAConfPath)
+		}
+		if err := wm.removeStaticConfs(removed, remaining); err != nil {
+			return err
+		}
+		conf.Networks = remaining
+		return nil
+	})
+}
+
+// UpdateNetwork calls update on the saved network with the given SSID and
+// writes the result back to the WPA conf file. The file is left alone if
+// update points the network at certificates that do not exist.
+func (wm *WifiManager) UpdateNetwork(ssid string, update func(network *WPANetwork) error) error {
+	return wm.updateConf(func(conf *WPAConf) error {
+		network := conf.Network(ssid)
+		if network == nil {
+			return fmt.Errorf("No network with SSID '%v' in %v", ssid, wm.WPAConfPath)
+		}
+		certs := [3]string{network.CACert, network.ClientCert, network.PrivateKey}
+		if err := update(network); err != nil {
+			return err
+		}
+		if certs != [3]string{network.CACert, network.ClientCert, network.PrivateKey} {
+			return network.checkCertPaths()
+		}
+		return nil
+	})
+}
+
+// SetPriority sets the priority wpa_supplicant uses to choose between
+// visible networks. Higher values are preferred.
+func (wm *WifiManager) SetPriority(ssid string, priority int) error {
+	return wm.UpdateNetwork(ssid, func(network *WPANetwork) error {
+		network.Priority = priority
+		return nil
+	})
+}
+
+// SetDisabled marks a saved network as disabled so that wpa_supplicant
+// does not connect to it automatically
+func (wm *WifiManager) SetDisabled(ssid string, disabled bool) error {
+	return wm.UpdateNetwork(ssid, func(network *WPANetwork) error {
+		network.Disabled = disabled
+		return nil
+	})
+}
+
+// updateConf parses the WPA conf file, applies fn and atomically writes the
+// file back if anything changed. KnownSSIDs is refreshed afterwards.
+func (wm *WifiManager) updateConf(fn func(conf *WPAConf) error) error {
+	wm.confMutex.Lock()
+	defer wm.confMutex.Unlock()
+
+	original, err := ioutil.ReadFile(wm.WPAConfPath)
+	if err != nil {
+		return fmt.Errorf("Failed to read WPA conf file: %v", err)
+	}
+	conf, err := ParseWPAConf(string(original))
+	if err != nil {
+		return fmt.Errorf("Failed to parse WPA conf file: %v", err)
+	}
+	if err = fn(conf); err != nil {
+		return err
+	}
+
+	data := conf.Bytes()
+	if !bytes.Equal(data, original) {
+		if err = writeFileAtomic(wm.WPAConfPath, data); err != nil {
+			return fmt.Errorf("Failed to update WPA conf file: %v", err)
+		}
+	}
+	return wm.UpdateKnownSSIDs()
+}
+
+func removeNetworks(networks []*WPANetwork, remove func(wn *WPANetwork) bool) []*WPANetwork {
+	ret := make([]*WPANetwork, 0, len(networks))
+	for _, network := range networks {
+		if !remove(network) {
+			ret = append(ret, network)
+		}
+	}
+	return ret
+}
+
+// writeFileAtomic replaces path with data such that readers see either the
+// old or the new file, never a partial one, even across a power loss
+func writeFileAtomic(path string, data []byte) error {
+	perm := os.FileMode(0600)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmpPath, perm); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	// Make the rename itself durable
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,196 @@
+package wifimanager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func createNetworksTestConf(require *require.Assertions) (string, func()) {
+	dir, err := ioutil.TempDir("", "wifimanager-")
+	require.Nil(err)
+	path := filepath.Join(dir, "wpa_supplicant.conf")
+	err = ioutil.WriteFile(path, []byte(wpaConfRoundTripTestData), 0640)
+	require.Nil(err)
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestAddNetworkConfMerge(t *testing.T) {
+	require := require.New(t)
+
+	path, cleanup := createNetworksTestConf(require)
+	defer cleanup()
+
+	wm, err := New(path)
+	require.Nil(err)
+
+	err = wm.AddNetworkConf("guest", "")
+	require.Nil(err)
+	require.True(wm.KnownSSIDs.Has("guest"))
+
+	// Adding it again must not create a second block
+	err = wm.AddNetworkConf("guest", "")
+	require.Nil(err)
+
+	networks, err := ParseWPASupplicantConf(path)
+	require.Nil(err)
+	require.Equal(3, len(networks))
+	require.Equal("NONE", networks[2].KeyMgmt)
+
+	// The rest of the file is untouched and the mode is preserved
+	data, err := ioutil.ReadFile(path)
+	require.Nil(err)
+	require.Contains(string(data), wpaConfRoundTripTestData)
+	info, err := os.Stat(path)
+	require.Nil(err)
+	require.Equal(os.FileMode(0640), info.Mode().Perm())
+}
+
+func TestRemoveNetwork(t *testing.T) {
+	require := require.New(t)
+
+	path, cleanup := createNetworksTestConf(require)
+	defer cleanup()
+
+	wm, err := New(path)
+	require.Nil(err)
+	require.True(wm.KnownSSIDs.Has("home"))
+
+	err = wm.RemoveNetwork("home")
+	require.Nil(err)
+	require.False(wm.KnownSSIDs.Has("home"))
+	require.True(wm.KnownSSIDs.Has("office"))
+
+	err = wm.RemoveNetwork("home")
+	require.NotNil(err)
+
+	conf, err := ReadWPAConf(path)
+	require.Nil(err)
+	require.Equal(1, len(conf.Networks))
+	value, _ := conf.Global("country")
+	require.Equal("US", value)
+}
+
+func TestUpdateNetwork(t *testing.T) {
+	require := require.New(t)
+
+	path, cleanup := createNetworksTestConf(require)
+	defer cleanup()
+
+	wm, err := New(path)
+	require.Nil(err)
+
+	err = wm.SetPriority("office", 7)
+	require.Nil(err)
+	err = wm.SetDisabled("office", false)
+	require.Nil(err)
+	err = wm.SetDisabled("home", true)
+	require.Nil(err)
+	err = wm.UpdateNetwork("home", func(network *WPANetwork) error {
+		network.BSSID = "66:77:88:99:aa:bb"
+		return nil
+	})
+	require.Nil(err)
+
+	err = wm.SetPriority("missing", 1)
+	require.NotNil(err)
+
+	conf, err := ReadWPAConf(path)
+	require.Nil(err)
+	home, office := conf.Network("home"), conf.Network("office")
+	require.True(home.Disabled)
+	require.Equal("66:77:88:99:aa:bb", home.BSSID)
+	require.Equal(5, home.Priority)
+	require.Equal(7, office.Priority)
+	require.False(office.Disabled)
+	require.Equal("bob", office.Identity)
+}
+
+func TestAddNetworkConfWPA3(t *testing.T) {
+	require := require.New(t)
+
+	path, cleanup := createNetworksTestConf(require)
+	defer cleanup()
+
+	wm, err := New(path)
+	require.Nil(err)
+
+	err = wm.AddNetworkConf("sae", "correct horse battery staple", WPA3())
+	require.Nil(err)
+	err = wm.AddNetworkConf("mixed", "password123", WPA3Transition())
+	require.Nil(err)
+	require.NotNil(wm.AddNetworkConf("short", "pass", WPA3()))
+	require.NotNil(wm.AddNetworkConf("open", "", WPA3Transition()))
+
+	data, err := ioutil.ReadFile(path)
+	require.Nil(err)
+	require.Contains(string(data), `
+network={
+	ssid="sae"
+	key_mgmt=SAE
+	sae_password="correct horse battery staple"
+	ieee80211w=2
+}`)
+
+	conf, err := ReadWPAConf(path)
+	require.Nil(err)
+	sae := conf.Network("sae")
+	require.Equal("", sae.PSK)
+	require.Equal("correct horse battery staple", sae.SAEPassword)
+	mixed := conf.Network("mixed")
+	require.Equal("WPA-PSK SAE", mixed.KeyMgmt)
+	require.Equal(1, mixed.IEEE80211W)
+	require.Equal("password123", mixed.SAEPassword)
+	require.Equal(64, len(mixed.PSK))
+
+	// Switching the network back to WPA2 drops the SAE settings
+	err = wm.AddNetworkConf("sae", "password123")
+	require.Nil(err)
+	conf, err = ReadWPAConf(path)
+	require.Nil(err)
+	sae = conf.Network("sae")
+	require.Equal(64, len(sae.PSK))
+	require.Equal("", sae.KeyMgmt)
+	require.Equal(0, sae.IEEE80211W)
+	require.Equal("", sae.SAEPassword)
+}
+
+func TestAddNetworkConfFromEAP(t *testing.T) {
+	require := require.New(t)
+
+	path, cleanup := createNetworksTestConf(require)
+	defer cleanup()
+	data, err := ioutil.ReadFile(path)
+	require.Nil(err)
+	data = []byte(strings.Replace(string(data), "    bssid=", "    phase1=\"peaplabel=0\"\n    bssid=", 1))
+	require.Nil(ioutil.WriteFile(path, data, 0640))
+
+	wm, err := New(path)
+	require.Nil(err)
+	require.Nil(wm.AddNetworkConf("office", "password123"))
+
+	data, err = ioutil.ReadFile(path)
+	require.Nil(err)
+	require.Contains(string(data), `
+# Office
+network={
+    ssid=6f6666696365
+    scan_ssid=1
+    bssid=00:11:22:33:44:55
+    disabled=1
+    #psk="password123"
+    psk=`)
+	for _, key := range []string{"key_mgmt=WPA-EAP", "eap=", "identity=", "password=", "phase1=", "phase2="} {
+		require.NotContains(string(data), "    "+key)
+	}
+	conf, err := ReadWPAConf(path)
+	require.Nil(err)
+	office := conf.Network("office")
+	require.Equal("", office.EAP)
+	require.Equal("", office.Identity)
+	require.Equal(64, len(office.PSK))
+}
@@ -0,0 +1,409 @@
+package wifimanager
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultRunDir is where PID files are kept unless WifiManager.RunDir is set
+const DefaultRunDir = "/var/run/wifimanager"
+
+// tempConfDir is where the configurations generated for the daemons are
+// written. Files in it starting with one of tempConfPrefixes are ours.
+var tempConfDir = "/tmp"
+
+var tempConfPrefixes = []string{"hostapd-", "dnsmasq-", "wpa_supplicant-"}
+
+// ownPid is recorded in PID files as the owner of the daemons we start, so
+// that those of managers that are still running are left alone
+var ownPid = os.Getpid()
+
+// ownStart is the start time of this program, recorded along with ownPid so
+// that an owner whose pid was reused can be told apart
+var ownStart = processStartTime(ownPid)
+
+// ProcessFinder is implemented by Executors that can find a process started
+// by an earlier run of the program
+type ProcessFinder interface {
+	// FindProcess returns the process with the given pid if it is alive and
+	// running cmdline. Such a process cannot be waited for, so the returned
+	// Process has no exit error.
+	FindProcess(pid int, cmdline string) (Process, error)
+}
+
+// pidFile records a daemon we launched. The first line is the pid, so the
+// file works with the usual tools; the name, interface, command line, and
+// the pid and start time of the program that owns the daemon follow.
+type pidFile struct {
+	path    string
+	name    string
+	iface   string
+	cmdline string
+	pid     int
+	// owner is 0 in files written before owners were recorded, and
+	// ownerStart in those written before their start times were
+	owner      int
+	ownerStart uint64
+}
+
+func (wm *WifiManager) runDir() string {
+	if len(wm.RunDir) == 0 {
+		return DefaultRunDir
+	}
+	return wm.RunDir
+}
+
+func (wm *WifiManager) newPidFile(name, iface, cmdline string) *pidFile {
+	return &pidFile{
+		path:       filepath.Join(wm.runDir(), fmt.Sprintf("%v-%v.pid", name, iface)),
+		name:       name,
+		iface:      iface,
+		cmdline:    cmdline,
+		owner:      ownPid,
+		ownerStart: ownStart,
+	}
+}
+
+func readPidFile(path string) (*pidFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) < 4 || len(lines) > 6 {
+		return nil, fmt.Errorf("Malformed PID file %v", path)
+	}
+	pid, err := strconv.Atoi(lines[0])
+	if err != nil || pid <= 0 {
+		return nil, fmt.Errorf("Malformed PID file %v: bad pid '%v'", path, lines[0])
+	}
+	pf := &pidFile{path: path, pid: pid, name: lines[1], iface: lines[2], cmdline: lines[3]}
+	if len(lines) >= 5 {
+		if pf.owner, err = strconv.Atoi(lines[4]); err != nil || pf.owner <= 0 {
+			return nil, fmt.Errorf("Malformed PID file %v: bad owner '%v'", path, lines[4])
+		}
+	}
+	if len(lines) == 6 {
+		if pf.ownerStart, err = strconv.ParseUint(lines[5], 10, 64); err != nil {
+			return nil, fmt.Errorf("Malformed PID file %v: bad owner start time '%v'", path, lines[5])
+		}
+	}
+	return pf, nil
+}
+
+// orphaned reports whether the program that started the daemon is gone.
+// Our own pid only names this program if the start time matches too: after a
+// crash the program is often restarted with the same pid, e.g. as pid 1 of a
+// container. Another live pid is only trusted if its start time matches.
+func (pf *pidFile) orphaned() bool {
+	if pf.owner == 0 {
+		return true
+	}
+	if pf.owner == ownPid {
+		return pf.ownerStart == 0 || pf.ownerStart != ownStart
+	}
+	if syscall.Kill(pf.owner, 0) == syscall.ESRCH {
+		return true
+	}
+	start := processStartTime(pf.owner)
+	return pf.ownerStart != 0 && start != 0 && start != pf.ownerStart
+}
+
+// processStartTime returns the time pid started in clock ticks after boot,
+// field 22 of /proc/<pid>/stat, or 0 if it cannot be read
+func processStartTime(pid int) uint64 {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+	// The command name in field 2 may contain spaces and parentheses
+	idx := strings.LastIndex(string(data), ")")
+	if idx < 0 {
+		return 0
+	}
+	fields := strings.Fields(string(data[idx+1:]))
+	if len(fields) < 20 {
+		return 0
+	}
+	start, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return start
+}
+
+// removeConf removes the generated configuration the daemon was started
+// with, if any
+func (pf *pidFile) removeConf() {
+	if path := tempConfPath(pf.cmdline); len(path) > 0 {
+		log.Debugf("Removing leftover %v", path)
+		os.Remove(path)
+	}
+}
+
+// write records pid. Failures are only logged since the daemon is running
+// either way.
+func (pf *pidFile) write(pid int) {
+	pf.pid = pid
+	data := fmt.Sprintf("%d\n%v\n%v\n%v\n%d\n%d\n", pid, pf.name, pf.iface, pf.cmdline, pf.owner, pf.ownerStart)
+	err := os.MkdirAll(filepath.Dir(pf.path), 0755)
+	if err == nil {
+		err = writeFileAtomic(pf.path, []byte(data))
+	}
+	if err != nil {
+		log.Warnf("Failed to write PID file for %v: %v", pf.name, err)
+	}
+}
+
+// remove deletes the file unless it has been taken over by another instance
+func (pf *pidFile) remove() {
+	if current, err := readPidFile(pf.path); err == nil && current.pid != pf.pid {
+		return
+	}
+	os.Remove(pf.path)
+}
+
+// orphan is a live daemon found through a PID file
+type orphan struct {
+	*pidFile
+	proc Process
+}
+
+// RecoverOrphans deals with the daemons recorded in RunDir by an earlier run
+// that did not shut down cleanly. Daemons whose program is still running are
+// left alone. With AdoptOrphans set, live daemons are supervised as though
+// this manager had started them, either one wpa_supplicant or one hotspot on
+// each interface; anything else is stopped. Stale PID files and the
+// configuration files they name are removed. New calls it.
+func (wm *WifiManager) RecoverOrphans() error {
+	dir := wm.runDir()
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to read run directory: %v", err)
+	}
+
+	orphans := make([]*orphan, 0)
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".pid") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		pf, err := readPidFile(path)
+		if err != nil {
+			log.Warnf("Removing unreadable PID file: %v", err)
+			os.Remove(path)
+			continue
+		}
+		if !pf.orphaned() {
+			log.Debugf("Leaving %v (pid %d) to its owner %d", pf.name, pf.pid, pf.owner)
+			continue
+		}
+		proc, err := wm.findProcess(pf.pid, pf.cmdline)
+		if err != nil {
+			log.Infof("Removing stale PID file %v: %v", path, err)
+			os.Remove(path)
+			pf.removeConf()
+			continue
+		}
+		orphans = append(orphans, &orphan{pf, proc})
+	}
+
+	adopted := wm.adoptOrphans(orphans)
+	supplicants := make([]string, 0)
+	for o := range adopted {
+		if o.name == "wpa_supplicant" {
+			supplicants = append(supplicants, o.iface)
+		}
+	}
+	sort.Strings(supplicants)
+	errs := make([]string, 0)
+	for _, o := range orphans {
+		if adopted[o] {
+			continue
+		}
+		log.Infof("Stopping orphaned %v (pid %d) on %v", o.name, o.pid, o.iface)
+		if err := stopProcess(context.Background(), o.proc, wm.gracePeriod()); err != nil {
+			errs = append(errs, fmt.Sprintf("Failed to stop %v (pid %d): %v", o.name, o.pid, err))
+			continue
+		}
+		os.Remove(o.path)
+		o.removeConf()
+	}
+
+	// The output of the DHCP client of an adopted wpa_supplicant cannot be
+	// followed, so it was stopped above and is replaced by a new one
+	for _, iface := range supplicants {
+		if len(wm.DHCPClient) == 0 {
+			break
+		}
+		wm.enableDHCP(iface)
+		if err := wm.startDHCP(iface); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// adoptOrphans supervises the orphans that fit on idle interfaces and
+// returns them
+func (wm *WifiManager) adoptOrphans(orphans []*orphan) map[*orphan]bool {
+	adopted := make(map[*orphan]bool)
+	if !wm.AdoptOrphans {
+		return adopted
+	}
+	byIface := make(map[string][]*orphan)
+	ifaces := make([]string, 0)
+	for _, o := range orphans {
+		if _, ok := byIface[o.iface]; !ok {
+			ifaces = append(ifaces, o.iface)
+		}
+		byIface[o.iface] = append(byIface[o.iface], o)
+	}
+	sort.Strings(ifaces)
+	for _, iface := range ifaces {
+		wm.adoptIfaceOrphans(wm.controller(iface), byIface[iface], adopted)
+	}
+	return adopted
+}
+
+// adoptIfaceOrphans adopts a wpa_supplicant, or else a hotspot, among the
+// orphans of one interface if nothing runs there yet
+func (wm *WifiManager) adoptIfaceOrphans(ic *ifaceController, orphans []*orphan, adopted map[*orphan]bool) {
+	ic.lock(context.Background())
+	defer ic.unlock()
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	if ic.role != RoleIdle {
+		return
+	}
+	adopt := func(o *orphan, onLine func(line string)) *Supervised {
+		log.Infof("Adopting %v (pid %d) on %v", o.name, o.pid, o.iface)
+		adopted[o] = true
+		o.owner, o.ownerStart = ownPid, ownStart
+		return newSupervised(wm.executor(), o.name, o.cmdline, onLine, wm.Supervisor, o.proc, o.pidFile)
+	}
+
+	for _, o := range orphans {
+		if o.name == "wpa_supplicant" {
+			ic.wpaSupplicantCmd = adopt(o, wm.supplicantLineHandler(ic.name))
+			ic.role = RoleClient
+			return
+		}
+	}
+
+	// hostapd is only useful together with the dnsmasq on the same interface
+	for _, hostapd := range orphans {
+		if hostapd.name != "hostapd" {
+			continue
+		}
+		for _, dnsmasq := range orphans {
+			if dnsmasq.name != "dnsmasq" {
+				continue
+			}
+			ic.hostapdCmd = adopt(hostapd, nil)
+			ic.dnsmasqCmd = adopt(dnsmasq, nil)
+			ic.hostapdConf = tempConfPath(hostapd.cmdline)
+			ic.dnsmasqConf = tempConfPath(dnsmasq.cmdline)
+			ic.role = RoleHotspot
+			return
+		}
+	}
+}
+
+func (wm *WifiManager) findProcess(pid int, cmdline string) (Process, error) {
+	finder, ok := wm.executor().(ProcessFinder)
+	if !ok {
+		return nil, fmt.Errorf("Executor cannot look up processes")
+	}
+	return finder.FindProcess(pid, cmdline)
+}
+
+// tempConfPath returns the generated configuration cmdline was started with,
+// if any. The path may be attached to its option, as in -c/tmp/...
+func tempConfPath(cmdline string) string {
+	for _, field := range strings.Fields(cmdline) {
+		if idx := strings.Index(field, "/"); idx > 0 && strings.HasPrefix(field, "-") {
+			field = field[idx:]
+		}
+		if filepath.Dir(field) != filepath.Clean(tempConfDir) {
+			continue
+		}
+		for _, prefix := range tempConfPrefixes {
+			if strings.HasPrefix(filepath.Base(field), prefix) {
+				return field
+			}
+		}
+	}
+	return ""
+}
+
+func (ee *execExecutor) FindProcess(pid int, cmdline string) (Process, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil, fmt.Errorf("No process %d: %v", pid, err)
+	}
+	args := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+	if strings.Join(args, " ") != strings.Join(strings.Fields(cmdline), " ") {
+		return nil, fmt.Errorf("Process %d is not '%v'", pid, cmdline)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return nil, err
+	}
+	p := &foreignProcess{proc: proc, done: make(chan struct{})}
+	go p.poll()
+	return p, nil
+}
+
+// foreignProcess is a process that is not our child. It is polled since it
+// cannot be waited for.
+type foreignProcess struct {
+	proc *os.Process
+	done chan struct{}
+}
+
+func (p *foreignProcess) poll() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := p.proc.Signal(syscall.Signal(0)); err != nil {
+			close(p.done)
+			return
+		}
+	}
+}
+
+func (p *foreignProcess) Pid() int {
+	return p.proc.Pid
+}
+
+func (p *foreignProcess) Signal(sig os.Signal) error {
+	return p.proc.Signal(sig)
+}
+
+func (p *foreignProcess) Kill() error {
+	return p.proc.Kill()
+}
+
+func (p *foreignProcess) Wait() error {
+	<-p.done
+	return nil
+}
+
+func (p *foreignProcess) Done() <-chan struct{} {
+	return p.done
+}
@@ -0,0 +1,260 @@
+package wifimanager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// deadPid is above the kernel's pid limit, so no process ever has it
+const deadPid = 1 << 30
+
+// crashedWifiManager starts a hotspot on wlan0 and wpa_supplicant on wlan1
+// and wlan2, then abandons the manager as though the program had died. The
+// generated configurations are written to a temporary directory, along with
+// a file of another program that looks like ours.
+func crashedWifiManager(require *require.Assertions) (*WifiManager, *FakeExecutor, func()) {
+	wm, executor, cleanup := newFakeWifiManager(require)
+	dir, err := ioutil.TempDir("", "wifimanager-tmp-")
+	require.Nil(err)
+	oldTempConfDir := tempConfDir
+	tempConfDir = dir
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, "dnsmasq-other"), nil, 0644))
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, "unrelated"), nil, 0644))
+
+	ownPid = deadPid
+	defer func() { ownPid = os.Getpid() }()
+	wm.Hotspot.SSID = "setup"
+	require.Nil(wm.StartHotspot("wlan0"))
+	require.Nil(wm.StartWPASupplicant("wlan1", wm.WPAConfPath))
+	require.Nil(wm.StartWPASupplicant("wlan2", wm.WPAConfPath))
+
+	restarted := &WifiManager{
+		WPAConfPath:     wm.WPAConfPath,
+		CtrlDir:         wm.CtrlDir,
+		RunDir:          wm.RunDir,
+		Executor:        executor,
+		Links:           wm.Links,
+		StopGracePeriod: 10 * time.Millisecond,
+	}
+	return restarted, executor, func() {
+		tempConfDir = oldTempConfDir
+		os.RemoveAll(dir)
+		cleanup()
+	}
+}
+
+func TestPidFiles(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	wm.Supervisor.InitialBackoff = time.Millisecond
+
+	require.Nil(wm.StartHotspot("wlan0"))
+	pf, err := readPidFile(filepath.Join(wm.RunDir, "hostapd-wlan0.pid"))
+	require.Nil(err)
+	hostapd := executor.Processes("/usr/sbin/hostapd")[0]
+	require.Equal(hostapd.Pid(), pf.pid)
+	require.Equal("hostapd", pf.name)
+	require.Equal("wlan0", pf.iface)
+	require.Equal(hostapd.Cmdline, pf.cmdline)
+	require.Equal(os.Getpid(), pf.owner)
+	require.Equal(ownStart, pf.ownerStart)
+
+	// The file follows restarts
+	hostapd.Exit(1)
+	require.Eventually(func() bool {
+		return len(executor.Processes("/usr/sbin/hostapd")) == 2 && wm.controller("wlan0").hostapdRunning()
+	}, time.Second, time.Millisecond)
+	pf, err = readPidFile(filepath.Join(wm.RunDir, "hostapd-wlan0.pid"))
+	require.Nil(err)
+	require.Equal(executor.Processes("/usr/sbin/hostapd")[1].Pid(), pf.pid)
+
+	require.Nil(wm.StopHotspot("wlan0"))
+	entries, err := ioutil.ReadDir(wm.RunDir)
+	require.Nil(err)
+	require.Empty(entries)
+
+	// A missing run directory is not fatal
+	wm.RunDir = "/path/that/does/not/exist"
+	require.Nil(wm.StartWPASupplicant("wlan0", wm.WPAConfPath))
+	require.True(wm.IsWPASupplicantRunning())
+}
+
+func TestRecoverOrphans(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := crashedWifiManager(require)
+	defer cleanup()
+	executor.Processes("/usr/sbin/hostapd")[0].IgnoreTerm()
+	require.Nil(ioutil.WriteFile(filepath.Join(wm.RunDir, "dnsmasq-wlan3.pid"), []byte("4242\ndnsmasq\nwlan3\n/usr/sbin/dnsmasq -d\n"), 0644))
+	require.Nil(ioutil.WriteFile(filepath.Join(wm.RunDir, "garbage.pid"), []byte("garbage"), 0644))
+
+	require.Nil(wm.RecoverOrphans())
+	for _, name := range []string{"/usr/sbin/hostapd", "/usr/sbin/dnsmasq", "/sbin/wpa_supplicant"} {
+		for _, p := range executor.Processes(name) {
+			require.False(p.Running(), name)
+		}
+	}
+	require.Equal([]os.Signal{syscall.SIGTERM, os.Kill}, executor.Processes("/usr/sbin/hostapd")[0].Signals())
+	require.False(wm.IsHostapdRunning())
+	require.False(wm.IsWPASupplicantRunning())
+
+	entries, err := ioutil.ReadDir(wm.RunDir)
+	require.Nil(err)
+	require.Empty(entries)
+	// Only the configurations named in PID files are removed
+	entries, err = ioutil.ReadDir(tempConfDir)
+	require.Nil(err)
+	names := make([]string, 0)
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	require.Equal([]string{"dnsmasq-other", "unrelated"}, names)
+}
+
+func TestRecoverOrphansOfLiveOwner(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	wm.Hotspot.SSID = "setup"
+	require.Nil(wm.StartHotspot("wlan0"))
+
+	// Another manager sharing RunDir leaves the daemons of this one alone
+	other := &WifiManager{WPAConfPath: wm.WPAConfPath, RunDir: wm.RunDir, Executor: executor, Links: wm.Links}
+	require.Nil(other.RecoverOrphans())
+	require.True(wm.IsHostapdRunning())
+	entries, err := ioutil.ReadDir(wm.RunDir)
+	require.Nil(err)
+	require.Equal(2, len(entries))
+	require.FileExists(wm.controller("wlan0").hostapdConf)
+	require.Nil(wm.StopHotspot("wlan0"))
+}
+
+func TestRecoverOrphansOfOwnPid(t *testing.T) {
+	require := require.New(t)
+
+	// The program that crashed had our pid but started earlier
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	ownStart--
+	wm.Hotspot.SSID = "setup"
+	require.Nil(wm.StartHotspot("wlan0"))
+	ownStart++
+
+	restarted := &WifiManager{WPAConfPath: wm.WPAConfPath, RunDir: wm.RunDir, Executor: executor, Links: wm.Links}
+	require.Nil(restarted.RecoverOrphans())
+	for _, name := range []string{"/usr/sbin/hostapd", "/usr/sbin/dnsmasq"} {
+		require.False(executor.Processes(name)[0].Running(), name)
+	}
+	entries, err := ioutil.ReadDir(wm.RunDir)
+	require.Nil(err)
+	require.Empty(entries)
+}
+
+func TestPidFileOrphaned(t *testing.T) {
+	require := require.New(t)
+
+	require.NotZero(ownStart)
+	parent := os.Getppid()
+	for _, tc := range []struct {
+		owner      int
+		ownerStart uint64
+		orphaned   bool
+	}{
+		{0, 0, true},
+		{ownPid, ownStart, false},
+		{ownPid, ownStart + 1, true},
+		{ownPid, 0, true},
+		{deadPid, ownStart, true},
+		{parent, processStartTime(parent), false},
+		{parent, 0, false},
+		// The pid of the owner was given to another process
+		{parent, processStartTime(parent) + 1, true},
+	} {
+		pf := &pidFile{owner: tc.owner, ownerStart: tc.ownerStart}
+		require.Equal(tc.orphaned, pf.orphaned(), "%+v", tc)
+	}
+}
+
+func TestTempConfPath(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal("/tmp/hostapd-123", tempConfPath("/usr/sbin/hostapd /tmp/hostapd-123"))
+	require.Equal("/tmp/dnsmasq-123", tempConfPath("/usr/sbin/dnsmasq -d -C /tmp/dnsmasq-123"))
+	require.Equal("/tmp/wpa_supplicant-123", tempConfPath("/sbin/wpa_supplicant -Dnl80211 -iwlan0 -c/tmp/wpa_supplicant-123"))
+	require.Equal("", tempConfPath("/sbin/wpa_supplicant -Dnl80211 -iwlan0 -c/etc/wpa_supplicant/wpa_supplicant.conf"))
+	require.Equal("", tempConfPath("/usr/sbin/hostapd /tmp/unrelated"))
+}
+
+func TestAdoptOrphans(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := crashedWifiManager(require)
+	defer cleanup()
+	wm.AdoptOrphans = true
+
+	require.Nil(wm.RecoverOrphans())
+	require.True(wm.IsHostapdRunning())
+	require.True(wm.IsWPASupplicantRunning())
+	ic := wm.controller("wlan0")
+	require.Equal(executor.Processes("/usr/sbin/hostapd")[0].Pid(), ic.hostapdCmd.Pid())
+	// Each interface gets its own daemons back
+	require.Equal([]InterfaceStatus{
+		{Name: "wlan0", Role: RoleHotspot, State: StateStopped, Daemons: wm.Interface("wlan0").Daemons},
+		{Name: "wlan1", Role: RoleClient, State: StateStopped, Daemons: wm.Interface("wlan1").Daemons},
+		{Name: "wlan2", Role: RoleClient, State: StateStopped, Daemons: wm.Interface("wlan2").Daemons},
+	}, wm.Interfaces())
+	for _, p := range executor.Processes("/sbin/wpa_supplicant") {
+		require.True(p.Running())
+	}
+
+	// The configurations of the adopted hotspot are kept, the rest removed
+	require.FileExists(ic.hostapdConf)
+	require.FileExists(ic.dnsmasqConf)
+	require.FileExists(filepath.Join(tempConfDir, "dnsmasq-other"))
+
+	// Adopted daemons are supervised like any other
+	require.Nil(wm.Close())
+	for _, p := range executor.Processes("") {
+		require.False(p.Running(), p.Cmdline)
+	}
+	entries, err := ioutil.ReadDir(wm.RunDir)
+	require.Nil(err)
+	require.Empty(entries)
+	// The adopted hotspot's configurations went with it
+	entries, err = ioutil.ReadDir(tempConfDir)
+	require.Nil(err)
+	require.Equal(2, len(entries))
+}
+
+func TestExecFindProcess(t *testing.T) {
+	require := require.New(t)
+
+	p, err := DefaultExecutor.Start("sleep 10", "test", nil)
+	require.Nil(err)
+	defer p.Kill()
+
+	finder := DefaultExecutor.(ProcessFinder)
+	_, err = finder.FindProcess(p.Pid(), "sleep 20")
+	require.NotNil(err)
+	found, err := finder.FindProcess(p.Pid(), "sleep 10")
+	require.Nil(err)
+	require.Equal(p.Pid(), found.Pid())
+
+	require.Nil(found.Kill())
+	select {
+	case <-found.Done():
+	case <-time.After(2 * time.Second):
+		require.Fail("Exit was not noticed")
+	}
+	_, err = finder.FindProcess(p.Pid(), "sleep 10")
+	require.NotNil(err)
+}
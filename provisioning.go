@@ -0,0 +1,321 @@
+package wifimanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ProvisioningNetwork is an entry of GET /networks
+type ProvisioningNetwork struct {
+	SSID      string     `json:"ssid"`
+	BSSID     string     `json:"bssid"`
+	Frequency int        `json:"frequency"`
+	Signal    int        `json:"signal"`
+	Security  []Security `json:"security"`
+	Known     bool       `json:"known"`
+}
+
+// ProvisioningRequest is the body of POST /networks
+type ProvisioningRequest struct {
+	SSID     string `json:"ssid"`
+	Password string `json:"password"`
+	// Security is "wpa3" or "wpa3-transition" for networks that need SAE
+	Security string `json:"security,omitempty"`
+}
+
+// ProvisioningStatus is the response of GET /status
+type ProvisioningStatus struct {
+	State         State    `json:"state"`
+	SSID          string   `json:"ssid"`
+	Hotspot       bool     `json:"hotspot"`
+	WPASupplicant bool     `json:"wpa_supplicant"`
+	KnownSSIDs    []string `json:"known_ssids"`
+	// Test is the last network tested through POST /networks
+	Test *ProvisioningTest `json:"test,omitempty"`
+}
+
+// ProvisioningTestState is the progress of a ProvisioningTest
+type ProvisioningTestState string
+
+const (
+	ProvisioningTesting ProvisioningTestState = "testing"
+	ProvisioningSaved   ProvisioningTestState = "saved"
+	ProvisioningFailed  ProvisioningTestState = "failed"
+)
+
+// ProvisioningTest is the outcome of testing a ProvisioningRequest
+type ProvisioningTest struct {
+	SSID   string                `json:"ssid"`
+	State  ProvisioningTestState `json:"state"`
+	Error  string                `json:"error,omitempty"`
+	Reason string                `json:"reason,omitempty"`
+}
+
+type provisioningError struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// NewProvisioningHandler returns an http.Handler that lets a user enter Wi-Fi
+// credentials for iface:
+//
+//	GET    /networks        visible networks, strongest first
+//	POST   /networks        test a ProvisioningRequest and save it if it works
+//	DELETE /networks/{ssid} forget a saved network
+//	GET    /status          a ProvisioningStatus
+//
+// The user is usually connected through a hotspot on iface. Networks are
+// then listed from the running ScanCache, since iface cannot scan in AP
+// mode, and POST /networks answers 202 right away: the test takes the
+// hotspot down, so it runs in the background and the hotspot is restarted
+// once it is over. Its outcome is reported by GET /status.
+func NewProvisioningHandler(wm *WifiManager, iface string) http.Handler {
+	ph := &provisioningHandler{wm: wm, iface: iface}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/networks", ph.networks)
+	mux.HandleFunc("/networks/", ph.network)
+	mux.HandleFunc("/status", ph.status)
+	return mux
+}
+
+type provisioningHandler struct {
+	wm    *WifiManager
+	iface string
+	test  *ProvisioningTest
+	mutex sync.Mutex
+}
+
+func (ph *provisioningHandler) networks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		ph.listNetworks(w, r)
+	case http.MethodPost:
+		ph.addNetwork(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"), "")
+	}
+}
+
+func (ph *provisioningHandler) listNetworks(w http.ResponseWriter, r *http.Request) {
+	results, code, err := ph.scanResults()
+	if err != nil {
+		writeJSONError(w, code, err, "")
+		return
+	}
+	// Only list the strongest access point of each named network
+	bySSID := make(map[string]*ProvisioningNetwork)
+	for _, result := range results {
+		if len(result.SSID) == 0 {
+			continue
+		}
+		if existing, ok := bySSID[result.SSID]; ok && existing.Signal >= result.Signal {
+			continue
+		}
+		bySSID[result.SSID] = &ProvisioningNetwork{
+			SSID:      result.SSID,
+			BSSID:     result.BSSID,
+			Frequency: result.Frequency,
+			Signal:    result.Signal,
+			Security:  result.Security,
+			Known:     ph.wm.KnownSSIDs.Has(result.SSID),
+		}
+	}
+	networks := make([]*ProvisioningNetwork, 0, len(bySSID))
+	for _, network := range bySSID {
+		networks = append(networks, network)
+	}
+	sort.Slice(networks, func(i, j int) bool {
+		if networks[i].Signal != networks[j].Signal {
+			return networks[i].Signal > networks[j].Signal
+		}
+		return networks[i].SSID < networks[j].SSID
+	})
+	writeJSON(w, http.StatusOK, networks)
+}
+
+func (ph *provisioningHandler) addNetwork(w http.ResponseWriter, r *http.Request) {
+	var req ProvisioningRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err, "")
+		return
+	}
+	if len(req.SSID) == 0 {
+		writeJSONError(w, http.StatusBadRequest, errors.New("Missing SSID"), "")
+		return
+	}
+
+	opts := make([]NetworkOption, 0)
+	switch req.Security {
+	case "":
+	case "wpa3":
+		opts = append(opts, WPA3())
+	case "wpa3-transition":
+		opts = append(opts, WPA3Transition())
+	default:
+		writeJSONError(w, http.StatusBadRequest, errors.New("Unknown security"), "")
+		return
+	}
+	network, err := newNetwork(req.SSID, req.Password, opts...)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err, "")
+		return
+	}
+
+	ph.mutex.Lock()
+	if ph.test != nil && ph.test.State == ProvisioningTesting {
+		ph.mutex.Unlock()
+		writeJSONError(w, http.StatusConflict, errors.New("A network is already being tested"), "")
+		return
+	}
+	ph.test = &ProvisioningTest{SSID: req.SSID, State: ProvisioningTesting}
+	ph.mutex.Unlock()
+
+	// The client would lose the response along with the hotspot
+	if hotspot, ok := ph.wm.controller(ph.iface).runningHotspot(); ok {
+		go func() {
+			ph.testNetwork(req, network, opts)
+			if err := ph.wm.StartHotspotWithConfig(ph.iface, hotspot); err != nil {
+				log.Errorf("Provisioning: failed to restart hotspot: %v", err)
+			}
+		}()
+		writeJSON(w, http.StatusAccepted, ph.currentStatus())
+		return
+	}
+
+	if test, code := ph.testNetwork(req, network, opts); code != http.StatusCreated {
+		writeJSON(w, code, &provisioningError{Error: test.Error, Reason: test.Reason})
+		return
+	}
+	writeJSON(w, http.StatusCreated, ph.currentStatus())
+}
+
+// testNetwork tests network on iface and saves it if it works. The outcome
+// is recorded for GET /status and returned with the matching HTTP status.
+func (ph *provisioningHandler) testNetwork(req ProvisioningRequest, network *WPANetwork, opts []NetworkOption) (*ProvisioningTest, int) {
+	test := &ProvisioningTest{SSID: req.SSID, State: ProvisioningSaved}
+	code := http.StatusCreated
+	if err := ph.wm.TestConnect(ph.iface, network); err != nil {
+		log.Warnf("Provisioning: %v", err)
+		test.State, test.Error, test.Reason = ProvisioningFailed, err.Error(), connectFailureReason(err)
+		code = http.StatusUnprocessableEntity
+	} else if err = ph.wm.AddNetworkConf(req.SSID, req.Password, opts...); err != nil {
+		test.State, test.Error = ProvisioningFailed, err.Error()
+		code = http.StatusInternalServerError
+	} else {
+		log.Infof("Provisioning: saved network '%v'", req.SSID)
+	}
+	ph.mutex.Lock()
+	ph.test = test
+	ph.mutex.Unlock()
+	return test, code
+}
+
+// scanResults returns the access points around iface along with the HTTP
+// status to fail with
+func (ph *provisioningHandler) scanResults() ([]*ScanResult, int, error) {
+	if sc := ph.wm.runningScanCache(); sc != nil {
+		results := sc.Results()
+		if _, err := sc.LastScan(); len(results) == 0 && err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return results, http.StatusOK, nil
+	}
+	if _, ok := ph.wm.controller(ph.iface).runningHotspot(); ok {
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("Cannot scan on %v while it runs the hotspot; start a ScanCache", ph.iface)
+	}
+	results, err := ph.wm.Scan(ph.iface)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return results, http.StatusOK, nil
+}
+
+func (ph *provisioningHandler) network(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"), "")
+		return
+	}
+	// Use the escaped path so that SSIDs containing '/' survive
+	ssid, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/networks/"))
+	if err != nil || len(ssid) == 0 {
+		writeJSONError(w, http.StatusBadRequest, errors.New("Invalid SSID"), "")
+		return
+	}
+	if !ph.wm.KnownSSIDs.Has(ssid) {
+		writeJSONError(w, http.StatusNotFound, errors.New("Unknown network"), "")
+		return
+	}
+	if err = ph.wm.RemoveNetwork(ssid); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err, "")
+		return
+	}
+	log.Infof("Provisioning: removed network '%v'", ssid)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ph *provisioningHandler) status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"), "")
+		return
+	}
+	writeJSON(w, http.StatusOK, ph.currentStatus())
+}
+
+func (ph *provisioningHandler) currentStatus() *ProvisioningStatus {
+	status := &ProvisioningStatus{
+		State:         ph.wm.State(ph.iface),
+		Hotspot:       ph.wm.IsHostapdRunning(),
+		WPASupplicant: ph.wm.IsWPASupplicantRunning(),
+		KnownSSIDs:    make([]string, 0),
+	}
+	if ssid, err := ph.wm.CurrentSSID(ph.iface); err == nil {
+		status.SSID = ssid
+	}
+	ph.mutex.Lock()
+	if ph.test != nil {
+		test := *ph.test
+		status.Test = &test
+	}
+	ph.mutex.Unlock()
+	for _, o := range ph.wm.KnownSSIDs.List() {
+		status.KnownSSIDs = append(status.KnownSSIDs, o.(string))
+	}
+	sort.Strings(status.KnownSSIDs)
+	return status
+}
+
+// connectFailureReason maps the errors of TestConnect to a short machine
+// readable reason
+func connectFailureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrNetworkNotFound):
+		return "not_found"
+	case errors.Is(err, ErrAuthFailed):
+		return "auth_failed"
+	case errors.Is(err, ErrAssocTimeout):
+		return "timeout"
+	case errors.Is(err, ErrNoDHCPLease):
+		return "no_dhcp_lease"
+	}
+	return ""
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Failed to write response: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, code int, err error, reason string) {
+	writeJSON(w, code, &provisioningError{Error: err.Error(), Reason: reason})
+}
@@ -0,0 +1,187 @@
+package wifimanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvisioningNetworks(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	executor.On("iw dev wlan0 scan", FakeResult{Stdout: string(iwScanTestData)})
+
+	server := httptest.NewServer(NewProvisioningHandler(wm, "wlan0"))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/networks")
+	require.Nil(err)
+	defer resp.Body.Close()
+	require.Equal(http.StatusOK, resp.StatusCode)
+
+	networks := make([]*ProvisioningNetwork, 0)
+	require.Nil(json.NewDecoder(resp.Body).Decode(&networks))
+	// The hidden network is left out and test is listed once
+	require.Equal(4, len(networks))
+	require.Equal(&ProvisioningNetwork{
+		SSID:      "test",
+		BSSID:     "00:11:22:33:44:55",
+		Frequency: 2412,
+		Signal:    -45,
+		Security:  []Security{SecurityWPA2},
+		Known:     true,
+	}, networks[0])
+	require.Equal("phonelab", networks[1].SSID)
+	require.Equal("café", networks[2].SSID)
+	require.False(networks[2].Known)
+
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/networks", nil)
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(err)
+	resp.Body.Close()
+	require.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestProvisioningAddNetwork(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+
+	server := httptest.NewServer(NewProvisioningHandler(wm, "wlan0"))
+	defer server.Close()
+
+	post := func(body string) (*http.Response, map[string]interface{}) {
+		resp, err := http.Post(server.URL+"/networks", "application/json", bytes.NewBufferString(body))
+		require.Nil(err)
+		defer resp.Body.Close()
+		ret := make(map[string]interface{})
+		require.Nil(json.NewDecoder(resp.Body).Decode(&ret))
+		return resp, ret
+	}
+
+	resp, _ := post(`{"ssid": ""}`)
+	require.Equal(http.StatusBadRequest, resp.StatusCode)
+	resp, _ = post(`not json`)
+	require.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	// A wrong password is reported and not saved
+	executor.OnStart("/sbin/wpa_supplicant", "wlan0: WPA: 4-Way Handshake failed - pre-shared key may be incorrect")
+	executor.On("/sbin/iwgetid -r wlan0", FakeResult{ExitCode: 255})
+	resp, body := post(`{"ssid": "office", "password": "wrongpassword"}`)
+	require.Equal(http.StatusUnprocessableEntity, resp.StatusCode)
+	require.Equal("auth_failed", body["reason"])
+	require.False(wm.KnownSSIDs.Has("office"))
+
+	executor.OnStart("/sbin/wpa_supplicant", "wlan0: CTRL-EVENT-CONNECTED - Connection to 00:11:22:33:44:55 completed [id=0 id_str=]")
+	executor.On("/sbin/iwgetid -r wlan0", FakeResult{Stdout: "office\n"})
+	resp, body = post(`{"ssid": "office", "password": "password123"}`)
+	require.Equal(http.StatusCreated, resp.StatusCode)
+	require.Equal("office", body["ssid"])
+	require.True(wm.KnownSSIDs.Has("office"))
+
+	data, err := ioutil.ReadFile(wm.WPAConfPath)
+	require.Nil(err)
+	require.Contains(string(data), `ssid="office"`)
+}
+
+func TestProvisioningRemoveNetwork(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	executor.On("/sbin/iwgetid -r wlan0", FakeResult{Stdout: "\n"})
+
+	server := httptest.NewServer(NewProvisioningHandler(wm, "wlan0"))
+	defer server.Close()
+
+	remove := func(path string) int {
+		req, _ := http.NewRequest(http.MethodDelete, server.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.Equal(http.StatusNotFound, remove("/networks/unknown"))
+	require.Equal(http.StatusNoContent, remove("/networks/test"))
+	require.False(wm.KnownSSIDs.Has("test"))
+	require.Equal(http.StatusNotFound, remove("/networks/test"))
+
+	resp, err := http.Get(server.URL + "/status")
+	require.Nil(err)
+	defer resp.Body.Close()
+	status := &ProvisioningStatus{}
+	require.Nil(json.NewDecoder(resp.Body).Decode(status))
+	require.Equal(&ProvisioningStatus{
+		State:      StateStopped,
+		KnownSSIDs: []string{"phonelab"},
+	}, status)
+}
+
+func TestProvisioningOverHotspot(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	executor.On("iw dev wlan0 scan", FakeResult{Stdout: string(iwScanTestData)})
+	executor.OnStart("/sbin/wpa_supplicant", "wlan0: CTRL-EVENT-CONNECTED - Connection to 00:11:22:33:44:55 completed [id=0 id_str=]")
+	executor.On("/sbin/iwgetid -r wlan0", FakeResult{Stdout: "office\n"})
+	wm.Hotspot.SSID = "setup"
+	require.Nil(wm.StartHotspot("wlan0"))
+
+	server := httptest.NewServer(NewProvisioningHandler(wm, "wlan0"))
+	defer server.Close()
+	getStatus := func() *ProvisioningStatus {
+		resp, err := http.Get(server.URL + "/status")
+		require.Nil(err)
+		defer resp.Body.Close()
+		status := &ProvisioningStatus{}
+		require.Nil(json.NewDecoder(resp.Body).Decode(status))
+		return status
+	}
+
+	// iface cannot scan in AP mode, only the scan cache can tell
+	resp, err := http.Get(server.URL + "/networks")
+	require.Nil(err)
+	resp.Body.Close()
+	require.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	require.NotContains(executor.Calls(), "iw dev wlan0 scan")
+
+	// The test runs once the response is out, and the hotspot comes back
+	resp, err = http.Post(server.URL+"/networks", "application/json", bytes.NewBufferString(`{"ssid": "office", "password": "password123"}`))
+	require.Nil(err)
+	resp.Body.Close()
+	require.Equal(http.StatusAccepted, resp.StatusCode)
+	require.Eventually(func() bool {
+		test := getStatus().Test
+		return test != nil && test.State == ProvisioningSaved
+	}, time.Second, time.Millisecond)
+	require.True(wm.KnownSSIDs.Has("office"))
+	require.Eventually(func() bool {
+		return len(executor.Processes("/usr/sbin/hostapd")) == 2 && wm.IsHostapdRunning()
+	}, time.Second, time.Millisecond)
+	require.Equal(RoleHotspot, wm.Interface("wlan0").Role)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sc := wm.StartScanCache(ctx, ScanCacheConfig{Ifaces: []string{"wlan1"}, TTL: time.Hour})
+	executor.On("iw dev wlan1 scan", FakeResult{Stdout: string(iwScanTestData)})
+	require.Nil(sc.Refresh())
+	resp, err = http.Get(server.URL + "/networks")
+	require.Nil(err)
+	defer resp.Body.Close()
+	require.Equal(http.StatusOK, resp.StatusCode)
+	networks := make([]*ProvisioningNetwork, 0)
+	require.Nil(json.NewDecoder(resp.Body).Decode(&networks))
+	require.Equal(4, len(networks))
+}
@@ -0,0 +1,80 @@
+package wifimanager
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// PSK derives the 256-bit WPA pre-shared key for a passphrase as described
+// in IEEE 802.11i: PBKDF2-HMAC-SHA1 with the SSID as salt and 4096 iterations.
+// The result is hex encoded, as wpa_supplicant expects it in psk=.
+func PSK(ssid, passphrase string) (string, error) {
+	if err := validateSSID(ssid); err != nil {
+		return "", err
+	}
+	if err := validatePassphrase(passphrase); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(pbkdf2SHA1([]byte(passphrase), []byte(ssid), 4096, 32)), nil
+}
+
+func validateSSID(ssid string) error {
+	if len(ssid) == 0 || len(ssid) > 32 {
+		return fmt.Errorf("SSID must be 1 to 32 bytes, got %d", len(ssid))
+	}
+	return nil
+}
+
+func validatePassphrase(passphrase string) error {
+	if len(passphrase) < 8 || len(passphrase) > 63 {
+		return fmt.Errorf("WPA passphrase must be 8 to 63 characters, got %d", len(passphrase))
+	}
+	for idx := 0; idx < len(passphrase); idx++ {
+		if passphrase[idx] < 32 || passphrase[idx] > 126 {
+			return fmt.Errorf("WPA passphrase must only contain printable ASCII characters")
+		}
+	}
+	return nil
+}
+
+// isRawPSK returns whether s is a 256-bit PSK in hex rather than a passphrase
+func isRawPSK(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// pbkdf2SHA1 implements PBKDF2 (RFC 2898) with HMAC-SHA1 as the PRF
+func pbkdf2SHA1(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	key := make([]byte, 0, numBlocks*hashLen)
+	counter := make([]byte, 4)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		binary.BigEndian.PutUint32(counter, uint32(block))
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(counter)
+		u = prf.Sum(u[:0])
+		t := make([]byte, hashLen)
+		copy(t, u)
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for idx := range t {
+				t[idx] ^= u[idx]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
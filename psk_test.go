@@ -0,0 +1,71 @@
+package wifimanager
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPSK(t *testing.T) {
+	require := require.New(t)
+
+	// The first two vectors are from IEEE 802.11i-2004, Annex H.4
+	vectors := []struct {
+		ssid       string
+		passphrase string
+		psk        string
+	}{
+		{"IEEE", "password", "f42c6fc52df0ebef9ebb4b90b38a5f902e83fe1b135a70e23aed762e9710a12e"},
+		{"ThisIsASSID", "ThisIsAPassword", "0dc0d6eb90555ed6419756b9a15ec3e3209b63df707dd508d14581f8982721af"},
+		{strings.Repeat("Z", 32), strings.Repeat("a", 63), "2d43d0dabfdd635377172efa1fc4b4b87dbfc4219193909ded9a7cfb89a3097b"},
+	}
+	for _, v := range vectors {
+		psk, err := PSK(v.ssid, v.passphrase)
+		require.Nil(err)
+		require.Equal(v.psk, psk)
+	}
+
+	for _, passphrase := range []string{"short", strings.Repeat("a", 64), "password\n123", "pässword123"} {
+		_, err := PSK("test", passphrase)
+		require.NotNil(err, passphrase)
+	}
+	_, err := PSK("", "password123")
+	require.NotNil(err)
+	_, err = PSK(strings.Repeat("a", 33), "password123")
+	require.NotNil(err)
+}
+
+func TestWPAPassphraseEncoding(t *testing.T) {
+	require := require.New(t)
+
+	// Quotes in the passphrase are fine, the SSID is hex encoded
+	block, err := WPAPassphrase(`say "hello"`, `pass"word"`)
+	require.Nil(err)
+	require.Contains(block, "ssid=736179202268656c6c6f22\n")
+	network := ParseWPANetwork(block)
+	require.NotNil(network)
+	require.Equal(`say "hello"`, network.SSID)
+	require.Equal(`pass"word"`, network.Password)
+	psk, err := PSK(`say "hello"`, `pass"word"`)
+	require.Nil(err)
+	require.Equal(psk, network.PSK)
+
+	block, err = WPAPassphrase("café", "")
+	require.Nil(err)
+	require.Contains(block, "ssid=636166c3a9\n")
+	require.Contains(block, "key_mgmt=NONE\n")
+	require.Equal("café", ParseWPANetwork(block).SSID)
+
+	raw := "1D2D5EB60AC569D0018F4572A324029EFAC83D4D4A605B6C7077FD1023715F37"
+	block, err = WPAPassphrase("test", raw)
+	require.Nil(err)
+	network = ParseWPANetwork(block)
+	require.Equal(strings.ToLower(raw), network.PSK)
+	require.Equal("", network.Password)
+
+	_, err = WPAPassphrase("test", "short")
+	require.NotNil(err)
+	_, err = WPAPassphrase("test", strings.Repeat("g", 64))
+	require.NotNil(err)
+}
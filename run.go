@@ -0,0 +1,275 @@
+package wifimanager
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// State is the mode Run has put the interface in
+type State string
+
+const (
+	StateScanning   State = "scanning"
+	StateConnecting State = "connecting"
+	StateConnected  State = "connected"
+	StateHotspot    State = "hotspot"
+	StateStopped    State = "stopped"
+)
+
+// StateChange describes a transition made by Run
+type StateChange struct {
+	From State
+	To   State
+	// SSID is the network we are connecting to, for StateConnecting, or
+	// connected to, for StateConnected
+	SSID string
+	// Err is the failure that caused the transition, if any
+	Err  error
+	Time time.Time
+}
+
+// RunConfig controls the behavior of Run. Zero values select the defaults.
+type RunConfig struct {
+	// MaxFailures is the number of failed scans or connection attempts in a
+	// row after which the hotspot is brought up. Default 3.
+	MaxFailures int
+	// RetryInterval is the pause between failed attempts. Default 5s.
+	RetryInterval time.Duration
+	// ConnectTimeout bounds how long a connection attempt may take. Default 15s.
+	ConnectTimeout time.Duration
+	// MonitorInterval is how often the link is checked while connected. Default 5s.
+	MonitorInterval time.Duration
+	// HotspotDuration is how long the hotspot stays up before it is torn
+	// down to scan for known networks again. Default 5m.
+	HotspotDuration time.Duration
+	// OnStateChange, if set, is called for every transition
+	OnStateChange func(change StateChange)
+}
+
+func (rc RunConfig) withDefaults() RunConfig {
+	if rc.MaxFailures <= 0 {
+		rc.MaxFailures = 3
+	}
+	if rc.RetryInterval <= 0 {
+		rc.RetryInterval = 5 * time.Second
+	}
+	if rc.ConnectTimeout <= 0 {
+		rc.ConnectTimeout = 15 * time.Second
+	}
+	if rc.MonitorInterval <= 0 {
+		rc.MonitorInterval = 5 * time.Second
+	}
+	if rc.HotspotDuration <= 0 {
+		rc.HotspotDuration = 5 * time.Minute
+	}
+	return rc
+}
+
+// stationDriver is what Run needs from WifiManager. Tests substitute a fake.
+type stationDriver interface {
+	BestNetwork(current string) (*Selection, error)
+	StartWPASupplicant(iface, confPath string) error
+	SelectSavedNetwork(iface, ssid string) error
+	StopWPASupplicant(iface string) error
+	RecordFailure(ssid string)
+	ClearFailures(ssid string)
+	CurrentSSID(iface string) (string, error)
+	StartHotspot(iface string) error
+	StopHotspot(iface string) error
+}
+
+// Run keeps iface connected to the known network SelectNetwork picks among
+// those in range, so that networks that failed recently are passed over. It
+// falls back to a hotspot for provisioning after conf.MaxFailures failed
+// attempts. While the hotspot is up it is periodically torn down to rescan. Run returns ctx.Err() once
+// ctx is cancelled, or ErrClosed once wm is closed, after stopping whatever
+// it started.
+func (wm *WifiManager) Run(ctx context.Context, iface string, conf RunConfig) error {
+	ctx, cancelClose := wm.withClose(ctx)
+	defer cancelClose()
+	r := &runner{
+		wm:     wm,
+		driver: wm,
+		iface:  iface,
+		conf:   conf.withDefaults(),
+		state:  StateStopped,
+	}
+	err := r.run(ctx)
+	if wm.isClosed() {
+		return ErrClosed
+	}
+	return err
+}
+
+// State returns the state of the Run loop on iface, or StateStopped if none
+// runs there
+func (wm *WifiManager) State(iface string) State {
+	return wm.Interface(iface).State
+}
+
+type runner struct {
+	wm       *WifiManager
+	driver   stationDriver
+	iface    string
+	conf     RunConfig
+	state    State
+	failures int
+	// target is the network selected by the last scan
+	target string
+}
+
+func (r *runner) transition(to State, ssid string, err error) {
+	change := StateChange{
+		From: r.state,
+		To:   to,
+		SSID: ssid,
+		Err:  err,
+		Time: time.Now(),
+	}
+	log.Infof("%v: %v -> %v (ssid=%v err=%v)", r.iface, change.From, change.To, ssid, err)
+	r.state = to
+	ic := r.wm.controller(r.iface)
+	ic.mutex.Lock()
+	ic.state = to
+	ic.mutex.Unlock()
+	if r.conf.OnStateChange != nil {
+		r.conf.OnStateChange(change)
+	}
+}
+
+// fail records a failed attempt and picks the next state
+func (r *runner) fail(err error) {
+	r.failures++
+	if r.failures >= r.conf.MaxFailures {
+		r.transition(StateHotspot, "", err)
+	} else {
+		r.transition(StateScanning, "", err)
+	}
+}
+
+func (r *runner) run(ctx context.Context) error {
+	events, cancel := r.wm.Subscribe()
+	defer cancel()
+
+	r.transition(StateScanning, "", nil)
+	for {
+		if ctx.Err() != nil {
+			break
+		}
+		switch r.state {
+		case StateScanning:
+			r.scan(ctx)
+		case StateConnecting:
+			r.connect(ctx)
+		case StateConnected:
+			r.monitor(ctx, events)
+		case StateHotspot:
+			r.hotspot(ctx)
+		}
+	}
+	r.transition(StateStopped, "", ctx.Err())
+	return ctx.Err()
+}
+
+func (r *runner) scan(ctx context.Context) {
+	if r.failures > 0 && !sleepContext(ctx, r.conf.RetryInterval) {
+		return
+	}
+	selection, err := r.driver.BestNetwork("")
+	if err != nil {
+		r.fail(err)
+		return
+	}
+	r.target = selection.Network.SSID
+	r.transition(StateConnecting, r.target, nil)
+}
+
+// connect starts wpa_supplicant on the WPA conf file and points it at the
+// selected network. Should the control socket be unavailable, whatever
+// known network wpa_supplicant joins is accepted.
+func (r *runner) connect(ctx context.Context) {
+	if err := r.driver.StartWPASupplicant(r.iface, r.wm.WPAConfPath); err != nil {
+		r.fail(err)
+		return
+	}
+	selected := false
+	deadline := time.Now().Add(r.conf.ConnectTimeout)
+	for time.Now().Before(deadline) {
+		if !selected {
+			if err := r.driver.SelectSavedNetwork(r.iface, r.target); err != nil {
+				log.Debugf("%v: failed to select '%v': %v", r.iface, r.target, err)
+			} else {
+				selected = true
+			}
+		}
+		ssid, err := r.driver.CurrentSSID(r.iface)
+		if err == nil && len(ssid) > 0 && (ssid == r.target || !selected) {
+			r.failures = 0
+			r.driver.ClearFailures(ssid)
+			r.transition(StateConnected, ssid, nil)
+			return
+		}
+		if !sleepContext(ctx, r.conf.ConnectTimeout/15) {
+			r.driver.StopWPASupplicant(r.iface)
+			return
+		}
+	}
+	r.driver.StopWPASupplicant(r.iface)
+	r.driver.RecordFailure(r.target)
+	r.fail(ErrAssocTimeout)
+}
+
+func (r *runner) monitor(ctx context.Context, events <-chan *Event) {
+	ticker := time.NewTicker(r.conf.MonitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			r.driver.StopWPASupplicant(r.iface)
+			return
+		case e := <-events:
+			if e.Iface != r.iface || e.Type != EventDisconnected {
+				continue
+			}
+		case <-ticker.C:
+		}
+		if ssid, err := r.driver.CurrentSSID(r.iface); err != nil || len(ssid) == 0 {
+			log.Warnf("%v: lost connection", r.iface)
+			r.driver.StopWPASupplicant(r.iface)
+			r.fail(ErrAssocTimeout)
+			return
+		}
+	}
+}
+
+func (r *runner) hotspot(ctx context.Context) {
+	if err := r.driver.StartHotspot(r.iface); err != nil {
+		log.Errorf("%v: failed to start hotspot: %v", r.iface, err)
+		r.failures = 0
+		r.transition(StateScanning, "", err)
+		return
+	}
+	sleepContext(ctx, r.conf.HotspotDuration)
+	if err := r.driver.StopHotspot(r.iface); err != nil {
+		log.Errorf("%v: failed to stop hotspot: %v", r.iface, err)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	r.failures = 0
+	r.transition(StateScanning, "", nil)
+}
+
+// sleepContext sleeps for d and reports whether ctx is still live
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
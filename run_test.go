@@ -0,0 +1,277 @@
+package wifimanager
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStation is a stationDriver whose radio state is scripted by the test.
+// The supplicant joins connectSSID unless another network was selected.
+type fakeStation struct {
+	scanResults    []string
+	scanErr        error
+	connectSSID    string
+	selected       string
+	selections     []string
+	failures       map[string]int
+	supplicant     bool
+	hotspot        bool
+	hotspotStarts  int
+	supplicantRuns int
+	sync.Mutex
+}
+
+func (fs *fakeStation) BestNetwork(current string) (*Selection, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	if fs.scanErr != nil {
+		return nil, fs.scanErr
+	}
+	candidates := make([]*Candidate, 0)
+	for _, ssid := range fs.scanResults {
+		candidates = append(candidates, &Candidate{
+			Network:  &WPANetwork{SSID: ssid},
+			Result:   &ScanResult{SSID: ssid, Signal: -50, Band: Band2GHz},
+			Failures: fs.failures[ssid],
+		})
+	}
+	return (&DefaultSelector{}).Select(candidates)
+}
+
+func (fs *fakeStation) SelectSavedNetwork(iface, ssid string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.selected = ssid
+	fs.selections = append(fs.selections, ssid)
+	return nil
+}
+
+func (fs *fakeStation) RecordFailure(ssid string) {
+	fs.Lock()
+	defer fs.Unlock()
+	if fs.failures == nil {
+		fs.failures = make(map[string]int)
+	}
+	fs.failures[ssid]++
+}
+
+func (fs *fakeStation) ClearFailures(ssid string) {
+	fs.Lock()
+	defer fs.Unlock()
+	delete(fs.failures, ssid)
+}
+
+func (fs *fakeStation) StartWPASupplicant(iface, confPath string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.supplicant = true
+	fs.selected = ""
+	fs.supplicantRuns++
+	return nil
+}
+
+func (fs *fakeStation) StopWPASupplicant(iface string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.supplicant = false
+	return nil
+}
+
+func (fs *fakeStation) CurrentSSID(iface string) (string, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	if !fs.supplicant || (len(fs.selected) > 0 && fs.selected != fs.connectSSID) {
+		return "", nil
+	}
+	return fs.connectSSID, nil
+}
+
+func (fs *fakeStation) StartHotspot(iface string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.hotspot = true
+	fs.hotspotStarts++
+	return nil
+}
+
+func (fs *fakeStation) StopHotspot(iface string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.hotspot = false
+	return nil
+}
+
+func (fs *fakeStation) set(fn func()) {
+	fs.Lock()
+	defer fs.Unlock()
+	fn()
+}
+
+// runFake starts the state machine on iface against driver with short
+// timeouts. It
+// returns the transitions, a function to stop it and the result of Run.
+func runFake(wm *WifiManager, iface string, driver stationDriver) (chan StateChange, context.CancelFunc, chan error) {
+	changes := make(chan StateChange, 100)
+	conf := RunConfig{
+		MaxFailures:     2,
+		RetryInterval:   time.Millisecond,
+		ConnectTimeout:  30 * time.Millisecond,
+		MonitorInterval: 5 * time.Millisecond,
+		HotspotDuration: 30 * time.Millisecond,
+		OnStateChange: func(change StateChange) {
+			changes <- change
+		},
+	}
+	r := &runner{
+		wm:     wm,
+		driver: driver,
+		iface:  iface,
+		conf:   conf.withDefaults(),
+		state:  StateStopped,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- r.run(ctx)
+	}()
+	return changes, cancel, done
+}
+
+func waitForState(require *require.Assertions, changes chan StateChange, state State) StateChange {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case change := <-changes:
+			if change.To == state {
+				return change
+			}
+		case <-timeout:
+			require.Fail(fmt.Sprintf("Timed out waiting for state %v", state))
+		}
+	}
+}
+
+func TestRunConnects(t *testing.T) {
+	require := require.New(t)
+
+	wm := &WifiManager{}
+	driver := &fakeStation{scanResults: []string{"home"}, connectSSID: "home"}
+	changes, cancel, done := runFake(wm, "wlan0", driver)
+
+	change := waitForState(require, changes, StateConnected)
+	require.Equal("home", change.SSID)
+	require.Equal(StateConnected, wm.State("wlan0"))
+
+	// Losing the link sends us back to scanning
+	driver.set(func() { driver.connectSSID = "" })
+	change = waitForState(require, changes, StateScanning)
+	require.Equal(StateConnected, change.From)
+	require.NotNil(change.Err)
+
+	cancel()
+	require.Equal(context.Canceled, <-done)
+	require.Equal(StateStopped, wm.State("wlan0"))
+	require.False(driver.supplicant)
+}
+
+func TestRunStatePerInterface(t *testing.T) {
+	require := require.New(t)
+
+	wm := &WifiManager{}
+	home := &fakeStation{scanResults: []string{"home"}, connectSSID: "home"}
+	nowhere := &fakeStation{}
+	changes0, cancel0, done0 := runFake(wm, "wlan0", home)
+	changes1, cancel1, done1 := runFake(wm, "wlan1", nowhere)
+
+	// Each loop keeps the state of its own interface, even while the
+	// other one keeps going between the hotspot and scanning
+	waitForState(require, changes0, StateConnected)
+	waitForState(require, changes1, StateHotspot)
+	waitForState(require, changes1, StateScanning)
+	require.Equal(StateConnected, wm.State("wlan0"))
+	require.Contains([]State{StateScanning, StateHotspot}, wm.State("wlan1"))
+	require.Equal(StateConnected, wm.Interface("wlan0").State)
+	require.Equal(StateStopped, wm.State("wlan2"))
+
+	cancel1()
+	require.Equal(context.Canceled, <-done1)
+	require.Equal(StateStopped, wm.State("wlan1"))
+	require.Equal(StateConnected, wm.State("wlan0"))
+	cancel0()
+	require.Equal(context.Canceled, <-done0)
+	require.Equal(StateStopped, wm.State("wlan0"))
+}
+
+func TestRunFallsBackToHotspot(t *testing.T) {
+	require := require.New(t)
+
+	wm := &WifiManager{}
+	driver := &fakeStation{}
+	changes, cancel, done := runFake(wm, "wlan0", driver)
+
+	change := waitForState(require, changes, StateHotspot)
+	require.Equal(ErrNetworkNotFound, change.Err)
+
+	// The hotspot is torn down periodically to rescan
+	change = waitForState(require, changes, StateScanning)
+	require.Equal(StateHotspot, change.From)
+
+	// Once the network shows up we join it
+	driver.set(func() {
+		driver.scanResults = []string{"home"}
+		driver.connectSSID = "home"
+	})
+	waitForState(require, changes, StateConnected)
+	require.False(driver.hotspot)
+	require.True(driver.hotspotStarts >= 1)
+
+	cancel()
+	require.Equal(context.Canceled, <-done)
+}
+
+func TestRunSelectsNetwork(t *testing.T) {
+	require := require.New(t)
+
+	wm := &WifiManager{}
+	// Both networks are known but only the second one lets us in
+	driver := &fakeStation{scanResults: []string{"home", "office"}, connectSSID: "office"}
+	changes, cancel, done := runFake(wm, "wlan0", driver)
+
+	change := waitForState(require, changes, StateConnecting)
+	require.Equal("home", change.SSID)
+	change = waitForState(require, changes, StateScanning)
+	require.Equal(ErrAssocTimeout, change.Err)
+
+	// The failure counts against home, so office is tried next
+	change = waitForState(require, changes, StateConnecting)
+	require.Equal("office", change.SSID)
+	change = waitForState(require, changes, StateConnected)
+	require.Equal("office", change.SSID)
+	cancel()
+	require.Equal(context.Canceled, <-done)
+	require.Equal([]string{"home", "office"}, driver.selections)
+	require.Equal(map[string]int{"home": 1}, driver.failures)
+}
+
+func TestRunConnectTimeout(t *testing.T) {
+	require := require.New(t)
+
+	wm := &WifiManager{}
+	// The network is visible but we never manage to associate
+	driver := &fakeStation{scanResults: []string{"home"}}
+	changes, cancel, done := runFake(wm, "wlan0", driver)
+
+	change := waitForState(require, changes, StateHotspot)
+	require.Equal(ErrAssocTimeout, change.Err)
+	require.Equal(2, driver.supplicantRuns)
+	require.False(driver.supplicant)
+
+	cancel()
+	require.Equal(context.Canceled, <-done)
+	require.False(driver.hotspot)
+}
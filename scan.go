@@ -0,0 +1,331 @@
+package wifimanager
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Security is a kind of protection advertised by an access point
+type Security string
+
+const (
+	SecurityOpen Security = "open"
+	SecurityWEP  Security = "WEP"
+	SecurityWPA  Security = "WPA"
+	SecurityWPA2 Security = "WPA2"
+	SecurityWPA3 Security = "WPA3"
+	SecurityEAP  Security = "EAP"
+)
+
+// Band is a Wi-Fi frequency band
+type Band string
+
+const (
+	Band2GHz Band = "2.4GHz"
+	Band5GHz Band = "5GHz"
+	Band6GHz Band = "6GHz"
+)
+
+// ScanResult is an access point found by Scan
+type ScanResult struct {
+	BSSID string
+	// SSID is empty for access points that hide their SSID
+	SSID string
+	// Hidden is set for access points that do not broadcast their SSID
+	Hidden bool
+	// Frequency in MHz
+	Frequency int
+	Channel   int
+	Band      Band
+	// Signal is the RSSI in dBm
+	Signal int
+	// Quality is the signal strength as a percentage, 0 at -100dBm or
+	// less and 100 at -50dBm or more
+	Quality int
+	// Security lists every protection the access point offers, e.g. WPA2
+	// and WPA3 for a transition mode network
+	Security []Security
+	LastSeen time.Time
+	// Iface is the interface that received the access point best
+	Iface string
+	// Ifaces lists every interface that saw the access point
+	Ifaces []string
+}
+
+// Scan triggers a scan on iface and returns the access points found,
+// strongest first
+func (wm *WifiManager) Scan(iface string) ([]*ScanResult, error) {
+	return wm.ScanContext(context.Background(), iface)
+}
+
+// ScanContext is Scan, aborting the scan and returning ctx.Err() once ctx is
+// done
+func (wm *WifiManager) ScanContext(ctx context.Context, iface string) ([]*ScanResult, error) {
+	stdout, err := runContext(ctx, wm.executor(), fmt.Sprintf("iw dev %v scan", iface))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("Failed to scan on '%v': %v", iface, err)
+	}
+	results := parseIWScan(iface, stdout, time.Now())
+	sortScanResults(results)
+	return results, nil
+}
+
+// wifiInterfaces lists the interfaces ScanAll scans on
+var wifiInterfaces = func(wm *WifiManager) ([]string, error) {
+	return wm.GetWifiInterfaces()
+}
+
+// ScanAll scans on every wifi interface and returns the access points found,
+// strongest first. An access point seen on several interfaces is reported
+// once, with the interface that received it best. Results are returned as
+// long as one interface could scan.
+func (wm *WifiManager) ScanAll() ([]*ScanResult, error) {
+	ifaces, err := wifiInterfaces(wm)
+	if err != nil {
+		return nil, err
+	}
+	if len(ifaces) == 0 {
+		return nil, fmt.Errorf("No wifi interface found")
+	}
+
+	scans := make([][]*ScanResult, 0, len(ifaces))
+	errs := make([]string, 0)
+	for _, iface := range ifaces {
+		results, err := wm.Scan(iface)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		scans = append(scans, results)
+	}
+	if len(scans) == 0 {
+		return nil, fmt.Errorf("%v", strings.Join(errs, "\n"))
+	}
+	return mergeScanResults(scans...), nil
+}
+
+// mergeScanResults combines the results of several interfaces into one entry
+// per BSSID and sorts them by signal
+func mergeScanResults(scans ...[]*ScanResult) []*ScanResult {
+	byBSSID := make(map[string]*ScanResult)
+	merged := make([]*ScanResult, 0)
+	for _, results := range scans {
+		for _, result := range results {
+			existing, ok := byBSSID[result.BSSID]
+			if !ok {
+				copied := *result
+				copied.Ifaces = append([]string{}, result.Ifaces...)
+				byBSSID[result.BSSID] = &copied
+				merged = append(merged, &copied)
+				continue
+			}
+			ifaces := append(existing.Ifaces, result.Ifaces...)
+			lastSeen := existing.LastSeen
+			if result.LastSeen.After(lastSeen) {
+				lastSeen = result.LastSeen
+			}
+			if result.Signal > existing.Signal {
+				*existing = *result
+			}
+			existing.Ifaces = ifaces
+			existing.LastSeen = lastSeen
+		}
+	}
+	sortScanResults(merged)
+	return merged
+}
+
+func sortScanResults(results []*ScanResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Signal != results[j].Signal {
+			return results[i].Signal > results[j].Signal
+		}
+		return results[i].BSSID < results[j].BSSID
+	})
+}
+
+// frequencyChannel returns the channel and band of a frequency in MHz
+func frequencyChannel(freq int) (int, Band) {
+	switch {
+	case freq == 2484:
+		return 14, Band2GHz
+	case freq >= 2412 && freq <= 2472:
+		return (freq - 2407) / 5, Band2GHz
+	case freq >= 5955 && freq <= 7115:
+		return (freq - 5950) / 5, Band6GHz
+	case freq >= 5160 && freq <= 5885:
+		return (freq - 5000) / 5, Band5GHz
+	}
+	return 0, ""
+}
+
+// signalQuality maps an RSSI in dBm onto 0-100%
+func signalQuality(dbm int) int {
+	switch {
+	case dbm <= -100:
+		return 0
+	case dbm >= -50:
+		return 100
+	}
+	return 2 * (dbm + 100)
+}
+
+// parseIWScan parses the output of 'iw dev <iface> scan' run at now
+func parseIWScan(iface, output string, now time.Time) []*ScanResult {
+	results := make([]*ScanResult, 0)
+	var current *ScanResult
+	var privacy bool
+	// section is the RSN or WPA element whose details are being read
+	section := ""
+
+	finish := func() {
+		if current == nil {
+			return
+		}
+		current.Channel, current.Band = frequencyChannel(current.Frequency)
+		current.Quality = signalQuality(current.Signal)
+		// Hidden networks have an empty SSID or one made of NUL bytes
+		if len(strings.Trim(current.SSID, "\x00")) == 0 {
+			current.SSID = ""
+			current.Hidden = true
+		}
+		if current.LastSeen.IsZero() {
+			current.LastSeen = now
+		}
+		if len(current.Security) == 0 {
+			if privacy {
+				current.Security = []Security{SecurityWEP}
+			} else {
+				current.Security = []Security{SecurityOpen}
+			}
+		}
+		results = append(results, current)
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "BSS ") {
+			finish()
+			bssid := strings.TrimPrefix(line, "BSS ")
+			if idx := strings.IndexAny(bssid, "( "); idx >= 0 {
+				bssid = bssid[:idx]
+			}
+			current = &ScanResult{BSSID: bssid, Iface: iface, Ifaces: []string{iface}}
+			privacy = false
+			section = ""
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		// Top-level attributes are indented by exactly one tab
+		if strings.HasPrefix(line, "\t") && !strings.HasPrefix(line, "\t\t") {
+			section = ""
+		}
+		key, value := trimmed, ""
+		if idx := strings.Index(trimmed, ":"); idx >= 0 {
+			key, value = trimmed[:idx], strings.TrimSpace(trimmed[idx+1:])
+		}
+
+		switch key {
+		case "freq":
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				current.Frequency = int(f)
+			}
+		case "signal":
+			if s, err := strconv.ParseFloat(strings.TrimSuffix(value, " dBm"), 64); err == nil {
+				current.Signal = int(s)
+			}
+		case "SSID":
+			current.SSID = unescapeIW(value)
+		case "last seen":
+			// Older versions of iw print the age, newer ones the boottime
+			if strings.HasSuffix(value, " ms ago") {
+				if ms, err := strconv.Atoi(strings.TrimSuffix(value, " ms ago")); err == nil {
+					current.LastSeen = now.Add(-time.Duration(ms) * time.Millisecond)
+				}
+			}
+		case "capability":
+			privacy = strings.Contains(value, "Privacy")
+		case "RSN", "WPA":
+			section = key
+			if key == "WPA" {
+				current.addSecurity(SecurityWPA)
+			}
+			// iw prints the first detail on the same line as the element
+			if strings.HasPrefix(value, "* ") {
+				current.handleSuiteLine(section, strings.TrimPrefix(value, "* "))
+			}
+		case "* Authentication suites":
+			current.handleSuiteLine(section, trimmed[2:])
+		}
+	}
+	finish()
+	return results
+}
+
+// handleSuiteLine interprets an "Authentication suites: ..." detail of the
+// RSN or WPA element
+func (sr *ScanResult) handleSuiteLine(section, line string) {
+	if !strings.HasPrefix(line, "Authentication suites:") || len(section) == 0 {
+		return
+	}
+	suites := strings.TrimPrefix(line, "Authentication suites:")
+	if strings.Contains(suites, "PSK") && section == "RSN" {
+		sr.addSecurity(SecurityWPA2)
+	}
+	if strings.Contains(suites, "SAE") {
+		sr.addSecurity(SecurityWPA3)
+	}
+	if strings.Contains(suites, "802.1X") {
+		sr.addSecurity(SecurityEAP)
+	}
+}
+
+func (sr *ScanResult) addSecurity(s Security) {
+	for _, existing := range sr.Security {
+		if existing == s {
+			return
+		}
+	}
+	sr.Security = append(sr.Security, s)
+}
+
+// HasSecurity returns whether the access point offers s
+func (sr *ScanResult) HasSecurity(s Security) bool {
+	for _, existing := range sr.Security {
+		if existing == s {
+			return true
+		}
+	}
+	return false
+}
+
+// unescapeIW undoes the \xNN escaping iw applies to non-printable SSID bytes
+func unescapeIW(s string) string {
+	if !strings.Contains(s, `\x`) {
+		return s
+	}
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if b, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				buf = append(buf, byte(b))
+				i += 3
+				continue
+			}
+		}
+		buf = append(buf, s[i])
+	}
+	return string(buf)
+}
@@ -0,0 +1,239 @@
+package wifimanager
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ScanCacheConfig controls the background scans of a ScanCache. Zero values
+// select the defaults.
+type ScanCacheConfig struct {
+	// Ifaces are the interfaces to scan on. Default all wifi interfaces.
+	Ifaces []string
+	// ConnectedInterval is the time between scans while any of Ifaces is
+	// connected, kept long because scanning disrupts the connection.
+	// Default 2m.
+	ConnectedInterval time.Duration
+	// DisconnectedInterval is the time between scans otherwise. Default 15s.
+	DisconnectedInterval time.Duration
+	// TTL is how long an access point stays in the cache after it was last
+	// seen. Default 5m.
+	TTL time.Duration
+}
+
+func (sc ScanCacheConfig) withDefaults() ScanCacheConfig {
+	if sc.ConnectedInterval == 0 {
+		sc.ConnectedInterval = 2 * time.Minute
+	}
+	if sc.DisconnectedInterval == 0 {
+		sc.DisconnectedInterval = 15 * time.Second
+	}
+	if sc.TTL == 0 {
+		sc.TTL = 5 * time.Minute
+	}
+	return sc
+}
+
+// ScanCache keeps the results of periodic background scans so that queries
+// are answered without waiting for a scan. When a known network that was
+// not in the cache shows up, an EventKnownNetworkAppeared event is
+// published to the subscribers of the WifiManager.
+type ScanCache struct {
+	wm       *WifiManager
+	conf     ScanCacheConfig
+	entries  map[string]*ScanResult
+	lastScan time.Time
+	lastErr  error
+	refresh  chan chan error
+	cancel   context.CancelFunc
+	done     chan struct{}
+	mutex    sync.Mutex
+}
+
+// StartScanCache starts scanning in the background until ctx is done or
+// Stop is called. While it runs, ScanForKnownSSID answers from the cache.
+func (wm *WifiManager) StartScanCache(ctx context.Context, conf ScanCacheConfig) *ScanCache {
+	ctx, cancel := context.WithCancel(ctx)
+	sc := &ScanCache{
+		wm:      wm,
+		conf:    conf.withDefaults(),
+		entries: make(map[string]*ScanResult),
+		refresh: make(chan chan error),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	wm.cacheMutex.Lock()
+	wm.scanCache = sc
+	wm.cacheMutex.Unlock()
+	go sc.run(ctx)
+	return sc
+}
+
+func (wm *WifiManager) runningScanCache() *ScanCache {
+	wm.cacheMutex.Lock()
+	defer wm.cacheMutex.Unlock()
+	return wm.scanCache
+}
+
+func (sc *ScanCache) run(ctx context.Context) {
+	defer func() {
+		sc.wm.cacheMutex.Lock()
+		if sc.wm.scanCache == sc {
+			sc.wm.scanCache = nil
+		}
+		sc.wm.cacheMutex.Unlock()
+		close(sc.done)
+	}()
+
+	sc.scan()
+	for {
+		interval := sc.conf.DisconnectedInterval
+		if sc.connected() {
+			interval = sc.conf.ConnectedInterval
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case reply := <-sc.refresh:
+			timer.Stop()
+			reply <- sc.scan()
+		case <-timer.C:
+			sc.scan()
+		}
+	}
+}
+
+// Done is closed once the background scans have stopped
+func (sc *ScanCache) Done() <-chan struct{} {
+	return sc.done
+}
+
+// Stop stops the background scans and returns once they have finished
+func (sc *ScanCache) Stop() {
+	sc.cancel()
+	<-sc.done
+}
+
+// Refresh scans right away and returns once the cache is updated
+func (sc *ScanCache) Refresh() error {
+	reply := make(chan error, 1)
+	select {
+	case sc.refresh <- reply:
+		return <-reply
+	case <-sc.done:
+		return fmt.Errorf("Scan cache is stopped")
+	}
+}
+
+// Results returns the access points seen within the TTL, strongest first
+func (sc *ScanCache) Results() []*ScanResult {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	sc.expire(time.Now())
+	results := make([]*ScanResult, 0, len(sc.entries))
+	for _, result := range sc.entries {
+		copied := *result
+		results = append(results, &copied)
+	}
+	sortScanResults(results)
+	return results
+}
+
+// LastScan returns when the last background scan finished and its error
+func (sc *ScanCache) LastScan() (time.Time, error) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return sc.lastScan, sc.lastErr
+}
+
+func (sc *ScanCache) ifaces() ([]string, error) {
+	if len(sc.conf.Ifaces) > 0 {
+		return sc.conf.Ifaces, nil
+	}
+	ifaces, err := wifiInterfaces(sc.wm)
+	if err == nil && len(ifaces) == 0 {
+		err = fmt.Errorf("No wifi interface found")
+	}
+	return ifaces, err
+}
+
+func (sc *ScanCache) connected() bool {
+	ifaces, err := sc.ifaces()
+	if err != nil {
+		return false
+	}
+	for _, iface := range ifaces {
+		if ssid, err := sc.wm.CurrentSSID(iface); err == nil && len(ssid) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// scan scans on every interface and merges the results into the cache
+func (sc *ScanCache) scan() error {
+	ifaces, err := sc.ifaces()
+	scans := make([][]*ScanResult, 0)
+	if err == nil {
+		for _, iface := range ifaces {
+			results, scanErr := sc.wm.Scan(iface)
+			if scanErr != nil {
+				log.Warnf("Background scan failed: %v", scanErr)
+				err = scanErr
+				continue
+			}
+			scans = append(scans, results)
+		}
+		// Some results are good enough
+		if len(scans) > 0 {
+			err = nil
+		}
+	}
+
+	sc.mutex.Lock()
+	now := time.Now()
+	sc.lastScan = now
+	sc.lastErr = err
+	sc.expire(now)
+	present := make(map[string]bool)
+	for _, result := range sc.entries {
+		present[result.SSID] = true
+	}
+	appeared := make([]*ScanResult, 0)
+	for _, result := range mergeScanResults(scans...) {
+		sc.entries[result.BSSID] = result
+		if !result.Hidden && !present[result.SSID] && sc.wm.KnownSSIDs.Has(result.SSID) {
+			present[result.SSID] = true
+			appeared = append(appeared, result)
+		}
+	}
+	sc.mutex.Unlock()
+
+	for _, result := range appeared {
+		log.Infof("Known network '%v' appeared (%v, %ddBm)", result.SSID, result.BSSID, result.Signal)
+		sc.wm.publish(&Event{
+			Type:  EventKnownNetworkAppeared,
+			Iface: result.Iface,
+			Level: -1,
+			BSSID: result.BSSID,
+			SSID:  result.SSID,
+			Time:  now,
+		})
+	}
+	return err
+}
+
+// expire drops access points that have not been seen within the TTL
+func (sc *ScanCache) expire(now time.Time) {
+	for bssid, result := range sc.entries {
+		if now.Sub(result.LastSeen) > sc.conf.TTL {
+			delete(sc.entries, bssid)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package wifimanager
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func countCalls(executor *FakeExecutor, prefix string) int {
+	count := 0
+	for _, call := range executor.Calls() {
+		if strings.HasPrefix(call, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+func waitForAppeared(require *require.Assertions, events <-chan *Event) *Event {
+	for {
+		select {
+		case e := <-events:
+			if e.Type == EventKnownNetworkAppeared {
+				return e
+			}
+		case <-time.After(2 * time.Second):
+			require.Fail("No known network appeared")
+			return nil
+		}
+	}
+}
+
+func TestScanCache(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	executor.On("iw dev wlan0 scan", FakeResult{Stdout: string(iwScanTestData)})
+	executor.On("/sbin/iwgetid -r wlan0", FakeResult{ExitCode: 255})
+
+	events, unsubscribe := wm.Subscribe()
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sc := wm.StartScanCache(ctx, ScanCacheConfig{
+		Ifaces:               []string{"wlan0"},
+		DisconnectedInterval: time.Hour,
+		TTL:                  time.Hour,
+	})
+
+	appeared := []string{waitForAppeared(require, events).SSID, waitForAppeared(require, events).SSID}
+	require.ElementsMatch([]string{"test", "phonelab"}, appeared)
+	require.Equal(6, len(sc.Results()))
+	lastScan, err := sc.LastScan()
+	require.Nil(err)
+	require.False(lastScan.IsZero())
+
+	// Queries are answered from the cache
+	ssids, err := wm.ScanForKnownSSID()
+	require.Nil(err)
+	require.Equal([]string{"test", "phonelab"}, ssids)
+	require.Equal(1, countCalls(executor, "iw dev"))
+
+	// Networks that are still around do not appear again
+	require.Nil(sc.Refresh())
+	require.Equal(2, countCalls(executor, "iw dev"))
+	select {
+	case e := <-events:
+		require.Fail("Unexpected event", "%v", e)
+	default:
+	}
+
+	executor.On("iw dev wlan0 scan", FakeResult{ExitCode: 240, Stderr: "Device or resource busy"})
+	require.NotNil(sc.Refresh())
+	// The cached results outlive a failed scan
+	require.Equal(6, len(sc.Results()))
+
+	cancel()
+	<-sc.Done()
+	require.NotNil(sc.Refresh())
+	require.Nil(wm.runningScanCache())
+}
+
+func TestScanCacheExpiry(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	executor.On("iw dev wlan0 scan", FakeResult{Stdout: string(iwScanTestData)})
+	// Connected, so the background scans are slow
+	executor.On("/sbin/iwgetid -r wlan0", FakeResult{Stdout: "test\n"})
+
+	events, unsubscribe := wm.Subscribe()
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sc := wm.StartScanCache(ctx, ScanCacheConfig{
+		Ifaces:               []string{"wlan0"},
+		ConnectedInterval:    time.Hour,
+		DisconnectedInterval: time.Millisecond,
+		TTL:                  200 * time.Millisecond,
+	})
+	waitForAppeared(require, events)
+	waitForAppeared(require, events)
+
+	executor.On("iw dev wlan0 scan", FakeResult{})
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(1, countCalls(executor, "iw dev"))
+	require.Equal(0, len(sc.Results()))
+	ssids, err := wm.ScanForKnownSSID()
+	require.Nil(err)
+	require.Nil(ssids)
+
+	// Once expired, networks appear again
+	executor.On("iw dev wlan0 scan", FakeResult{Stdout: string(iwScanTestData)})
+	require.Nil(sc.Refresh())
+	waitForAppeared(require, events)
+	waitForAppeared(require, events)
+}
@@ -0,0 +1,109 @@
+package wifimanager
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var iwScanTestData, _ = ioutil.ReadFile("test/iw-scan.txt")
+
+func TestParseIWScan(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Now()
+	results := parseIWScan("wlan0", string(iwScanTestData), now)
+	require.Equal(6, len(results))
+
+	require.Equal(&ScanResult{
+		BSSID:     "00:11:22:33:44:55",
+		SSID:      "test",
+		Frequency: 2412,
+		Channel:   1,
+		Band:      Band2GHz,
+		Signal:    -45,
+		Quality:   100,
+		Security:  []Security{SecurityWPA2},
+		LastSeen:  now.Add(-20 * time.Millisecond),
+		Iface:     "wlan0",
+		Ifaces:    []string{"wlan0"},
+	}, results[0])
+	require.Equal([]Security{SecurityWPA2, SecurityWPA3}, results[1].Security)
+	require.Equal(5180, results[1].Frequency)
+	require.Equal(36, results[1].Channel)
+	require.Equal(Band5GHz, results[1].Band)
+	require.Equal(60, results[1].Quality)
+	require.Equal([]Security{SecurityOpen}, results[2].Security)
+	require.Equal(6, results[2].Channel)
+	require.Equal("café", results[3].SSID)
+	require.True(results[3].HasSecurity(SecurityEAP))
+	require.True(results[3].HasSecurity(SecurityWPA))
+	require.False(results[3].HasSecurity(SecurityWPA2))
+	require.Equal("", results[4].SSID)
+	require.True(results[4].Hidden)
+	require.Equal(now.Add(-100*time.Millisecond), results[4].LastSeen)
+	require.Equal([]Security{SecurityWEP}, results[5].Security)
+
+	results = parseIWScan("wlan0", "BSS 00:00:00:00:00:01(on wlan0)\n\tfreq: 5975\n\tSSID: \\x00\\x00\\x00\n", now)
+	require.Equal(1, len(results))
+	require.True(results[0].Hidden)
+	require.Equal("", results[0].SSID)
+	require.Equal(5, results[0].Channel)
+	require.Equal(Band6GHz, results[0].Band)
+	require.Equal(now, results[0].LastSeen)
+}
+
+func TestScan(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+
+	executor.On("iw dev wlan0 scan", FakeResult{Stdout: string(iwScanTestData)})
+	results, err := wm.Scan("wlan0")
+	require.Nil(err)
+	require.Equal(6, len(results))
+	// Sorted by signal rather than the order iw printed them in
+	for _, bssid := range []string{"00:11:22:33:44:55", "aa:bb:cc:dd:ee:ff", "00:11:22:33:44:66"} {
+		require.Equal(bssid, results[0].BSSID)
+		results = results[1:]
+	}
+
+	executor.On("iw dev wlan0 scan", FakeResult{ExitCode: 240, Stderr: "Device or resource busy"})
+	_, err = wm.Scan("wlan0")
+	require.NotNil(err)
+	require.Contains(err.Error(), "busy")
+
+	executor.On("iw dev wlan0 scan", FakeResult{Stdout: string(iwScanTestData), Delay: time.Hour})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = wm.ScanContext(ctx, "wlan0")
+	require.True(errors.Is(err, context.DeadlineExceeded), "%v", err)
+}
+
+func TestMergeScanResults(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Now()
+	wlan0 := parseIWScan("wlan0", string(iwScanTestData), now)
+	wlan1 := parseIWScan("wlan1", string(iwScanTestData), now.Add(time.Second))
+	// wlan1 receives the 5GHz access point better
+	wlan1[1].Signal = -40
+
+	merged := mergeScanResults(wlan0, wlan1)
+	require.Equal(6, len(merged))
+	require.Equal("00:11:22:33:44:66", merged[0].BSSID)
+	require.Equal("wlan1", merged[0].Iface)
+	require.Equal([]string{"wlan0", "wlan1"}, merged[0].Ifaces)
+	require.Equal("00:11:22:33:44:55", merged[1].BSSID)
+	require.Equal("wlan0", merged[1].Iface)
+	require.Equal([]string{"wlan0", "wlan1"}, merged[1].Ifaces)
+	require.Equal(now.Add(time.Second-20*time.Millisecond), merged[1].LastSeen)
+
+	// The inputs are left untouched
+	require.Equal([]string{"wlan0"}, wlan0[0].Ifaces)
+}
@@ -0,0 +1,223 @@
+package wifimanager
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Candidate is a known network that is in range
+type Candidate struct {
+	Network *WPANetwork
+	// Result is the strongest access point seen for the network
+	Result *ScanResult
+	// Current is set for the network we are connected to
+	Current bool
+	// Failures is the number of failed connection attempts within
+	// FailureWindow
+	Failures    int
+	LastFailure time.Time
+}
+
+// Selection is the network a Selector chose and why
+type Selection struct {
+	*Candidate
+	Reason string
+	// Ranked holds every candidate, best first
+	Ranked []*Candidate
+}
+
+// Selector picks the network to join among the known networks in range
+type Selector interface {
+	Select(candidates []*Candidate) (*Selection, error)
+}
+
+// SelectorFunc lets an ordinary function act as a Selector
+type SelectorFunc func(candidates []*Candidate) (*Selection, error)
+
+func (f SelectorFunc) Select(candidates []*Candidate) (*Selection, error) {
+	return f(candidates)
+}
+
+// FailureWindow is how long a failed connection attempt counts against a
+// network
+const FailureWindow = 10 * time.Minute
+
+// DefaultSelector ranks candidates by, in order:
+//   - fewer recent connection failures
+//   - higher priority in the WPA conf file
+//   - stronger signal, where 5GHz and 6GHz networks get BandBonus if they
+//     are at least MinHighBandSignal, and the current network gets
+//     Hysteresis so that we do not flap between similar networks
+type DefaultSelector struct {
+	// Hysteresis in dB. Default 8.
+	Hysteresis int
+	// BandBonus in dB. Default 10.
+	BandBonus int
+	// MinHighBandSignal in dBm. Default -70.
+	MinHighBandSignal int
+}
+
+func (ds *DefaultSelector) withDefaults() DefaultSelector {
+	ret := *ds
+	if ret.Hysteresis == 0 {
+		ret.Hysteresis = 8
+	}
+	if ret.BandBonus == 0 {
+		ret.BandBonus = 10
+	}
+	if ret.MinHighBandSignal == 0 {
+		ret.MinHighBandSignal = -70
+	}
+	return ret
+}
+
+// effectiveSignal is the signal of c with the band and hysteresis bonuses
+func (ds *DefaultSelector) effectiveSignal(c *Candidate) int {
+	signal := c.Result.Signal
+	if c.Result.Band != Band2GHz && c.Result.Signal >= ds.MinHighBandSignal {
+		signal += ds.BandBonus
+	}
+	if c.Current {
+		signal += ds.Hysteresis
+	}
+	return signal
+}
+
+func (ds *DefaultSelector) Select(candidates []*Candidate) (*Selection, error) {
+	if len(candidates) == 0 {
+		return nil, ErrNetworkNotFound
+	}
+	conf := ds.withDefaults()
+	ranked := append([]*Candidate{}, candidates...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return conf.compare(ranked[i], ranked[j]) < 0
+	})
+
+	selection := &Selection{Candidate: ranked[0], Ranked: ranked}
+	if len(ranked) == 1 {
+		selection.Reason = "only known network in range"
+	} else {
+		selection.Reason = conf.reason(ranked[0], ranked[1])
+	}
+	return selection, nil
+}
+
+// compare returns a negative number if a should be preferred over b
+func (ds *DefaultSelector) compare(a, b *Candidate) int {
+	if a.Failures != b.Failures {
+		return a.Failures - b.Failures
+	}
+	if a.Network.Priority != b.Network.Priority {
+		return b.Network.Priority - a.Network.Priority
+	}
+	return ds.effectiveSignal(b) - ds.effectiveSignal(a)
+}
+
+// reason explains why best was ranked above the runner up
+func (ds *DefaultSelector) reason(best, next *Candidate) string {
+	switch {
+	case best.Failures != next.Failures:
+		return fmt.Sprintf("fewer recent failures than '%v' (%d < %d)", next.Network.SSID, best.Failures, next.Failures)
+	case best.Network.Priority != next.Network.Priority:
+		return fmt.Sprintf("higher priority than '%v' (%d > %d)", next.Network.SSID, best.Network.Priority, next.Network.Priority)
+	case best.Current && best.Result.Signal < next.Result.Signal:
+		return fmt.Sprintf("staying connected, '%v' is not enough stronger (%ddBm vs %ddBm)", next.Network.SSID, next.Result.Signal, best.Result.Signal)
+	case best.Result.Band != next.Result.Band && best.Result.Signal < next.Result.Signal:
+		return fmt.Sprintf("prefer %v over '%v' on %v (%ddBm vs %ddBm)", best.Result.Band, next.Network.SSID, next.Result.Band, best.Result.Signal, next.Result.Signal)
+	}
+	return fmt.Sprintf("stronger signal than '%v' (%ddBm vs %ddBm)", next.Network.SSID, best.Result.Signal, next.Result.Signal)
+}
+
+// SelectNetwork chooses among the known networks in results using
+// wm.Selector, or DefaultSelector if it is nil. current is the SSID we are
+// connected to, if any.
+func (wm *WifiManager) SelectNetwork(results []*ScanResult, current string) (*Selection, error) {
+	conf, err := ReadWPAConf(wm.WPAConfPath)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]*Candidate, 0)
+	bySSID := make(map[string]*Candidate)
+	for _, result := range results {
+		if result.Hidden {
+			continue
+		}
+		if c, ok := bySSID[result.SSID]; ok {
+			if result.Signal > c.Result.Signal {
+				c.Result = result
+			}
+			continue
+		}
+		network := conf.Network(result.SSID)
+		if network == nil || network.Disabled {
+			continue
+		}
+		c := &Candidate{Network: network, Result: result, Current: result.SSID == current}
+		c.Failures, c.LastFailure = wm.recentFailures(result.SSID)
+		bySSID[result.SSID] = c
+		candidates = append(candidates, c)
+	}
+
+	selector := wm.Selector
+	if selector == nil {
+		selector = &DefaultSelector{}
+	}
+	selection, err := selector.Select(candidates)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Selected network '%v' (%v, %ddBm): %v", selection.Network.SSID, selection.Result.BSSID, selection.Result.Signal, selection.Reason)
+	return selection, nil
+}
+
+// BestNetwork selects the network to join from the results of the running
+// ScanCache, or of a scan on every wifi interface if there is none
+func (wm *WifiManager) BestNetwork(current string) (*Selection, error) {
+	results, err := wm.latestScanResults()
+	if err != nil {
+		return nil, err
+	}
+	return wm.SelectNetwork(results, current)
+}
+
+// RecordFailure counts a failed connection attempt against ssid. TestConnect
+// records its failures itself.
+func (wm *WifiManager) RecordFailure(ssid string) {
+	wm.failureMutex.Lock()
+	defer wm.failureMutex.Unlock()
+	if wm.failures == nil {
+		wm.failures = make(map[string][]time.Time)
+	}
+	wm.failures[ssid] = append(wm.failures[ssid], time.Now())
+}
+
+// ClearFailures forgets the failed connection attempts of ssid
+func (wm *WifiManager) ClearFailures(ssid string) {
+	wm.failureMutex.Lock()
+	defer wm.failureMutex.Unlock()
+	delete(wm.failures, ssid)
+}
+
+// recentFailures returns the number of failures of ssid within
+// FailureWindow and when the last one happened
+func (wm *WifiManager) recentFailures(ssid string) (int, time.Time) {
+	wm.failureMutex.Lock()
+	defer wm.failureMutex.Unlock()
+	cutoff := time.Now().Add(-FailureWindow)
+	recent := make([]time.Time, 0)
+	for _, t := range wm.failures[ssid] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(wm.failures, ssid)
+		return 0, time.Time{}
+	}
+	wm.failures[ssid] = recent
+	return len(recent), recent[len(recent)-1]
+}
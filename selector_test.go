@@ -0,0 +1,123 @@
+package wifimanager
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newSelectorTestCandidate(ssid string, priority, signal, freq int) *Candidate {
+	channel, band := frequencyChannel(freq)
+	return &Candidate{
+		Network: &WPANetwork{SSID: ssid, Priority: priority},
+		Result:  &ScanResult{SSID: ssid, Signal: signal, Frequency: freq, Channel: channel, Band: band},
+	}
+}
+
+func TestDefaultSelector(t *testing.T) {
+	require := require.New(t)
+
+	selector := &DefaultSelector{}
+	_, err := selector.Select(nil)
+	require.Equal(ErrNetworkNotFound, err)
+
+	a := newSelectorTestCandidate("a", 0, -60, 2412)
+	b := newSelectorTestCandidate("b", 0, -50, 2437)
+	selection, err := selector.Select([]*Candidate{a, b})
+	require.Nil(err)
+	require.Equal("b", selection.Network.SSID)
+	require.Contains(selection.Reason, "stronger signal")
+	require.Equal([]*Candidate{b, a}, selection.Ranked)
+
+	// Hysteresis keeps us on the current network
+	a.Current = true
+	a.Result.Signal = -56
+	selection, err = selector.Select([]*Candidate{a, b})
+	require.Nil(err)
+	require.Equal("a", selection.Network.SSID)
+	require.Contains(selection.Reason, "staying connected")
+	a.Current = false
+	a.Result.Signal = -60
+
+	// 5GHz wins if it is strong enough
+	c := newSelectorTestCandidate("c", 0, -58, 5180)
+	selection, err = selector.Select([]*Candidate{a, b, c})
+	require.Nil(err)
+	require.Equal("c", selection.Network.SSID)
+	require.Contains(selection.Reason, "prefer 5GHz")
+	c.Result.Signal = -75
+	selection, err = selector.Select([]*Candidate{a, b, c})
+	require.Nil(err)
+	require.Equal("b", selection.Network.SSID)
+
+	// Priority beats signal
+	a.Network.Priority = 5
+	selection, err = selector.Select([]*Candidate{a, b, c})
+	require.Nil(err)
+	require.Equal("a", selection.Network.SSID)
+	require.Contains(selection.Reason, "higher priority")
+
+	// Recent failures beat priority
+	a.Failures = 2
+	selection, err = selector.Select([]*Candidate{a, b})
+	require.Nil(err)
+	require.Equal("b", selection.Network.SSID)
+	require.Contains(selection.Reason, "fewer recent failures")
+
+	selection, err = selector.Select([]*Candidate{a})
+	require.Nil(err)
+	require.Equal("only known network in range", selection.Reason)
+}
+
+func TestSelectNetwork(t *testing.T) {
+	require := require.New(t)
+
+	wm, _, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+
+	data := []byte(`network={
+	ssid="test"
+	psk="password123"
+	priority=1
+}
+network={
+	ssid="phonelab"
+	key_mgmt=NONE
+}
+network={
+	ssid="café"
+	key_mgmt=NONE
+	disabled=1
+}
+`)
+	require.Nil(ioutil.WriteFile(wm.WPAConfPath, data, 0600))
+
+	results := parseIWScan("wlan0", string(iwScanTestData), time.Now())
+	selection, err := wm.SelectNetwork(results, "")
+	require.Nil(err)
+	require.Equal("test", selection.Network.SSID)
+	require.Equal("00:11:22:33:44:55", selection.Result.BSSID)
+	// Disabled and unknown networks are not candidates
+	require.Equal(2, len(selection.Ranked))
+
+	wm.RecordFailure("test")
+	selection, err = wm.SelectNetwork(results, "")
+	require.Nil(err)
+	require.Equal("phonelab", selection.Network.SSID)
+	require.Equal(1, selection.Ranked[1].Failures)
+
+	wm.ClearFailures("test")
+	wm.Selector = SelectorFunc(func(candidates []*Candidate) (*Selection, error) {
+		return &Selection{Candidate: candidates[len(candidates)-1], Reason: "last", Ranked: candidates}, nil
+	})
+	selection, err = wm.SelectNetwork(results, "")
+	require.Nil(err)
+	require.Equal("phonelab", selection.Network.SSID)
+	require.Equal("last", selection.Reason)
+
+	wm.Selector = nil
+	_, err = wm.SelectNetwork(results[4:], "")
+	require.Equal(ErrNetworkNotFound, err)
+}
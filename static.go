@@ -0,0 +1,346 @@
+package wifimanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StaticConfig is the address configuration applied to an interface instead
+// of running DHCP when it associates with a saved network
+type StaticConfig struct {
+	// Addresses are IPv4 or IPv6 addresses with their prefix length, e.g.
+	// "192.168.1.10/24" or "2001:db8::10/64"
+	Addresses []string `json:"addresses"`
+	Gateway   string   `json:"gateway,omitempty"`
+	Gateway6  string   `json:"gateway6,omitempty"`
+	DNS       []string `json:"dns,omitempty"`
+	Search    []string `json:"search,omitempty"`
+}
+
+// Validate checks the configuration without touching any interface
+func (sc *StaticConfig) Validate() error {
+	if len(sc.Addresses) == 0 {
+		return fmt.Errorf("Static configuration needs at least one address")
+	}
+	for _, addr := range sc.Addresses {
+		if _, _, err := net.ParseCIDR(addr); err != nil {
+			return fmt.Errorf("Invalid static address '%v': %v", addr, err)
+		}
+	}
+	if len(sc.Gateway) > 0 {
+		if ip := net.ParseIP(sc.Gateway); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("Invalid IPv4 gateway '%v'", sc.Gateway)
+		}
+	}
+	if len(sc.Gateway6) > 0 {
+		if ip := net.ParseIP(sc.Gateway6); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("Invalid IPv6 gateway '%v'", sc.Gateway6)
+		}
+	}
+	for _, dns := range sc.DNS {
+		if net.ParseIP(dns) == nil {
+			return fmt.Errorf("Invalid DNS server '%v'", dns)
+		}
+	}
+	for _, domain := range sc.Search {
+		if len(domain) == 0 || strings.ContainsAny(domain, " \t\n#;") {
+			return fmt.Errorf("Invalid search domain '%v'", domain)
+		}
+	}
+	return nil
+}
+
+// staticConfPath is the sidecar of the WPA conf file that holds the static
+// configurations, keyed by the id_str of their networks
+func (wm *WifiManager) staticConfPath() string {
+	if len(wm.StaticConfPath) == 0 {
+		return wm.WPAConfPath + ".static"
+	}
+	return wm.StaticConfPath
+}
+
+func (wm *WifiManager) readStaticConfs() (map[string]*StaticConfig, error) {
+	confs := make(map[string]*StaticConfig)
+	data, err := ioutil.ReadFile(wm.staticConfPath())
+	if os.IsNotExist(err) {
+		return confs, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read static configurations: %v", err)
+	}
+	if err = json.Unmarshal(data, &confs); err != nil {
+		return nil, fmt.Errorf("Failed to parse static configurations: %v", err)
+	}
+	return confs, nil
+}
+
+// StaticConfig returns the static configuration of the saved network with
+// the given SSID, or nil if it uses DHCP
+func (wm *WifiManager) StaticConfig(ssid string) (*StaticConfig, error) {
+	networks, err := ParseWPASupplicantConf(wm.WPAConfPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, network := range networks {
+		if network.SSID != ssid {
+			continue
+		}
+		if len(network.IDStr) == 0 {
+			return nil, nil
+		}
+		confs, err := wm.readStaticConfs()
+		if err != nil {
+			return nil, err
+		}
+		return confs[network.IDStr], nil
+	}
+	return nil, fmt.Errorf("No network with SSID '%v' in %v", ssid, wm.WPAConfPath)
+}
+
+// SetStaticConfig makes the saved network with the given SSID use conf
+// instead of DHCP, or DHCP again if conf is nil. The network is given an
+// id_str to refer to it by if it has none.
+func (wm *WifiManager) SetStaticConfig(ssid string, conf *StaticConfig) error {
+	if conf != nil {
+		if err := conf.Validate(); err != nil {
+			return err
+		}
+	}
+	return wm.updateConf(func(wpaConf *WPAConf) error {
+		network := wpaConf.Network(ssid)
+		if network == nil {
+			return fmt.Errorf("No network with SSID '%v' in %v", ssid, wm.WPAConfPath)
+		}
+		if len(network.IDStr) == 0 {
+			if conf == nil {
+				return nil
+			}
+			network.IDStr = "static-" + hex.EncodeToString([]byte(ssid))
+		}
+
+		confs, err := wm.readStaticConfs()
+		if err != nil {
+			return err
+		}
+		if conf == nil {
+			delete(confs, network.IDStr)
+		} else {
+			confs[network.IDStr] = conf
+		}
+		return wm.writeStaticConfs(confs)
+	})
+}
+
+func (wm *WifiManager) writeStaticConfs(confs map[string]*StaticConfig) error {
+	data, err := json.MarshalIndent(confs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(wm.staticConfPath(), append(data, '\n')); err != nil {
+		return fmt.Errorf("Failed to update static configurations: %v", err)
+	}
+	return nil
+}
+
+// removeStaticConfs drops the static configurations of removed networks
+// that no remaining network refers to. It is called from updateConf.
+func (wm *WifiManager) removeStaticConfs(removed, remaining []*WPANetwork) error {
+	confs, err := wm.readStaticConfs()
+	if err != nil {
+		return err
+	}
+	inUse := make(map[string]bool)
+	for _, network := range remaining {
+		inUse[network.IDStr] = true
+	}
+	changed := false
+	for _, network := range removed {
+		if _, ok := confs[network.IDStr]; ok && !inUse[network.IDStr] {
+			delete(confs, network.IDStr)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return wm.writeStaticConfs(confs)
+}
+
+// appliedStatic is a static configuration applied to an interface, with the
+// resolv.conf it replaced so that it can be put back
+type appliedStatic struct {
+	conf *StaticConfig
+	// resolvConf is nil if the resolv.conf was left alone, and empty if
+	// there was none
+	resolvConf []byte
+}
+
+// configureAddress gives iface its address after it associated with the
+// network with the given id_str: the static configuration of the network
+// if it has one, and otherwise a lease from the DHCP client. Both the
+// supplicant output and the connection tests call it, so the address lock of
+// the interface is held from the check of what is applied until it is
+// recorded.
+func (wm *WifiManager) configureAddress(iface, idStr string) error {
+	var conf *StaticConfig
+	if len(idStr) > 0 {
+		confs, err := wm.readStaticConfs()
+		if err != nil {
+			return err
+		}
+		conf = confs[idStr]
+	}
+
+	ic := wm.controller(iface)
+	ic.addressMutex.Lock()
+	defer ic.addressMutex.Unlock()
+	if conf == nil {
+		if err := wm.clearStaticLocked(context.Background(), iface); err != nil {
+			return err
+		}
+		return wm.startDHCP(iface)
+	}
+
+	wm.dhcpMutex.Lock()
+	applied := wm.static[iface]
+	dc := wm.dhcp[iface]
+	running := dc != nil && dc.cmd != nil
+	wm.dhcpMutex.Unlock()
+	if applied != nil && reflect.DeepEqual(applied.conf, conf) {
+		return nil
+	}
+	if running {
+		// Stop the client but keep the interface marked for DHCP in case
+		// it moves on to a network without a static configuration
+		if err := wm.StopDHCP(iface); err != nil {
+			log.Warnf("Failed to stop DHCP client on %v: %v", iface, err)
+		}
+		wm.enableDHCP(iface)
+	}
+	return wm.applyStatic(iface, conf, applied)
+}
+
+// applyStatic applies conf to iface in place of applied, which may be nil
+func (wm *WifiManager) applyStatic(iface string, conf *StaticConfig, applied *appliedStatic) error {
+	links := wm.links()
+	steps := []func() error{func() error { return links.FlushAddresses(iface) }}
+	for _, addr := range conf.Addresses {
+		ip, ipnet, _ := net.ParseCIDR(addr)
+		ipnet.IP = ip
+		steps = append(steps, func() error { return links.AddAddress(iface, ipnet) })
+	}
+	for _, gateway := range []string{conf.Gateway, conf.Gateway6} {
+		if len(gateway) > 0 {
+			route := Route{Gateway: net.ParseIP(gateway)}
+			steps = append(steps, func() error { return links.ReplaceRoute(iface, route) })
+		}
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return fmt.Errorf("Failed to apply static configuration to %v: %w", iface, err)
+		}
+	}
+
+	next := &appliedStatic{conf: conf}
+	if applied != nil {
+		next.resolvConf = applied.resolvConf
+	}
+	if len(conf.DNS) > 0 || len(conf.Search) > 0 {
+		if next.resolvConf == nil {
+			data, err := ioutil.ReadFile(resolvConfPath)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("Failed to read %v: %v", resolvConfPath, err)
+			}
+			next.resolvConf = append([]byte{}, data...)
+		}
+		buf := bytes.NewBuffer(nil)
+		buf.WriteString(resolvConfHeader(iface))
+		if len(conf.Search) > 0 {
+			fmt.Fprintf(buf, "search %v\n", strings.Join(conf.Search, " "))
+		}
+		for _, dns := range conf.DNS {
+			fmt.Fprintf(buf, "nameserver %v\n", dns)
+		}
+		if err := writeFileAtomic(resolvConfPath, buf.Bytes()); err != nil {
+			return fmt.Errorf("Failed to write %v: %v", resolvConfPath, err)
+		}
+	} else if next.resolvConf != nil {
+		if err := restoreResolvConf(iface, next.resolvConf); err != nil {
+			return err
+		}
+		next.resolvConf = nil
+	}
+
+	wm.dhcpMutex.Lock()
+	if wm.static == nil {
+		wm.static = make(map[string]*appliedStatic)
+	}
+	wm.static[iface] = next
+	wm.dhcpMutex.Unlock()
+	log.Infof("Applied static configuration %v to %v", conf.Addresses, iface)
+	return nil
+}
+
+func resolvConfHeader(iface string) string {
+	return fmt.Sprintf("# Generated by wifimanager for %v\n", iface)
+}
+
+// restoreResolvConf puts back the resolv.conf replaced by the static
+// configuration of iface, unless something else rewrote it since
+func restoreResolvConf(iface string, data []byte) error {
+	current, err := ioutil.ReadFile(resolvConfPath)
+	if err != nil || !bytes.HasPrefix(current, []byte(resolvConfHeader(iface))) {
+		return nil
+	}
+	if len(data) == 0 {
+		err = os.Remove(resolvConfPath)
+	} else {
+		err = writeFileAtomic(resolvConfPath, data)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to restore %v: %v", resolvConfPath, err)
+	}
+	return nil
+}
+
+// clearStatic removes the static configuration applied to iface, if any
+func (wm *WifiManager) clearStatic(ctx context.Context, iface string) error {
+	ic := wm.controller(iface)
+	ic.addressMutex.Lock()
+	defer ic.addressMutex.Unlock()
+	return wm.clearStaticLocked(ctx, iface)
+}
+
+func (wm *WifiManager) clearStaticLocked(ctx context.Context, iface string) error {
+	wm.dhcpMutex.Lock()
+	applied := wm.static[iface]
+	delete(wm.static, iface)
+	wm.dhcpMutex.Unlock()
+	if applied == nil {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if applied.resolvConf != nil {
+		if err := restoreResolvConf(iface, applied.resolvConf); err != nil {
+			log.Warnf("%v", err)
+		}
+	}
+	return wm.links().FlushAddresses(iface)
+}
+
+func (wm *WifiManager) hasStatic(iface string) bool {
+	wm.dhcpMutex.Lock()
+	defer wm.dhcpMutex.Unlock()
+	return wm.static[iface] != nil
+}
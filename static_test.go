@@ -0,0 +1,231 @@
+package wifimanager
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticConfigValidate(t *testing.T) {
+	require := require.New(t)
+
+	valid := StaticConfig{
+		Addresses: []string{"192.168.1.10/24", "2001:db8::10/64"},
+		Gateway:   "192.168.1.1",
+		Gateway6:  "fe80::1",
+		DNS:       []string{"192.168.1.1", "2001:4860:4860::8888"},
+		Search:    []string{"lan", "example.com"},
+	}
+	require.Nil(valid.Validate())
+
+	for _, modify := range []func(sc *StaticConfig){
+		func(sc *StaticConfig) { sc.Addresses = nil },
+		func(sc *StaticConfig) { sc.Addresses = []string{"192.168.1.10"} },
+		func(sc *StaticConfig) { sc.Gateway = "fe80::1" },
+		func(sc *StaticConfig) { sc.Gateway = "gateway" },
+		func(sc *StaticConfig) { sc.Gateway6 = "192.168.1.1" },
+		func(sc *StaticConfig) { sc.DNS = []string{"8.8.8"} },
+		func(sc *StaticConfig) { sc.Search = []string{"lan\nnameserver 1.2.3.4"} },
+	} {
+		sc := valid
+		modify(&sc)
+		require.NotNil(sc.Validate(), "%+v", sc)
+	}
+}
+
+func TestSetStaticConfig(t *testing.T) {
+	require := require.New(t)
+
+	wm, _, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+
+	conf, err := wm.StaticConfig("test")
+	require.Nil(err)
+	require.Nil(conf)
+	_, err = wm.StaticConfig("unknown")
+	require.NotNil(err)
+	require.NotNil(wm.SetStaticConfig("unknown", &StaticConfig{Addresses: []string{"192.168.1.10/24"}}))
+	require.NotNil(wm.SetStaticConfig("test", &StaticConfig{}))
+
+	static := &StaticConfig{Addresses: []string{"192.168.1.10/24"}, Gateway: "192.168.1.1"}
+	require.Nil(wm.SetStaticConfig("test", static))
+	conf, err = wm.StaticConfig("test")
+	require.Nil(err)
+	require.Equal(static, conf)
+
+	// The network is tied to its configuration by id_str
+	networks, err := ParseWPASupplicantConf(wm.WPAConfPath)
+	require.Nil(err)
+	require.Equal("", networks[0].IDStr)
+	require.Equal("static-74657374", networks[1].IDStr)
+	data, err := ioutil.ReadFile(wm.WPAConfPath + ".static")
+	require.Nil(err)
+	require.Contains(string(data), `"static-74657374"`)
+
+	// An existing id_str is kept
+	require.Nil(wm.UpdateNetwork("phonelab", func(network *WPANetwork) error {
+		network.IDStr = "office"
+		return nil
+	}))
+	require.Nil(wm.SetStaticConfig("phonelab", static))
+	networks, err = ParseWPASupplicantConf(wm.WPAConfPath)
+	require.Nil(err)
+	require.Equal("office", networks[0].IDStr)
+
+	require.Nil(wm.SetStaticConfig("test", nil))
+	conf, err = wm.StaticConfig("test")
+	require.Nil(err)
+	require.Nil(conf)
+	conf, err = wm.StaticConfig("phonelab")
+	require.Nil(err)
+	require.Equal(static, conf)
+}
+
+func TestRemoveNetworkStaticConfig(t *testing.T) {
+	require := require.New(t)
+
+	wm, _, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	static := &StaticConfig{Addresses: []string{"192.168.1.10/24"}}
+	require.Nil(wm.SetStaticConfig("test", static))
+	require.Nil(wm.SetStaticConfig("phonelab", static))
+
+	// Forgetting a network forgets its configuration
+	require.Nil(wm.RemoveNetwork("test"))
+	data, err := ioutil.ReadFile(wm.WPAConfPath + ".static")
+	require.Nil(err)
+	require.NotContains(string(data), `"static-74657374"`)
+	conf, err := wm.StaticConfig("phonelab")
+	require.Nil(err)
+	require.Equal(static, conf)
+
+	// so a network saved again under the same SSID uses DHCP
+	require.Nil(wm.AddNetworkConf("test", "password"))
+	conf, err = wm.StaticConfig("test")
+	require.Nil(err)
+	require.Nil(conf)
+
+	// A configuration another network still refers to is kept
+	require.Nil(wm.UpdateNetwork("test", func(network *WPANetwork) error {
+		network.IDStr = "static-70686f6e656c6162"
+		return nil
+	}))
+	require.Nil(wm.RemoveNetwork("test"))
+	conf, err = wm.StaticConfig("phonelab")
+	require.Nil(err)
+	require.Equal(static, conf)
+}
+
+func TestApplyStaticConfig(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newDHCPWifiManager(require, DHCPClientUdhcpc)
+	defer cleanup()
+	executor.OnStart("/sbin/wpa_supplicant")
+	require.Nil(wm.SetStaticConfig("test", &StaticConfig{
+		Addresses: []string{"192.168.1.10/24", "2001:db8::10/64"},
+		Gateway:   "192.168.1.1",
+		Gateway6:  "fe80::1",
+		DNS:       []string{"192.168.1.1"},
+		Search:    []string{"lan"},
+	}))
+
+	require.Nil(wm.StartWPASupplicant("wlan0", wm.WPAConfPath))
+	links := wm.Links.(*FakeLinks)
+	ops := len(links.Ops())
+	handleLine := wm.supplicantLineHandler("wlan0")
+	handleLine("wlan0: CTRL-EVENT-CONNECTED - Connection to 00:11:22:33:44:55 completed [id=1 id_str=static-74657374]")
+	require.Equal([]string{
+		"addr flush dev wlan0",
+		"addr add 192.168.1.10/24 dev wlan0",
+		"addr add 2001:db8::10/64 dev wlan0",
+		"route replace default via 192.168.1.1 dev wlan0",
+		"route replace default via fe80::1 dev wlan0",
+	}, links.Ops()[ops:])
+	routes, err := links.Routes("wlan0")
+	require.Nil(err)
+	require.Equal(2, len(routes))
+	require.Empty(executor.Processes("/sbin/udhcpc"))
+	data, err := ioutil.ReadFile(resolvConfPath)
+	require.Nil(err)
+	require.Equal("# Generated by wifimanager for wlan0\nsearch lan\nnameserver 192.168.1.1\n", string(data))
+
+	// Reassociating with the same network changes nothing
+	ops = len(links.Ops())
+	handleLine("wlan0: CTRL-EVENT-CONNECTED - Connection to 00:11:22:33:44:55 completed [id=1 id_str=static-74657374]")
+	require.Equal(ops, len(links.Ops()))
+
+	// Moving on to a network without one switches to DHCP
+	handleLine("wlan0: CTRL-EVENT-CONNECTED - Connection to 00:11:22:33:44:66 completed [id=0 id_str=]")
+	require.Equal("addr flush dev wlan0", links.Ops()[ops])
+	require.Equal(1, len(executor.Processes("/sbin/udhcpc")))
+
+	// and back again
+	handleLine("wlan0: CTRL-EVENT-CONNECTED - Connection to 00:11:22:33:44:55 completed [id=1 id_str=static-74657374]")
+	require.False(executor.Processes("/sbin/udhcpc")[0].Running())
+	require.True(wm.hasStatic("wlan0"))
+
+	ops = len(links.Ops())
+	require.Nil(wm.StopWPASupplicant("wlan0"))
+	require.Equal("addr flush dev wlan0", links.Ops()[ops])
+	require.False(wm.hasStatic("wlan0"))
+
+	// The resolv.conf from before the static configuration is back
+	data, err = ioutil.ReadFile(resolvConfPath)
+	require.Nil(err)
+	require.Equal("# Generated\nnameserver 192.168.1.1\nnameserver 8.8.8.8\nsearch lan\n", string(data))
+}
+
+func TestApplyStaticConfigConcurrently(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newDHCPWifiManager(require, DHCPClientUdhcpc)
+	defer cleanup()
+	executor.OnStart("/sbin/wpa_supplicant")
+	require.Nil(wm.SetStaticConfig("test", &StaticConfig{Addresses: []string{"192.168.1.10/24"}}))
+	require.Nil(wm.StartWPASupplicant("wlan0", wm.WPAConfPath))
+	links := wm.Links.(*FakeLinks)
+	ops := len(links.Ops())
+
+	// The supplicant output and a connection test see the same association
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = wm.configureAddress("wlan0", "static-74657374")
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.Nil(err)
+	}
+	require.Equal([]string{
+		"addr flush dev wlan0",
+		"addr add 192.168.1.10/24 dev wlan0",
+	}, links.Ops()[ops:])
+}
+
+func TestConnectStatic(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newDHCPWifiManager(require, DHCPClientUdhcpc)
+	defer cleanup()
+	wm.RequireIPAddress = true
+	wm.ConnectTimeout = time.Second
+	require.Nil(wm.SetStaticConfig("test", &StaticConfig{Addresses: []string{"192.168.1.10/24"}}))
+	data, err := ioutil.ReadFile(wm.WPAConfPath)
+	require.Nil(err)
+	conf, err := ParseWPAConf(string(data))
+	require.Nil(err)
+
+	// No DHCP client runs, and none is needed
+	executor.OnStart("/sbin/wpa_supplicant", "wlan0: CTRL-EVENT-CONNECTED - Connection to 00:11:22:33:44:55 completed [id=0 id_str=static-74657374]")
+	require.Nil(wm.TestConnect("wlan0", conf.Network("test")))
+	require.Empty(executor.Processes("/sbin/udhcpc"))
+	require.Contains(wm.Links.(*FakeLinks).Ops(), "addr add 192.168.1.10/24 dev wlan0")
+}
@@ -0,0 +1,294 @@
+package wifimanager
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SupervisorConfig controls how daemons are restarted when they exit on
+// their own. Zero values select the defaults.
+type SupervisorConfig struct {
+	// MaxRestarts is the number of restarts in a row after which the daemon
+	// is given up on. Default 5. Negative disables restarting.
+	MaxRestarts int
+	// InitialBackoff is the delay before the first restart, doubled for
+	// every further restart. Default 1s.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between restarts. Default 30s.
+	MaxBackoff time.Duration
+	// StableAfter is how long the daemon must run before earlier restarts
+	// are forgotten. Default 1m.
+	StableAfter time.Duration
+}
+
+func (sc SupervisorConfig) withDefaults() SupervisorConfig {
+	if sc.MaxRestarts == 0 {
+		sc.MaxRestarts = 5
+	}
+	if sc.InitialBackoff == 0 {
+		sc.InitialBackoff = time.Second
+	}
+	if sc.MaxBackoff == 0 {
+		sc.MaxBackoff = 30 * time.Second
+	}
+	if sc.StableAfter == 0 {
+		sc.StableAfter = time.Minute
+	}
+	return sc
+}
+
+// Supervised is a daemon that is restarted whenever it exits without being
+// asked to. It implements Process for the daemon as a whole: Done is closed
+// and Wait returns once it has been stopped or given up on.
+type Supervised struct {
+	Name     string
+	executor Executor
+	cmdline  string
+	onLine   func(line string)
+	conf     SupervisorConfig
+	pidFile  *pidFile
+
+	proc     Process
+	restarts int
+	lastExit error
+	err      error
+	stopping bool
+	stop     chan struct{}
+	done     chan struct{}
+	mutex    sync.Mutex
+}
+
+// DaemonStatus describes a supervised daemon
+type DaemonStatus struct {
+	Name    string
+	Running bool
+	Pid     int
+	// Restarts is the number of restarts since the daemon last ran stably
+	Restarts int
+	// LastExit is the exit error of the last time the daemon exited
+	LastExit error
+	// Err is set once the daemon was given up on
+	Err error
+}
+
+// supervise starts cmdline with executor and keeps it running
+func supervise(executor Executor, name, cmdline string, onLine func(line string), conf SupervisorConfig) (*Supervised, error) {
+	proc, err := executor.Start(cmdline, name, onLine)
+	if err != nil {
+		return nil, err
+	}
+	return newSupervised(executor, name, cmdline, onLine, conf, proc, nil), nil
+}
+
+// newSupervised keeps proc, which is already running cmdline, running. If pf
+// is not nil it is kept up to date with the pid of the current instance and
+// removed once the daemon is stopped.
+func newSupervised(executor Executor, name, cmdline string, onLine func(line string), conf SupervisorConfig, proc Process, pf *pidFile) *Supervised {
+	s := &Supervised{
+		Name:     name,
+		executor: executor,
+		cmdline:  cmdline,
+		onLine:   onLine,
+		conf:     conf.withDefaults(),
+		proc:     proc,
+		pidFile:  pf,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if pf != nil {
+		pf.write(proc.Pid())
+	}
+	go s.watch(proc)
+	return s
+}
+
+func (s *Supervised) watch(proc Process) {
+	defer close(s.done)
+	if s.pidFile != nil {
+		defer s.pidFile.remove()
+	}
+	backoff := s.conf.InitialBackoff
+	for {
+		started := time.Now()
+		var exitErr error
+		if proc != nil {
+			exitErr = proc.Wait()
+		}
+
+		s.mutex.Lock()
+		s.lastExit = exitErr
+		if s.stopping {
+			s.mutex.Unlock()
+			return
+		}
+		if time.Since(started) >= s.conf.StableAfter {
+			s.restarts = 0
+			backoff = s.conf.InitialBackoff
+		}
+		if s.restarts >= s.conf.MaxRestarts {
+			s.err = fmt.Errorf("%v exited %d times in a row, giving up: %v", s.Name, s.restarts+1, exitErr)
+			log.Errorf("%v", s.err)
+			s.mutex.Unlock()
+			return
+		}
+		s.restarts++
+		s.mutex.Unlock()
+
+		log.Warnf("%v exited unexpectedly (%v), restarting in %v", s.Name, exitErr, backoff)
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > s.conf.MaxBackoff {
+			backoff = s.conf.MaxBackoff
+		}
+
+		s.mutex.Lock()
+		if s.stopping {
+			s.mutex.Unlock()
+			return
+		}
+		var err error
+		if proc, err = s.executor.Start(s.cmdline, s.Name, s.onLine); err != nil {
+			log.Errorf("Failed to restart %v: %v", s.Name, err)
+			proc = nil
+			s.lastExit = err
+		} else if s.pidFile != nil {
+			s.pidFile.write(proc.Pid())
+		}
+		s.proc = proc
+		s.mutex.Unlock()
+	}
+}
+
+// StopRestarting lets the daemon exit without being restarted, e.g. because
+// it was asked to terminate by other means than a signal
+func (s *Supervised) StopRestarting() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.stopping {
+		s.stopping = true
+		close(s.stop)
+	}
+}
+
+// Pid returns the pid of the current instance, or 0 if none is running
+func (s *Supervised) Pid() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.proc == nil || !isRunning(s.proc) {
+		return 0
+	}
+	return s.proc.Pid()
+}
+
+// Signal sends sig to the daemon. SIGINT, SIGTERM and SIGKILL also stop it
+// from being restarted.
+func (s *Supervised) Signal(sig os.Signal) error {
+	switch sig {
+	case os.Interrupt, syscall.SIGTERM, os.Kill:
+		s.StopRestarting()
+	}
+	s.mutex.Lock()
+	proc := s.proc
+	s.mutex.Unlock()
+	if proc == nil {
+		return os.ErrProcessDone
+	}
+	return proc.Signal(sig)
+}
+
+func (s *Supervised) Kill() error {
+	return s.Signal(os.Kill)
+}
+
+// Wait blocks until the daemon was stopped or given up on, and returns the
+// error that made it give up or else the last exit error
+func (s *Supervised) Wait() error {
+	<-s.done
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	return s.lastExit
+}
+
+func (s *Supervised) Done() <-chan struct{} {
+	return s.done
+}
+
+// Running reports whether an instance of the daemon is alive right now
+func (s *Supervised) Running() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.proc != nil && isRunning(s.proc)
+}
+
+// Err returns the error that made the supervisor give up, if any
+func (s *Supervised) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
+
+// Status returns the current state of the daemon
+func (s *Supervised) Status() DaemonStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status := DaemonStatus{
+		Name:     s.Name,
+		Restarts: s.restarts,
+		LastExit: s.lastExit,
+		Err:      s.err,
+	}
+	if s.proc != nil && isRunning(s.proc) {
+		status.Running = true
+		status.Pid = s.proc.Pid()
+	}
+	return status
+}
+
+func isRunning(p Process) bool {
+	select {
+	case <-p.Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// Daemons returns the status of the daemons this manager has started
+func (wm *WifiManager) Daemons() []DaemonStatus {
+	ret := make([]DaemonStatus, 0)
+	for _, ic := range wm.controllers() {
+		for _, s := range ic.daemons() {
+			ret = append(ret, s.Status())
+		}
+	}
+	wm.dhcpMutex.Lock()
+	defer wm.dhcpMutex.Unlock()
+	for _, dc := range wm.dhcp {
+		if dc.cmd != nil {
+			ret = append(ret, dc.cmd.Status())
+		}
+	}
+	return ret
+}
+
+// supervise starts a daemon for iface through the manager's executor and
+// records it in a PID file in RunDir
+func (wm *WifiManager) supervise(name, iface, cmdline string, onLine func(line string)) (*Supervised, error) {
+	proc, err := wm.executor().Start(cmdline, name, onLine)
+	if err != nil {
+		return nil, err
+	}
+	return newSupervised(wm.executor(), name, cmdline, onLine, wm.Supervisor, proc, wm.newPidFile(name, iface, cmdline)), nil
+}
@@ -0,0 +1,116 @@
+package wifimanager
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func waitForProcesses(require *require.Assertions, executor *FakeExecutor, prefix string, n int) []*FakeProcess {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if processes := executor.Processes(prefix); len(processes) >= n {
+			return processes
+		}
+		time.Sleep(time.Millisecond)
+	}
+	require.Fail("Process was not restarted")
+	return nil
+}
+
+func TestSupervisedRestart(t *testing.T) {
+	require := require.New(t)
+
+	executor := NewFakeExecutor()
+	conf := SupervisorConfig{MaxRestarts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond}
+	s, err := supervise(executor, "hostapd", "hostapd /tmp/hostapd.conf", nil, conf)
+	require.Nil(err)
+	require.True(s.Running())
+	require.Equal(executor.Processes("hostapd")[0].Pid(), s.Pid())
+
+	// A crash is followed by a restart
+	executor.Processes("hostapd")[0].Exit(1)
+	processes := waitForProcesses(require, executor, "hostapd", 2)
+	require.True(processes[1].Running())
+	require.Eventually(s.Running, time.Second, time.Millisecond)
+	status := s.Status()
+	require.Equal(1, status.Restarts)
+	require.Equal("exit status 1", status.LastExit.Error())
+	require.Nil(status.Err)
+	require.Equal(processes[1].Pid(), status.Pid)
+
+	// Until it has crashed too often
+	for n := 2; n <= 4; n++ {
+		processes[n-1].Exit(1)
+		if n <= 3 {
+			processes = waitForProcesses(require, executor, "hostapd", n+1)
+		}
+	}
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		require.Fail("Supervisor did not give up")
+	}
+	require.Equal(4, len(executor.Processes("hostapd")))
+	require.False(s.Running())
+	require.Equal(0, s.Pid())
+	require.NotNil(s.Err())
+	require.Contains(s.Err().Error(), "giving up")
+	require.Equal(s.Err(), s.Wait())
+}
+
+func TestSupervisedStop(t *testing.T) {
+	require := require.New(t)
+
+	executor := NewFakeExecutor()
+	s, err := supervise(executor, "dnsmasq", "dnsmasq -d", nil, SupervisorConfig{InitialBackoff: time.Hour})
+	require.Nil(err)
+
+	// Signals that do not stop the daemon are passed through
+	require.Nil(s.Signal(syscall.SIGHUP))
+	require.True(s.Running())
+
+	require.Nil(s.Signal(os.Interrupt))
+	require.NotNil(s.Wait())
+	require.Nil(s.Err())
+	require.Equal(1, len(executor.Processes("dnsmasq")))
+
+	// Stopping during the backoff does not wait for it
+	s, err = supervise(executor, "dnsmasq", "dnsmasq -d", nil, SupervisorConfig{InitialBackoff: time.Hour})
+	require.Nil(err)
+	executor.Processes("dnsmasq")[1].Exit(1)
+	require.Eventually(func() bool { return s.Status().Restarts == 1 }, time.Second, time.Millisecond)
+	require.Equal(os.ErrProcessDone, s.Kill())
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		require.Fail("Supervisor did not stop")
+	}
+	require.Equal(2, len(executor.Processes("dnsmasq")))
+}
+
+func TestHotspotCrash(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	wm.Supervisor = SupervisorConfig{MaxRestarts: -1}
+
+	require.Nil(wm.StartHotspot("wlan0"))
+	require.True(wm.IsHostapdRunning())
+
+	executor.Processes("/usr/sbin/hostapd")[0].Exit(1)
+	require.Eventually(func() bool { return !wm.IsHostapdRunning() }, time.Second, time.Millisecond)
+	daemons := wm.Daemons()
+	require.Equal(2, len(daemons))
+	require.Equal("hostapd", daemons[0].Name)
+	require.False(daemons[0].Running)
+	require.NotNil(daemons[0].Err)
+	require.True(daemons[1].Running)
+
+	require.Nil(wm.StopHotspot("wlan0"))
+	require.Equal(0, len(wm.Daemons()))
+}
@@ -1,7 +1,7 @@
 package wifimanager
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -11,20 +11,77 @@ import (
 
 	"github.com/fatih/set"
 	"github.com/gurupras/go-easyfiles"
-	simpleexec "github.com/gurupras/go-simpleexec"
 	"github.com/homesound/go-networkmanager"
 	log "github.com/sirupsen/logrus"
 )
 
+// WifiManager runs wpa_supplicant or a hotspot on each of the wifi
+// interfaces. It is safe for concurrent use: the methods that start or stop
+// daemons run one at a time on each interface, and the getters do not wait
+// for them.
 type WifiManager struct {
 	WPAConfPath string
+	// CtrlDir is the ctrl_interface directory of the wpa_supplicant
+	// instances this manager talks to
+	CtrlDir string
+	// RequireIPAddress makes TestConnect wait for the interface to get an
+	// IPv4 address after associating. With DHCPClient set, that means
+	// waiting for the DHCP client to obtain a lease.
+	RequireIPAddress bool
+	// DHCPClient, if set, is run on the interface once a wpa_supplicant
+	// started by this manager has associated with a network that has no
+	// static configuration, and stopped with it
+	DHCPClient DHCPClient
+	// StaticConfPath holds the static address configurations of saved
+	// networks. It defaults to WPAConfPath with ".static" appended.
+	StaticConfPath string
+	// ConnectTimeout bounds how long TestConnect waits for a connection.
+	// It defaults to DefaultConnectTimeout.
+	ConnectTimeout time.Duration
+	// RunDir is where PID files for the daemons are kept, so that they can
+	// be found again if the program dies. It defaults to DefaultRunDir.
+	RunDir string
+	// AdoptOrphans makes RecoverOrphans take over live daemons left behind
+	// by an earlier run instead of stopping them
+	AdoptOrphans bool
+	// StopGracePeriod is how long daemons are given to exit after SIGTERM
+	// before they are killed. It defaults to DefaultStopGracePeriod.
+	StopGracePeriod time.Duration
+	// Executor runs the external commands. It defaults to DefaultExecutor.
+	Executor Executor
+	// Links configures the interfaces. It defaults to DefaultLinks.
+	Links LinkController
+	// Hotspot is the access point StartHotspot brings up
+	Hotspot HotspotConfig
+	// Supervisor controls how crashed daemons are restarted
+	Supervisor SupervisorConfig
+	// Selector chooses among known networks in SelectNetwork. It defaults
+	// to DefaultSelector.
+	Selector Selector
 	*networkmanager.NetworkManager
-	KnownSSIDs       set.Interface
-	wpaSupplicantCmd *simpleexec.Cmd
-	hostapdCmd       *simpleexec.Cmd
-	dnsmasqCmd       *simpleexec.Cmd
-	dnsmasqConf      string
-	sync.Mutex
+	// KnownSSIDs holds the SSIDs of the saved networks. It is updated in
+	// place, so it may be kept and read from any goroutine.
+	KnownSSIDs set.Interface
+	knownMutex sync.Mutex
+
+	// ifaces holds the daemons and role of each interface used so far
+	ifaces     map[string]*ifaceController
+	ifaceMutex sync.Mutex
+
+	confMutex    sync.Mutex
+	failures     map[string][]time.Time
+	dhcp         map[string]*dhcpClient
+	static       map[string]*appliedStatic
+	dhcpMutex    sync.Mutex
+	failureMutex sync.Mutex
+	scanCache    *ScanCache
+	cacheMutex   sync.Mutex
+	subscribers  map[chan *Event]struct{}
+	eventMutex   sync.Mutex
+	closed       chan struct{}
+	closeOnce    sync.Once
+	closeErr     error
+	closeMutex   sync.Mutex
 }
 
 func New(wpaConfPath string) (*WifiManager, error) {
@@ -33,33 +90,45 @@ func New(wpaConfPath string) (*WifiManager, error) {
 	}
 	wm := &WifiManager{}
 	wm.WPAConfPath = wpaConfPath
+	wm.CtrlDir = DefaultCtrlDir
+	wm.Executor = DefaultExecutor
+	wm.Links = DefaultLinks
+	wm.Hotspot = DefaultHotspotConfig()
 	wm.NetworkManager = &networkmanager.NetworkManager{}
 	wm.KnownSSIDs = set.New()
+	wm.RunDir = DefaultRunDir
 	if err := wm.UpdateKnownSSIDs(); err != nil {
 		return nil, err
 	}
+	if err := wm.RecoverOrphans(); err != nil {
+		log.Warnf("Failed to clean up after an earlier run: %v", err)
+	}
 	return wm, nil
 }
 
 func (wm *WifiManager) CurrentSSID(iface string) (string, error) {
-	cmd := simpleexec.ParseCmd(fmt.Sprintf("/sbin/iwgetid -r %v", iface))
-	buf := bytes.NewBuffer(nil)
-	cmd.Stdout = buf
-	if err := cmd.Run(); err != nil {
+	stdout, err := wm.executor().Run(fmt.Sprintf("/sbin/iwgetid -r %v", iface))
+	if err != nil {
 		return "", err
 	}
-	return strings.TrimSpace(buf.String()), nil
+	return strings.TrimSpace(stdout), nil
 }
 
 func (wm *WifiManager) ResetWifiInterface(iface string) error {
-	cmds := []string{
-		fmt.Sprintf("ifconfig %v down", iface),
-		fmt.Sprintf("ip addr flush %v", iface),
-		fmt.Sprintf("ifconfig %v up", iface),
-	}
-	for _, cmd := range cmds {
-		if err := runCmd(cmd); err != nil {
-			return fmt.Errorf("Failed to reset wifi interface: %v", err)
+	ic := wm.controller(iface)
+	ic.lock(context.Background())
+	defer ic.unlock()
+	return wm.resetWifiInterface(context.Background(), iface)
+}
+
+func (wm *WifiManager) resetWifiInterface(ctx context.Context, iface string) error {
+	links := wm.links()
+	for _, step := range []func(string) error{links.SetLinkDown, links.FlushAddresses, links.SetLinkUp} {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := step(iface); err != nil {
+			return fmt.Errorf("Failed to reset wifi interface: %w", err)
 		}
 	}
 	return nil
@@ -70,132 +139,238 @@ func (wm *WifiManager) UpdateKnownSSIDs() error {
 	if err != nil {
 		return err
 	}
-	newSet := set.New()
+	known := make(map[string]bool)
 	for _, network := range wpaNetworks {
-		newSet.Add(network.SSID)
+		known[network.SSID] = true
+	}
+
+	wm.knownMutex.Lock()
+	defer wm.knownMutex.Unlock()
+	if wm.KnownSSIDs == nil {
+		wm.KnownSSIDs = set.New()
+	}
+	// SSIDs that stay known never disappear from the set in between
+	for _, ssid := range wm.KnownSSIDs.List() {
+		if !known[ssid.(string)] {
+			wm.KnownSSIDs.Remove(ssid)
+		}
+	}
+	for ssid := range known {
+		wm.KnownSSIDs.Add(ssid)
 	}
-	wm.KnownSSIDs = newSet
 	return nil
 }
 
+// ScanForKnownSSID returns the visible networks from the WPA conf file,
+// strongest first. The results of a running ScanCache are used if there is
+// one, otherwise every wifi interface is scanned.
 func (wm *WifiManager) ScanForKnownSSID() ([]string, error) {
-	ifaces, err := wm.GetWifiInterfaces()
+	results, err := wm.latestScanResults()
 	if err != nil {
-		// Error finding interfaces
 		return nil, err
-	} else {
-		if len(ifaces) > 0 {
-			// We found wifi interfaces
-			ret := make([]string, 0)
-			errorString := bytes.NewBuffer(nil)
-			for _, iface := range ifaces {
-				scanResults, err := wm.WifiScan(iface)
-				if err != nil {
-					errorString.WriteString(fmt.Sprintf("%v\n", err))
-					continue
-				}
-				scanSet := set.NewNonTS()
-				for _, entry := range scanResults {
-					scanSet.Add(entry.SSID)
-				}
-				log.Debugf("Scan results=%v", scanResults)
-				intersection := set.Intersection(wm.KnownSSIDs, scanSet)
-				if intersection.Size() > 0 {
-					for _, o := range intersection.List() {
-						str := o.(string)
-						ret = append(ret, str)
-					}
-				}
-				log.Debugf("Intersection=%v", intersection)
-			}
-			// Now check the results
-			if len(ret) > 0 {
-				// We found some wifi SSIDs. Ignore the errors
-				// and just return the results
-				return ret, nil
-			} else {
-				// No Known wifi SSIDs found.
-				// Did we encounter errors?
-				if errorString.Len() > 0 {
-					return nil, fmt.Errorf(errorString.String())
-				} else {
-					// No errors and no Known SSIDs
-					// legit response.
-					return nil, nil
-				}
-			}
-		} else {
-			// Did not find any wifi interfaces
-			err = fmt.Errorf("No wifi interface found")
-			return nil, err
+	}
+	log.Debugf("Scan results=%v", len(results))
+
+	ret := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, result := range results {
+		if result.Hidden || seen[result.SSID] || !wm.KnownSSIDs.Has(result.SSID) {
+			continue
 		}
+		seen[result.SSID] = true
+		ret = append(ret, result.SSID)
+	}
+	log.Debugf("Known SSIDs in range=%v", ret)
+	if len(ret) == 0 {
+		// No errors and no Known SSIDs
+		// legit response.
+		return nil, nil
+	}
+	return ret, nil
+}
+
+// latestScanResults returns the results of the running ScanCache if there is
+// one, and otherwise scans every wifi interface
+func (wm *WifiManager) latestScanResults() ([]*ScanResult, error) {
+	sc := wm.runningScanCache()
+	if sc == nil {
+		return wm.ScanAll()
+	}
+	results := sc.Results()
+	if _, err := sc.LastScan(); len(results) == 0 && err != nil {
+		return nil, err
 	}
+	return results, nil
 }
 
+// TestConnect checks whether iface can connect to network. On failure the
+// returned error wraps ErrNetworkNotFound, ErrAuthFailed, ErrAssocTimeout or
+// ErrNoDHCPLease.
 func (wm *WifiManager) TestConnect(iface string, network *WPANetwork) error {
-	f, err := ioutil.TempFile("/tmp", "wpa_supplicant-")
+	return wm.TestConnectContext(context.Background(), iface, network)
+}
+
+// TestConnectContext is TestConnect, giving up with ctx.Err() once ctx is
+// done. The connection attempt itself is bounded by ConnectTimeout.
+func (wm *WifiManager) TestConnectContext(ctx context.Context, iface string, network *WPANetwork) error {
+	f, err := ioutil.TempFile(tempConfDir, "wpa_supplicant-")
 	if err != nil {
 		return err
 	}
 	defer os.Remove(f.Name())
 
-	confStr := network.AsConf()
+	confStr := fmt.Sprintf("ctrl_interface=%v\n%v\n", wm.CtrlDir, network.AsConf())
 	if err = ioutil.WriteFile(f.Name(), []byte(confStr), 0664); err != nil {
 		return fmt.Errorf("Failed to create a temporary wpa_supllicant .conf file: %v", err)
 	}
 
-	wm.Lock()
-	defer wm.Unlock()
+	ctx, cancelClose := wm.withClose(ctx)
+	defer cancelClose()
+
+	ic := wm.controller(iface)
+	if err = ic.lock(ctx); err != nil {
+		if wm.isClosed() {
+			return ErrClosed
+		}
+		return err
+	}
+	defer ic.unlock()
+	if wm.isClosed() {
+		return ErrClosed
+	}
 
 	// Disable hostapd
-	if err = wm.StopHotspot(iface); err != nil {
-		return fmt.Errorf("Failed to stop hotspot to test connection: %v", err)
+	if err = wm.stopHotspot(ctx, ic); err != nil {
+		return fmt.Errorf("Failed to stop hotspot to test connection: %w", err)
 	}
 
-	err = wm.StartWPASupplicant(iface, f.Name())
+	events, cancel := wm.Subscribe()
+	defer cancel()
+
+	err = wm.startWPASupplicant(ctx, ic, f.Name())
 	if err != nil {
-		return fmt.Errorf("Failed to start wpa supplicant: %v", err)
+		return fmt.Errorf("Failed to start wpa supplicant: %w", err)
 	}
+	ic.mutex.Lock()
+	ic.role = RoleTesting
+	ic.mutex.Unlock()
 	log.Debugln("Started test WPA supplicant")
 
-	connected := false
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		start := time.Now()
-		for time.Now().Sub(start) < 10*time.Second {
+	err = wm.waitForConnection(ctx, iface, network, events)
+
+	// The supplicant must be stopped even if ctx is done
+	if stopErr := wm.stopWPASupplicant(context.Background(), ic); stopErr != nil {
+		return fmt.Errorf("Failed to stop WPA supplicant: %v", stopErr)
+	}
+
+	if wm.isClosed() {
+		return ErrClosed
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		wm.RecordFailure(network.SSID)
+		return fmt.Errorf("Failed to connect '%v' to SSID %v: %w", iface, network.SSID, err)
+	}
+	wm.ClearFailures(network.SSID)
+	return nil
+}
+
+// waitForConnection follows the events of the supplicant on iface until it
+// is connected to network, an authentication failure is reported, the
+// connection timeout passes or ctx is done
+func (wm *WifiManager) waitForConnection(ctx context.Context, iface string, network *WPANetwork, events <-chan *Event) error {
+	ssid := network.SSID
+	attempt := &connectAttempt{ssid: ssid}
+	timeout := time.After(wm.connectTimeout())
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e := <-events:
+			if e.Iface != iface {
+				continue
+			}
+			attempt.handleEvent(e)
+			if e.Type == EventScanResults {
+				if ctrl, err := wm.DialSupplicant(iface); err == nil {
+					if results, err := ctrl.ScanResults(); err == nil {
+						attempt.handleScanResults(results)
+					}
+					ctrl.Close()
+				}
+			}
+		case <-ticker.C:
+			// Events can be missed, so keep checking the link as well
 			if currentSSID, err := wm.CurrentSSID(iface); err != nil {
 				log.Errorf("Failed to get current SSID: %v", err)
-			} else {
-				if err == nil && strings.Compare(currentSSID, network.SSID) == 0 {
-					log.Infof("Found and connected to network! SSID=%v", currentSSID)
-					connected = true
-					break
-				} else {
-					log.Warnf("SSID mismatch! expected=%v got=%v", network.SSID, currentSSID)
-				}
+			} else if currentSSID == ssid {
+				attempt.connected = true
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			if attempt.connected && wm.RequireIPAddress {
+				return ErrNoDHCPLease
+			}
+			return attempt.failure()
+		}
+
+		if attempt.err != nil {
+			return attempt.err
+		}
+		if attempt.connected {
+			if err := wm.configureAddress(iface, network.IDStr); err != nil {
+				return err
 			}
-			time.Sleep(1 * time.Second)
 		}
-	}()
-	wg.Wait()
+		if attempt.connected && wm.hasAddress(iface) {
+			log.Infof("Found and connected to network! SSID=%v", ssid)
+			return nil
+		}
+	}
+}
 
-	if err = wm.StopWPASupplicant(iface); err != nil {
-		return fmt.Errorf("Failed to stop WPA supplicant: %v", err)
+// hasAddress reports whether iface is configured as far as RequireIPAddress
+// asks for
+func (wm *WifiManager) hasAddress(iface string) bool {
+	switch {
+	case !wm.RequireIPAddress, wm.hasStatic(iface):
+		return true
+	case wm.dhcpEnabled(iface):
+		return wm.hasLease(iface)
+	default:
+		return wm.hasIPv4Address(iface)
 	}
+}
 
-	if connected {
-		return nil
-	} else {
-		return fmt.Errorf("Failed to connect '%v' to SSID: %v", iface, network.SSID)
+func (wm *WifiManager) connectTimeout() time.Duration {
+	if wm.ConnectTimeout == 0 {
+		return DefaultConnectTimeout
 	}
+	return wm.ConnectTimeout
 }
 
+// IsHostapdRunning reports whether hostapd and dnsmasq are both alive on
+// any interface
 func (wm *WifiManager) IsHostapdRunning() bool {
-	return wm.hostapdCmd != nil || wm.dnsmasqCmd != nil
+	for _, ic := range wm.controllers() {
+		if ic.hostapdRunning() {
+			return true
+		}
+	}
+	return false
 }
 
+// IsWPASupplicantRunning reports whether wpa_supplicant is alive on any
+// interface
 func (wm *WifiManager) IsWPASupplicantRunning() bool {
-	return wm.wpaSupplicantCmd != nil
+	for _, ic := range wm.controllers() {
+		if ic.supplicantRunning() {
+			return true
+		}
+	}
+	return false
 }
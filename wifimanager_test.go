@@ -1,9 +1,14 @@
 package wifimanager
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
@@ -11,6 +16,26 @@ import (
 
 var wifiManagerTestData, _ = ioutil.ReadFile("test/available-ssid.conf")
 
+// newFakeWifiManager returns a WifiManager for test/available-ssid.conf
+// whose commands are answered by a FakeExecutor
+func newFakeWifiManager(require *require.Assertions) (*WifiManager, *FakeExecutor, func()) {
+	dir, err := ioutil.TempDir("", "wifimanager-")
+	require.Nil(err)
+	confPath := filepath.Join(dir, "wpa_supplicant.conf")
+	err = ioutil.WriteFile(confPath, wifiManagerTestData, 0664)
+	require.Nil(err)
+
+	wm, err := New(confPath)
+	require.Nil(err)
+	executor := NewFakeExecutor()
+	wm.Executor = executor
+	wm.Links = NewFakeLinks()
+	// No control sockets exist here, so nothing can be reached through them
+	wm.CtrlDir = dir
+	wm.RunDir = filepath.Join(dir, "run")
+	return wm, executor, func() { os.RemoveAll(dir) }
+}
+
 func TestConstructor(t *testing.T) {
 	require := require.New(t)
 
@@ -49,38 +74,68 @@ func TestUpdateKnownSSIDs(t *testing.T) {
 func TestScanForKnownSSID(t *testing.T) {
 	require := require.New(t)
 
-	wm, err := New("test/available-ssid.conf")
-	require.NotNil(wm)
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	oldWifiInterfaces := wifiInterfaces
+	wifiInterfaces = func(*WifiManager) ([]string, error) { return []string{"wlan0"}, nil }
+	defer func() { wifiInterfaces = oldWifiInterfaces }()
+	executor.On("iw dev wlan0 scan", FakeResult{Stdout: string(iwScanTestData)})
+	require.Nil(wm.UpdateKnownSSIDs())
+
+	// Without a ScanCache every wifi interface is scanned
+	ssids, err := wm.ScanForKnownSSID()
 	require.Nil(err)
+	require.Equal([]string{"test", "phonelab"}, ssids)
+	require.Equal([]string{"iw dev wlan0 scan"}, executor.Calls())
+
+	executor.On("iw dev wlan0 scan", FakeResult{ExitCode: 240, Stderr: "command failed: Device or resource busy (-16)"})
+	_, err = wm.ScanForKnownSSID()
+	require.NotNil(err)
+}
+
+func TestScanForKnownSSIDCached(t *testing.T) {
+	require := require.New(t)
 
-	wm.UpdateKnownSSIDs()
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	executor.On("iw dev wlan0 scan", FakeResult{Stdout: string(iwScanTestData)})
+	executor.On("/sbin/iwgetid -r wlan0", FakeResult{ExitCode: 255})
+	require.Nil(wm.UpdateKnownSSIDs())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sc := wm.StartScanCache(ctx, ScanCacheConfig{
+		Ifaces:               []string{"wlan0"},
+		DisconnectedInterval: time.Hour,
+		TTL:                  time.Hour,
+	})
+	require.Eventually(func() bool {
+		lastScan, _ := sc.LastScan()
+		return !lastScan.IsZero()
+	}, time.Second, time.Millisecond)
 
 	ssids, err := wm.ScanForKnownSSID()
 	require.Nil(err)
-	require.NotNil(ssids)
+	require.Equal([]string{"test", "phonelab"}, ssids)
 }
 
 func TestConnect(t *testing.T) {
 	require := require.New(t)
 
-	confFile := "test/available-ssid.conf"
-	wm, err := New(confFile)
-	require.NotNil(wm)
-	require.Nil(err)
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
 
-	ifaces, err := wm.GetWifiInterfaces()
-	require.Nil(err)
+	executor.OnStart("/sbin/wpa_supplicant", "wlan0: CTRL-EVENT-CONNECTED - Connection to 00:11:22:33:44:55 completed [id=0 id_str=]")
+	executor.On("/sbin/iwgetid -r wlan0", FakeResult{Stdout: "test\n"})
 
-	iface := ifaces[0]
-
-	networks, err := ParseWPASupplicantConf(confFile)
+	networks, err := ParseWPASupplicantConf(wm.WPAConfPath)
 	log.Infof("Found %d networks", len(networks))
 	require.Nil(err)
 	require.NotNil(networks)
 
 	succeeded := false
 	for _, network := range networks {
-		err = wm.TestConnect(iface, network)
+		err = wm.TestConnect("wlan0", network)
 		if err != nil {
 			continue
 		} else {
@@ -88,4 +143,158 @@ func TestConnect(t *testing.T) {
 		}
 	}
 	require.True(succeeded)
+	require.False(wm.IsWPASupplicantRunning())
+	for _, p := range executor.Processes("/sbin/wpa_supplicant") {
+		require.False(p.Running())
+	}
+}
+
+func TestConnectWrongKey(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+
+	executor.OnStart("/sbin/wpa_supplicant", "wlan0: WPA: 4-Way Handshake failed - pre-shared key may be incorrect")
+	executor.On("/sbin/iwgetid -r wlan0", FakeResult{ExitCode: 255})
+
+	err := wm.TestConnect("wlan0", &WPANetwork{SSID: "test", PSK: "8ac9f2d7ae608374d89283164d8fd8a877ddea7743391dffcdd6fd8f5f3a7755"})
+	require.True(errors.Is(err, ErrAuthFailed), "%v", err)
+}
+
+func TestConnectContext(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	executor.On("/sbin/iwgetid -r wlan0", FakeResult{ExitCode: 255})
+	network := &WPANetwork{SSID: "test", PSK: "8ac9f2d7ae608374d89283164d8fd8a877ddea7743391dffcdd6fd8f5f3a7755"}
+
+	// The connection timeout is configurable
+	wm.ConnectTimeout = 50 * time.Millisecond
+	start := time.Now()
+	err := wm.TestConnect("wlan0", network)
+	require.True(errors.Is(err, ErrAssocTimeout), "%v", err)
+	require.True(time.Since(start) < time.Second)
+
+	// Cancellation wins over the timeout and stops the supplicant
+	wm.ConnectTimeout = time.Hour
+	executor.OnStart("/sbin/wpa_supplicant")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = wm.TestConnectContext(ctx, "wlan0", network)
+	require.Equal(context.DeadlineExceeded, err)
+	require.False(wm.IsWPASupplicantRunning())
+	for _, p := range executor.Processes("/sbin/wpa_supplicant") {
+		require.False(p.Running())
+	}
+
+	// Nothing is started with a context that is already done
+	calls := len(executor.Calls())
+	err = wm.StartWPASupplicantContext(ctx, "wlan0", wm.WPAConfPath)
+	require.True(errors.Is(err, context.DeadlineExceeded), "%v", err)
+	require.Equal(calls, len(executor.Calls()))
+}
+
+func TestConcurrentOperations(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	wm.StopGracePeriod = 10 * time.Millisecond
+	wm.ConnectTimeout = 20 * time.Millisecond
+	executor.OnStart("/sbin/wpa_supplicant", "wlan0: CTRL-EVENT-CONNECTED - Connection to 00:11:22:33:44:55 completed [id=0 id_str=]")
+	executor.On("/sbin/iwgetid -r", FakeResult{Stdout: "test\n"})
+	network := &WPANetwork{SSID: "test", PSK: "8ac9f2d7ae608374d89283164d8fd8a877ddea7743391dffcdd6fd8f5f3a7755"}
+	known := wm.KnownSSIDs
+
+	ops := []func(){
+		func() { wm.StartHotspot("wlan0") },
+		func() { wm.StopHotspot("wlan0") },
+		func() { wm.StartWPASupplicant("wlan1", wm.WPAConfPath) },
+		func() { wm.StopWPASupplicant("wlan1") },
+		func() { wm.TestConnect("wlan0", network) },
+		func() { wm.ResetWifiInterface("wlan2") },
+		func() { wm.IsHostapdRunning(); wm.IsWPASupplicantRunning(); wm.Daemons() },
+		func() { wm.SetDisabled("phonelab", true) },
+		func() { wm.SetDisabled("phonelab", false) },
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				ops[(i+j)%len(ops)]()
+			}
+		}(i)
+	}
+	// SSIDs that stay saved never go missing while the set is updated
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			require.True(wm.KnownSSIDs.Has("test"))
+		}
+	}
+	require.True(known == wm.KnownSSIDs)
+
+	// Nothing was lost track of along the way: the hotspot only ran on
+	// wlan0, and there is at most one wpa_supplicant per interface
+	for _, name := range []string{"/usr/sbin/hostapd", "/usr/sbin/dnsmasq", "/sbin/wpa_supplicant -Dnl80211 -iwlan0", "/sbin/wpa_supplicant -Dnl80211 -iwlan1"} {
+		running := 0
+		for _, p := range executor.Processes(name) {
+			if p.Running() {
+				running++
+			}
+		}
+		require.True(running <= 1, "%v instances of %v", running, name)
+	}
+	require.Nil(wm.Close())
+	for _, p := range executor.Processes("") {
+		require.False(p.Running(), p.Cmdline)
+	}
+}
+
+func TestModeLock(t *testing.T) {
+	require := require.New(t)
+
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	wm.ConnectTimeout = time.Hour
+	executor.On("/sbin/iwgetid -r wlan0", FakeResult{ExitCode: 255})
+	network := &WPANetwork{SSID: "test", PSK: "8ac9f2d7ae608374d89283164d8fd8a877ddea7743391dffcdd6fd8f5f3a7755"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- wm.TestConnectContext(ctx, "wlan0", network)
+	}()
+	require.Eventually(func() bool {
+		return len(executor.Processes("/sbin/wpa_supplicant")) > 0
+	}, time.Second, time.Millisecond)
+
+	// Other transitions on wlan0 wait for the connection test, but those on
+	// other interfaces and the getters do not
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer waitCancel()
+	require.Equal(context.DeadlineExceeded, wm.StartHotspotContext(waitCtx, "wlan0"))
+	require.Empty(executor.Processes("/usr/sbin/hostapd"))
+	require.True(wm.IsWPASupplicantRunning())
+	require.Equal(1, len(wm.Daemons()))
+	require.Nil(wm.StartHotspot("wlan1"))
+	require.Equal(3, len(wm.Daemons()))
+
+	cancel()
+	require.Equal(context.Canceled, <-result)
+	require.Nil(wm.StartHotspot("wlan0"))
+	require.True(wm.IsHostapdRunning())
+	require.Nil(wm.StopHotspot("wlan0"))
+	require.Nil(wm.StopHotspot("wlan1"))
 }
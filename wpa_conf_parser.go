@@ -1,86 +1,282 @@
 package wifimanager
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
-	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 )
 
-// Regex testing was done on: https://regex101.com/r/RZzdwY/1
-var networkRegex = regexp.MustCompile("(?s)network={(?P<network>.*?)}")
-var ssidRegex = regexp.MustCompile(`^ssid="(?P<ssid>.*)"`)
-var passwordRegex = regexp.MustCompile(`^#psk=(?P<password>.*)`)
-var pskRegex = regexp.MustCompile(`^psk=(?P<psk>.*)`)
+// confLine is a single line of a wpa_supplicant.conf file. The raw text is
+// kept so that lines we did not change are written back byte-for-byte.
+type confLine struct {
+	raw string
+	// key is the option name of a key=value line, empty for anything else
+	key string
+	// value is the option value as last seen by the parser, used to detect
+	// whether the line needs to be regenerated on write
+	value string
+}
+
+// confItem is either a top-level line or a slot holding a network block
+type confItem struct {
+	line    *confLine
+	network *WPANetwork
+}
+
+// WPAConf is a parsed wpa_supplicant.conf file. Global options, comments,
+// unknown lines and the order of everything in the file are preserved so that
+// Bytes() returns the original file unchanged when nothing was modified.
+type WPAConf struct {
+	Networks []*WPANetwork
+	items    []confItem
+}
 
 type WPANetwork struct {
-	SSID     string
-	PSK      string
+	SSID string
+	// PSK is the psk option exactly as written: either 64 hex digits or a
+	// quoted passphrase
+	PSK string
+	// Password is the plaintext passphrase from the '#psk=' comment that
+	// wpa_passphrase leaves in the block
 	Password string
+	KeyMgmt  string
+	Priority int
+	ScanSSID bool
+	BSSID    string
+	EAP      string
+	Identity string
+	Proto    string
+	Pairwise string
+	Disabled bool
+	IDStr    string
+	// The remaining 802.1X settings are used with KeyMgmt WPA-EAP
+	AnonymousIdentity string
+	// EAPPassword is the password option, the credential of PEAP and TTLS
+	EAPPassword        string
+	CACert             string
+	ClientCert         string
+	PrivateKey         string
+	PrivateKeyPassword string
+	Phase2             string
+
+	// SAEPassword is the plaintext password used by WPA3-Personal (SAE)
+	SAEPassword string
+	// IEEE80211W is the management frame protection mode: 0 disabled,
+	// 1 optional, 2 required
+	IEEE80211W int
+
+	// Options holds every other option of the block with its value exactly
+	// as written in the file
+	Options map[string]string
+
+	// explicit holds the options that were set to their zero value, such as
+	// priority=0, as written, since the fields cannot tell them from unset
+	explicit map[string]string
+	header   string
+	footer   string
+	lines    []confLine
+}
+
+// networkField maps a wpa_supplicant option onto a WPANetwork field.
+// get returns the value in conf syntax, or "" if the option is not set.
+type networkField struct {
+	key string
+	get func(wn *WPANetwork) string
+	set func(wn *WPANetwork, value string) error
+}
+
+var networkFields = []networkField{
+	{"ssid",
+		func(wn *WPANetwork) string { return quoteString(wn.SSID) },
+		func(wn *WPANetwork, v string) (err error) { wn.SSID, err = parseString(v); return }},
+	{"#psk",
+		func(wn *WPANetwork) string { return quoteComment(wn.Password) },
+		func(wn *WPANetwork, v string) error { wn.Password = parseComment(v); return nil }},
+	{"psk",
+		func(wn *WPANetwork) string { return wn.PSK },
+		func(wn *WPANetwork, v string) error { wn.PSK = v; return nil }},
+	{"key_mgmt",
+		func(wn *WPANetwork) string { return wn.KeyMgmt },
+		func(wn *WPANetwork, v string) error { wn.KeyMgmt = v; return nil }},
+	{"sae_password",
+		func(wn *WPANetwork) string { return quoteString(wn.SAEPassword) },
+		func(wn *WPANetwork, v string) (err error) { wn.SAEPassword, err = parseString(v); return }},
+	{"ieee80211w",
+		func(wn *WPANetwork) string { return formatInt(wn.IEEE80211W) },
+		func(wn *WPANetwork, v string) (err error) { wn.IEEE80211W, err = strconv.Atoi(v); return }},
+	{"bssid",
+		func(wn *WPANetwork) string { return wn.BSSID },
+		func(wn *WPANetwork, v string) error { wn.BSSID = v; return nil }},
+	{"scan_ssid",
+		func(wn *WPANetwork) string { return formatBool(wn.ScanSSID) },
+		func(wn *WPANetwork, v string) (err error) { wn.ScanSSID, err = parseBool(v); return }},
+	{"priority",
+		func(wn *WPANetwork) string { return formatInt(wn.Priority) },
+		func(wn *WPANetwork, v string) (err error) { wn.Priority, err = strconv.Atoi(v); return }},
+	{"proto",
+		func(wn *WPANetwork) string { return wn.Proto },
+		func(wn *WPANetwork, v string) error { wn.Proto = v; return nil }},
+	{"pairwise",
+		func(wn *WPANetwork) string { return wn.Pairwise },
+		func(wn *WPANetwork, v string) error { wn.Pairwise = v; return nil }},
+	{"eap",
+		func(wn *WPANetwork) string { return wn.EAP },
+		func(wn *WPANetwork, v string) error { wn.EAP = v; return nil }},
+	{"identity",
+		func(wn *WPANetwork) string { return quoteString(wn.Identity) },
+		func(wn *WPANetwork, v string) (err error) { wn.Identity, err = parseString(v); return }},
+	{"anonymous_identity",
+		func(wn *WPANetwork) string { return quoteString(wn.AnonymousIdentity) },
+		func(wn *WPANetwork, v string) (err error) { wn.AnonymousIdentity, err = parseString(v); return }},
+	{"password",
+		func(wn *WPANetwork) string { return quoteString(wn.EAPPassword) },
+		func(wn *WPANetwork, v string) (err error) { wn.EAPPassword, err = parseString(v); return }},
+	{"ca_cert",
+		func(wn *WPANetwork) string { return quoteString(wn.CACert) },
+		func(wn *WPANetwork, v string) (err error) { wn.CACert, err = parseString(v); return }},
+	{"client_cert",
+		func(wn *WPANetwork) string { return quoteString(wn.ClientCert) },
+		func(wn *WPANetwork, v string) (err error) { wn.ClientCert, err = parseString(v); return }},
+	{"private_key",
+		func(wn *WPANetwork) string { return quoteString(wn.PrivateKey) },
+		func(wn *WPANetwork, v string) (err error) { wn.PrivateKey, err = parseString(v); return }},
+	{"private_key_passwd",
+		func(wn *WPANetwork) string { return quoteString(wn.PrivateKeyPassword) },
+		func(wn *WPANetwork, v string) (err error) { wn.PrivateKeyPassword, err = parseString(v); return }},
+	{"phase2",
+		func(wn *WPANetwork) string { return quoteString(wn.Phase2) },
+		func(wn *WPANetwork, v string) (err error) { wn.Phase2, err = parseString(v); return }},
+	{"id_str",
+		func(wn *WPANetwork) string { return quoteString(wn.IDStr) },
+		func(wn *WPANetwork, v string) (err error) { wn.IDStr, err = parseString(v); return }},
+	{"disabled",
+		func(wn *WPANetwork) string { return formatBool(wn.Disabled) },
+		func(wn *WPANetwork, v string) (err error) { wn.Disabled, err = parseBool(v); return }},
+}
+
+func lookupField(key string) *networkField {
+	for idx := range networkFields {
+		if networkFields[idx].key == key {
+			return &networkFields[idx]
+		}
+	}
+	return nil
 }
 
 func (wn *WPANetwork) String() string {
 	return fmt.Sprintf("(ssid=%v psk=%v)", wn.SSID, wn.PSK)
 }
 
-func (wn *WPANetwork) AsConf() string {
-	return fmt.Sprintf(`
-network={
-	ssid="%v"
-	#psk=%v
-	psk=%v
-}`, wn.SSID, wn.Password, wn.PSK)
+// Get returns the value of option key in conf syntax
+func (wn *WPANetwork) Get(key string) (string, bool) {
+	if field := lookupField(key); field != nil {
+		v := field.get(wn)
+		if len(v) == 0 {
+			v = wn.explicit[key]
+		}
+		return v, len(v) > 0
+	}
+	v, ok := wn.Options[key]
+	return v, ok
 }
 
-func ParseWPANetwork(s string) *WPANetwork {
-	lines := strings.Split(s, "\n")
-	var (
-		ssid     string
-		password string
-		psk      string
-	)
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.Contains(line, "ssid=") {
-			match := ssidRegex.FindStringSubmatch(line)
-			if len(match) > 0 {
-				m := mapSubexpNames(match, ssidRegex.SubexpNames())
-				ssid = m["ssid"]
-			}
-		} else if strings.Contains(line, "#psk=") {
-			match := passwordRegex.FindStringSubmatch(line)
-			if len(match) > 0 {
-				m := mapSubexpNames(match, pskRegex.SubexpNames())
-				password = m["password"]
-			}
-		} else if strings.Contains(line, "psk=") {
-			match := pskRegex.FindStringSubmatch(line)
-			if len(match) > 0 {
-				m := mapSubexpNames(match, pskRegex.SubexpNames())
-				psk = m["psk"]
+// Set sets option key from a value in conf syntax. Options that WPANetwork
+// does not model are stored in Options.
+func (wn *WPANetwork) Set(key, value string) error {
+	if field := lookupField(key); field != nil {
+		if err := field.set(wn, value); err != nil {
+			return fmt.Errorf("Invalid value for '%v': %v", key, err)
+		}
+		if len(field.get(wn)) == 0 && len(value) > 0 {
+			if wn.explicit == nil {
+				wn.explicit = make(map[string]string)
 			}
+			wn.explicit[key] = value
+		} else {
+			delete(wn.explicit, key)
 		}
+		return nil
+	}
+	if wn.Options == nil {
+		wn.Options = make(map[string]string)
+	}
+	wn.Options[key] = value
+	return nil
+}
+
+// AsConf returns the network block in wpa_supplicant.conf syntax
+func (wn *WPANetwork) AsConf() string {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString("\n")
+	wn.writeTo(buf)
+	return strings.TrimRight(buf.String(), "\n")
+}
+
+func (wn *WPANetwork) writeTo(buf *bytes.Buffer) {
+	header, footer := wn.header, wn.footer
+	if len(header) == 0 {
+		header = "network={"
+	}
+	if len(footer) == 0 {
+		footer = "}"
 	}
+	indent := "\t"
 
-	if len(ssid) > 0 {
-		return &WPANetwork{
-			SSID:     ssid,
-			Password: password,
-			PSK:      psk,
+	buf.WriteString(header + "\n")
+	written := make(map[string]bool)
+	for _, line := range wn.lines {
+		if len(line.key) == 0 {
+			buf.WriteString(line.raw + "\n")
+			continue
+		}
+		indent = leadingSpace(line.raw)
+		value, ok := wn.Get(line.key)
+		if !ok || (written[line.key] && value != line.value) {
+			// Removed, or a duplicate of a line we already rewrote
+			continue
+		}
+		written[line.key] = true
+		if value == line.value {
+			buf.WriteString(line.raw + "\n")
+		} else {
+			buf.WriteString(fmt.Sprintf("%v%v=%v\n", indent, line.key, value))
+		}
+	}
+	for _, field := range networkFields {
+		if written[field.key] {
+			continue
+		}
+		if value, ok := wn.Get(field.key); ok {
+			buf.WriteString(fmt.Sprintf("%v%v=%v\n", indent, field.key, value))
+		}
+	}
+	keys := make([]string, 0, len(wn.Options))
+	for key := range wn.Options {
+		if !written[key] {
+			keys = append(keys, key)
 		}
-	} else {
-		return nil
 	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		buf.WriteString(fmt.Sprintf("%v%v=%v\n", indent, key, wn.Options[key]))
+	}
+	buf.WriteString(footer + "\n")
 }
 
-func mapSubexpNames(m, n []string) map[string]string {
-	m, n = m[1:], n[1:]
-	r := make(map[string]string, len(m))
-	for i, _ := range n {
-		r[n[i]] = m[i]
+// ParseWPANetwork parses the first network block found in s
+func ParseWPANetwork(s string) *WPANetwork {
+	conf, err := ParseWPAConf(s)
+	if err != nil || len(conf.Networks) == 0 {
+		return nil
 	}
-	return r
+	if len(conf.Networks[0].SSID) == 0 {
+		return nil
+	}
+	return conf.Networks[0]
 }
 
 func ParseWPASupplicantConf(path string) ([]*WPANetwork, error) {
@@ -92,15 +288,351 @@ func ParseWPASupplicantConf(path string) ([]*WPANetwork, error) {
 }
 
 func parseConf(data string) ([]*WPANetwork, error) {
-	result := make([]*WPANetwork, 0)
+	conf, err := ParseWPAConf(data)
+	if err != nil {
+		return nil, err
+	}
+	return conf.Networks, nil
+}
+
+// ReadWPAConf reads and parses the wpa_supplicant.conf file at path
+func ReadWPAConf(path string) (*WPAConf, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseWPAConf(string(data))
+}
+
+// ParseWPAConf parses the contents of a wpa_supplicant.conf file
+func ParseWPAConf(data string) (*WPAConf, error) {
+	conf := &WPAConf{
+		Networks: make([]*WPANetwork, 0),
+		items:    make([]confItem, 0),
+	}
 
-	matches := networkRegex.FindAllStringSubmatch(data, -1)
-	for _, str := range matches {
-		m := mapSubexpNames(str, networkRegex.SubexpNames())
-		wn := ParseWPANetwork(strings.TrimSpace(m["network"]))
-		if wn != nil {
-			result = append(result, wn)
+	lines := strings.Split(data, "\n")
+	var network *WPANetwork
+	start := 0
+	for idx, raw := range lines {
+		line := strings.TrimSpace(raw)
+		if network == nil {
+			if isNetworkStart(line) {
+				network = &WPANetwork{header: raw}
+				start = idx + 1
+				continue
+			}
+			conf.items = append(conf.items, confItem{line: parseConfLine(raw, false)})
+			continue
+		}
+
+		if line == "}" {
+			network.footer = raw
+			network.finishParse()
+			conf.Networks = append(conf.Networks, network)
+			conf.items = append(conf.items, confItem{network: network})
+			network = nil
+			continue
+		}
+		cl := parseConfLine(raw, true)
+		if len(cl.key) > 0 {
+			if err := network.Set(cl.key, cl.value); err != nil {
+				// Keep what we could not interpret rather than losing it
+				cl.key = ""
+			}
+		}
+		network.lines = append(network.lines, *cl)
+	}
+	if network != nil {
+		return nil, fmt.Errorf("Network block starting at line %d is not terminated", start)
+	}
+	return conf, nil
+}
+
+// finishParse records the normalized value of every option line so that
+// writeTo can tell which lines were modified
+func (wn *WPANetwork) finishParse() {
+	for idx := range wn.lines {
+		line := &wn.lines[idx]
+		if len(line.key) > 0 {
+			line.value, _ = wn.Get(line.key)
 		}
 	}
-	return result, nil
+}
+
+func isNetworkStart(line string) bool {
+	return strings.Join(strings.Fields(line), "") == "network={"
+}
+
+func parseConfLine(raw string, inNetwork bool) *confLine {
+	cl := &confLine{raw: raw}
+	line := strings.TrimSpace(raw)
+	if len(line) == 0 {
+		return cl
+	}
+	if strings.HasPrefix(line, "#") && !(inNetwork && strings.HasPrefix(line, "#psk=")) {
+		return cl
+	}
+	idx := strings.Index(line, "=")
+	if idx <= 0 {
+		return cl
+	}
+	cl.key = strings.TrimSpace(line[:idx])
+	cl.value = strings.TrimSpace(line[idx+1:])
+	if strings.ContainsAny(cl.key, " \t") {
+		cl.key, cl.value = "", ""
+	}
+	return cl
+}
+
+// Global returns the value of a global option exactly as written
+func (c *WPAConf) Global(key string) (string, bool) {
+	value, found := "", false
+	for _, item := range c.items {
+		if item.line != nil && item.line.key == key {
+			value, found = item.line.value, true
+		}
+	}
+	return value, found
+}
+
+// SetGlobal sets a global option, replacing an existing line if there is one
+// or adding it after the last global option otherwise
+func (c *WPAConf) SetGlobal(key, value string) {
+	last := -1
+	for idx, item := range c.items {
+		if item.line == nil {
+			continue
+		}
+		if item.line.key == key {
+			last = idx
+		}
+	}
+	if last >= 0 {
+		line := c.items[last].line
+		if line.value != value {
+			line.raw = fmt.Sprintf("%v%v=%v", leadingSpace(line.raw), key, value)
+			line.value = value
+		}
+		return
+	}
+
+	insertAt := 0
+	for idx, item := range c.items {
+		if item.network != nil {
+			break
+		}
+		if len(item.line.key) > 0 {
+			insertAt = idx + 1
+		}
+	}
+	line := &confLine{raw: fmt.Sprintf("%v=%v", key, value), key: key, value: value}
+	c.items = append(c.items, confItem{})
+	copy(c.items[insertAt+1:], c.items[insertAt:])
+	c.items[insertAt] = confItem{line: line}
+}
+
+// Network returns the first network with the given SSID
+func (c *WPAConf) Network(ssid string) *WPANetwork {
+	for _, network := range c.Networks {
+		if network.SSID == ssid {
+			return network
+		}
+	}
+	return nil
+}
+
+// Bytes serializes the configuration. Networks are written into the slots
+// of the original file in order; any extra networks are appended at the end.
+func (c *WPAConf) Bytes() []byte {
+	buf := bytes.NewBuffer(nil)
+	items := c.items
+	// A file ending in a newline splits into a final empty line
+	trailingNewline := false
+	if n := len(items); n > 0 && items[n-1].line != nil && len(items[n-1].line.raw) == 0 {
+		items = items[:n-1]
+		trailingNewline = true
+	}
+
+	kept := make(map[*WPANetwork]bool)
+	for _, network := range c.Networks {
+		kept[network] = true
+	}
+	drop := removedItems(items, kept)
+	for idx, item := range items {
+		if drop[idx] {
+			continue
+		}
+		if item.network != nil {
+			item.network.writeTo(buf)
+			delete(kept, item.network)
+			continue
+		}
+		buf.WriteString(item.line.raw + "\n")
+	}
+	// Networks without a slot of their own are new and go at the end
+	added := false
+	for _, network := range c.Networks {
+		if !kept[network] {
+			continue
+		}
+		if buf.Len() > 0 && !bytes.HasSuffix(buf.Bytes(), []byte("\n\n")) {
+			buf.WriteString("\n")
+		}
+		network.writeTo(buf)
+		added = true
+	}
+	if !added && !trailingNewline && buf.Len() > 0 {
+		buf.Truncate(buf.Len() - 1)
+	}
+	return buf.Bytes()
+}
+
+// removedItems marks the slots of the networks that are no longer kept,
+// together with the comments just above them and the blank line that
+// separated them from what follows
+func removedItems(items []confItem, kept map[*WPANetwork]bool) map[int]bool {
+	drop := make(map[int]bool)
+	isComment := func(idx int) bool {
+		return items[idx].line != nil && strings.HasPrefix(strings.TrimSpace(items[idx].line.raw), "#")
+	}
+	isBlank := func(idx int) bool {
+		return idx < 0 || idx >= len(items) || (items[idx].line != nil && len(strings.TrimSpace(items[idx].line.raw)) == 0)
+	}
+	for idx, item := range items {
+		if item.network == nil || kept[item.network] {
+			continue
+		}
+		drop[idx] = true
+		start := idx
+		for start > 0 && isComment(start-1) {
+			start--
+			drop[start] = true
+		}
+		if isBlank(start-1) && isBlank(idx+1) {
+			if idx+1 < len(items) {
+				drop[idx+1] = true
+			} else if start > 0 {
+				drop[start-1] = true
+			}
+		}
+	}
+	return drop
+}
+
+func (c *WPAConf) String() string {
+	return string(c.Bytes())
+}
+
+func leadingSpace(s string) string {
+	return s[:len(s)-len(strings.TrimLeft(s, " \t"))]
+}
+
+// parseString decodes a wpa_supplicant string value, which is either quoted,
+// printf-escaped (P"...") or hex encoded
+func parseString(v string) (string, error) {
+	if len(v) >= 2 && strings.HasPrefix(v, `"`) && strings.HasSuffix(v, `"`) {
+		return v[1 : len(v)-1], nil
+	}
+	if len(v) >= 3 && strings.HasPrefix(v, `P"`) && strings.HasSuffix(v, `"`) {
+		return unescapePrintf(v[2 : len(v)-1])
+	}
+	if b, err := hex.DecodeString(v); err == nil {
+		return string(b), nil
+	}
+	return v, nil
+}
+
+// parseComment reads the value of a comment such as '#psk=', which
+// wpa_supplicant ignores and which is therefore never hex encoded
+func parseComment(v string) string {
+	if len(v) >= 2 && strings.HasPrefix(v, `"`) && strings.HasSuffix(v, `"`) {
+		return v[1 : len(v)-1]
+	}
+	return v
+}
+
+// quoteComment quotes s the way wpa_passphrase writes '#psk='
+func quoteComment(s string) string {
+	if len(s) == 0 {
+		return ""
+	}
+	return `"` + s + `"`
+}
+
+// quoteString quotes s for the conf file. Strings that cannot be quoted
+// safely, i.e. those with quotes, non-ASCII or non-printable bytes, are hex
+// encoded instead.
+func quoteString(s string) string {
+	if len(s) == 0 {
+		return ""
+	}
+	for idx := 0; idx < len(s); idx++ {
+		if s[idx] == '"' || s[idx] < 32 || s[idx] > 126 {
+			return hex.EncodeToString([]byte(s))
+		}
+	}
+	return `"` + s + `"`
+}
+
+func unescapePrintf(s string) (string, error) {
+	buf := bytes.NewBuffer(nil)
+	for idx := 0; idx < len(s); idx++ {
+		if s[idx] != '\\' || idx+1 == len(s) {
+			buf.WriteByte(s[idx])
+			continue
+		}
+		idx++
+		switch s[idx] {
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		case 'e':
+			buf.WriteByte('\033')
+		case 'x':
+			if idx+2 >= len(s) {
+				return "", fmt.Errorf("Truncated escape in '%v'", s)
+			}
+			b, err := hex.DecodeString(s[idx+1 : idx+3])
+			if err != nil {
+				return "", err
+			}
+			buf.Write(b)
+			idx += 2
+		default:
+			buf.WriteByte(s[idx])
+		}
+	}
+	return buf.String(), nil
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return ""
+}
+
+func parseBool(v string) (bool, error) {
+	n, err := strconv.Atoi(v)
+	return n != 0, err
+}
+
+func formatInt(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+func mapSubexpNames(m, n []string) map[string]string {
+	m, n = m[1:], n[1:]
+	r := make(map[string]string, len(m))
+	for i, _ := range n {
+		r[n[i]] = m[i]
+	}
+	return r
 }
@@ -3,6 +3,7 @@ package wifimanager
 import (
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -61,3 +62,258 @@ func TestWPAConfParseFromFile(t *testing.T) {
 	err = os.Remove(filename)
 	require.Nil(err)
 }
+
+var wpaConfRoundTripTestData = `# Written by hand
+ctrl_interface=DIR=/var/run/wpa_supplicant GROUP=netdev
+update_config=1
+country=US
+
+network={
+	ssid="home"
+	#psk="hello 123"
+	psk=1d2d5eb60ac569d0018f4572a324029efac83d4d4a605b6c7077fd1023715f37
+	key_mgmt=WPA-PSK
+	proto=RSN
+	pairwise=CCMP
+	priority=5
+	id_str="home"
+}
+
+# Office
+network={
+    ssid=6f6666696365
+    scan_ssid=1
+    key_mgmt=WPA-EAP
+    eap=PEAP
+    identity="bob"
+    password="secret"
+    phase2="auth=MSCHAPV2"
+    bssid=00:11:22:33:44:55
+    disabled=1
+}
+`
+
+func TestWPAConfRoundTrip(t *testing.T) {
+	require := require.New(t)
+
+	conf, err := ParseWPAConf(wpaConfRoundTripTestData)
+	require.Nil(err)
+	require.Equal(wpaConfRoundTripTestData, conf.String())
+
+	// Without a trailing newline
+	data := strings.TrimSpace(wpaConfRoundTripTestData)
+	conf, err = ParseWPAConf(data)
+	require.Nil(err)
+	require.Equal(data, conf.String())
+
+	// The legacy parser test data must survive as well
+	conf, err = ParseWPAConf(wpaConfParserTestData)
+	require.Nil(err)
+	require.Equal(wpaConfParserTestData, conf.String())
+}
+
+var wpaConfZeroTestData = `ctrl_interface=/var/run/wpa_supplicant
+pmf=2
+
+network={
+	ssid="legacy"
+	psk="passphrase"
+	priority=0
+	scan_ssid=0
+	ieee80211w=0
+	disabled=0
+}
+`
+
+func TestWPAConfExplicitZero(t *testing.T) {
+	require := require.New(t)
+
+	conf, err := ParseWPAConf(wpaConfZeroTestData)
+	require.Nil(err)
+	require.Equal(wpaConfZeroTestData, conf.String())
+	network := conf.Network("legacy")
+	require.Equal(0, network.IEEE80211W)
+	value, ok := network.Get("ieee80211w")
+	require.True(ok)
+	require.Equal("0", value)
+
+	// Changed lines are rewritten and the others left alone
+	network.Priority = 3
+	require.Equal(strings.Replace(wpaConfZeroTestData, "priority=0", "priority=3", 1), conf.String())
+	network.Priority = 0
+	require.Equal(wpaConfZeroTestData, conf.String())
+
+	// Set records an explicit zero for new networks too
+	added := &WPANetwork{SSID: "new", KeyMgmt: "NONE"}
+	require.Nil(added.Set("ieee80211w", "0"))
+	require.Contains(added.AsConf(), "\tieee80211w=0\n")
+	require.Nil(added.Set("ieee80211w", "1"))
+	added.IEEE80211W = 0
+	require.NotContains(added.AsConf(), "ieee80211w")
+}
+
+func TestWPAConfFields(t *testing.T) {
+	require := require.New(t)
+
+	conf, err := ParseWPAConf(wpaConfRoundTripTestData)
+	require.Nil(err)
+	require.Equal(2, len(conf.Networks))
+
+	value, ok := conf.Global("ctrl_interface")
+	require.True(ok)
+	require.Equal("DIR=/var/run/wpa_supplicant GROUP=netdev", value)
+	value, ok = conf.Global("country")
+	require.True(ok)
+	require.Equal("US", value)
+	_, ok = conf.Global("ap_scan")
+	require.False(ok)
+
+	home := conf.Networks[0]
+	require.Equal("home", home.SSID)
+	require.Equal("hello 123", home.Password)
+	require.Equal("1d2d5eb60ac569d0018f4572a324029efac83d4d4a605b6c7077fd1023715f37", home.PSK)
+	require.Equal("WPA-PSK", home.KeyMgmt)
+	require.Equal("RSN", home.Proto)
+	require.Equal("CCMP", home.Pairwise)
+	require.Equal(5, home.Priority)
+	require.Equal("home", home.IDStr)
+	require.False(home.Disabled)
+
+	office := conf.Network("office")
+	require.NotNil(office)
+	require.True(office.ScanSSID)
+	require.Equal("WPA-EAP", office.KeyMgmt)
+	require.Equal("PEAP", office.EAP)
+	require.Equal("bob", office.Identity)
+	require.Equal("00:11:22:33:44:55", office.BSSID)
+	require.True(office.Disabled)
+	require.Equal("secret", office.EAPPassword)
+	require.Equal("auth=MSCHAPV2", office.Phase2)
+	require.Equal(0, len(office.Options))
+}
+
+func TestWPAConfModify(t *testing.T) {
+	require := require.New(t)
+
+	conf, err := ParseWPAConf(wpaConfRoundTripTestData)
+	require.Nil(err)
+
+	conf.Networks[0].Priority = 10
+	conf.Networks[1].Disabled = false
+	conf.SetGlobal("country", "DE")
+	conf.SetGlobal("ap_scan", "1")
+	conf.Networks = append(conf.Networks, &WPANetwork{SSID: "guest", KeyMgmt: "NONE"})
+
+	expected := strings.NewReplacer(
+		"\tpriority=5", "\tpriority=10",
+		"    disabled=1\n", "",
+		"country=US", "country=DE\nap_scan=1",
+	).Replace(wpaConfRoundTripTestData) + `
+network={
+	ssid="guest"
+	key_mgmt=NONE
+}
+`
+	require.Equal(expected, conf.String())
+
+	// Removing a network drops its block and leaves the comments of the
+	// others with them
+	conf.Networks = conf.Networks[1:]
+	home := expected[strings.Index(expected, "network={"):strings.Index(expected, "# Office")]
+	require.Equal(strings.Replace(expected, home, "", 1), conf.String())
+	conf, err = ParseWPAConf(conf.String())
+	require.Nil(err)
+	require.Equal(2, len(conf.Networks))
+	require.Nil(conf.Network("home"))
+	require.NotNil(conf.Network("guest"))
+
+	// Comments right above a removed network go with it
+	data := `country=US
+
+# Home network, do not touch
+network={
+	ssid="home"
+}
+
+# Office network (IT ticket 42)
+network={
+	ssid="office"
+}
+`
+	conf, err = ParseWPAConf(data)
+	require.Nil(err)
+	conf.Networks = conf.Networks[1:]
+	require.Equal(`country=US
+
+# Office network (IT ticket 42)
+network={
+	ssid="office"
+}
+`, conf.String())
+	conf, err = ParseWPAConf(data)
+	require.Nil(err)
+	conf.Networks = conf.Networks[:1]
+	require.Equal(`country=US
+
+# Home network, do not touch
+network={
+	ssid="home"
+}
+`, conf.String())
+}
+
+func TestWPAConfUnterminated(t *testing.T) {
+	require := require.New(t)
+
+	_, err := ParseWPAConf("network={\n\tssid=\"x\"\n")
+	require.NotNil(err)
+}
+
+func TestWPAConfSAE(t *testing.T) {
+	require := require.New(t)
+
+	data := `network={
+	ssid="mixed"
+	key_mgmt=WPA-PSK SAE
+	psk="password123"
+	sae_password="password123"
+	ieee80211w=1
+}
+`
+	conf, err := ParseWPAConf(data)
+	require.Nil(err)
+	network := conf.Networks[0]
+	require.Equal("WPA-PSK SAE", network.KeyMgmt)
+	require.Equal("password123", network.SAEPassword)
+	require.Equal(1, network.IEEE80211W)
+	require.Equal(0, len(network.Options))
+	require.Equal(data, string(conf.Bytes()))
+
+	network.IEEE80211W = 2
+	network.SAEPassword = `pass"word`
+	conf, err = ParseWPAConf(string(conf.Bytes()))
+	require.Nil(err)
+	require.Equal(2, conf.Networks[0].IEEE80211W)
+	require.Equal(`pass"word`, conf.Networks[0].SAEPassword)
+}
+
+func TestWPAConfPasswordComment(t *testing.T) {
+	require := require.New(t)
+
+	data := `network={
+	ssid=686578
+	#psk=12345678
+	psk=1d2d5eb60ac569d0018f4572a324029efac83d4d4a605b6c7077fd1023715f37
+}
+`
+	conf, err := ParseWPAConf(data)
+	require.Nil(err)
+	// Only the fields wpa_supplicant decodes are hex
+	require.Equal("hex", conf.Networks[0].SSID)
+	require.Equal("12345678", conf.Networks[0].Password)
+
+	conf.Networks[0].Password = `say "hi"`
+	conf, err = ParseWPAConf(string(conf.Bytes()))
+	require.Nil(err)
+	require.Equal(`say "hi"`, conf.Networks[0].Password)
+}
@@ -0,0 +1,310 @@
+package wifimanager
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultCtrlDir is where wpa_supplicant creates its control sockets unless
+// ctrl_interface says otherwise
+const DefaultCtrlDir = "/var/run/wpa_supplicant"
+
+var wpaCtrlCounter uint32
+
+// WPACtrl is a client for the wpa_supplicant control interface, the UNIX
+// datagram socket that wpa_cli talks to
+type WPACtrl struct {
+	// Timeout bounds how long Request waits for a reply
+	Timeout time.Duration
+
+	conn      *net.UnixConn
+	localPath string
+	replies   chan string
+	messages  chan string
+	closed    chan struct{}
+	closeOnce sync.Once
+	mutex     sync.Mutex
+}
+
+// WPAScanResult is one line of the SCAN_RESULTS reply
+type WPAScanResult struct {
+	BSSID     string
+	Frequency int
+	Signal    int
+	Flags     string
+	SSID      string
+}
+
+// DialWPACtrl connects to the control socket at path, usually
+// /var/run/wpa_supplicant/<iface>
+func DialWPACtrl(path string) (*WPACtrl, error) {
+	localPath := filepath.Join(os.TempDir(), fmt.Sprintf("wpa_ctrl_%d-%d", os.Getpid(), atomic.AddUint32(&wpaCtrlCounter, 1)))
+	os.Remove(localPath)
+
+	laddr := &net.UnixAddr{Name: localPath, Net: "unixgram"}
+	raddr := &net.UnixAddr{Name: path, Net: "unixgram"}
+	conn, err := net.DialUnix("unixgram", laddr, raddr)
+	if err != nil {
+		os.Remove(localPath)
+		return nil, fmt.Errorf("Failed to connect to wpa_supplicant control socket '%v': %v", path, err)
+	}
+
+	c := &WPACtrl{
+		Timeout:   10 * time.Second,
+		conn:      conn,
+		localPath: localPath,
+		replies:   make(chan string, 1),
+		messages:  make(chan string, 64),
+		closed:    make(chan struct{}),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *WPACtrl) readLoop() {
+	defer close(c.messages)
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			c.Close()
+			return
+		}
+		msg := string(buf[:n])
+		if strings.HasPrefix(msg, "<") {
+			// Unsolicited message, e.g. "<3>CTRL-EVENT-CONNECTED ..."
+			select {
+			case c.messages <- msg:
+			default:
+				log.Warnf("Dropping wpa_supplicant message: %v", msg)
+			}
+			continue
+		}
+		select {
+		case c.replies <- msg:
+		default:
+			log.Warnf("Dropping unexpected wpa_supplicant reply: %v", msg)
+		}
+	}
+}
+
+// Messages returns the unsolicited messages wpa_supplicant sends once the
+// client is attached. The channel is closed when the client is closed.
+func (c *WPACtrl) Messages() <-chan string {
+	return c.messages
+}
+
+// Request sends cmd and returns the raw reply
+func (c *WPACtrl) Request(cmd string) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Discard a reply that arrived after an earlier request timed out
+	select {
+	case <-c.replies:
+	default:
+	}
+
+	if _, err := c.conn.Write([]byte(cmd)); err != nil {
+		return "", fmt.Errorf("Failed to send '%v' to wpa_supplicant: %v", cmd, err)
+	}
+	select {
+	case reply := <-c.replies:
+		return reply, nil
+	case <-c.closed:
+		return "", fmt.Errorf("wpa_supplicant control connection closed")
+	case <-time.After(c.Timeout):
+		return "", fmt.Errorf("Timed out waiting for wpa_supplicant to reply to '%v'", cmd)
+	}
+}
+
+// requestOK sends cmd and expects wpa_supplicant to reply OK
+func (c *WPACtrl) requestOK(cmd string) error {
+	reply, err := c.Request(cmd)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(reply) != "OK" {
+		return fmt.Errorf("wpa_supplicant rejected '%v': %v", cmd, strings.TrimSpace(reply))
+	}
+	return nil
+}
+
+func (c *WPACtrl) Ping() error {
+	reply, err := c.Request("PING")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(reply) != "PONG" {
+		return fmt.Errorf("Unexpected reply to PING: %v", reply)
+	}
+	return nil
+}
+
+// Attach registers this client to receive unsolicited messages
+func (c *WPACtrl) Attach() error {
+	return c.requestOK("ATTACH")
+}
+
+func (c *WPACtrl) Detach() error {
+	return c.requestOK("DETACH")
+}
+
+// Status returns the key=value pairs of the STATUS reply, e.g. wpa_state and ssid
+func (c *WPACtrl) Status() (map[string]string, error) {
+	reply, err := c.Request("STATUS")
+	if err != nil {
+		return nil, err
+	}
+	status := make(map[string]string)
+	for _, line := range strings.Split(reply, "\n") {
+		if idx := strings.Index(line, "="); idx > 0 {
+			status[line[:idx]] = line[idx+1:]
+		}
+	}
+	return status, nil
+}
+
+// Scan requests a new scan. Results are announced with CTRL-EVENT-SCAN-RESULTS.
+func (c *WPACtrl) Scan() error {
+	return c.requestOK("SCAN")
+}
+
+func (c *WPACtrl) ScanResults() ([]*WPAScanResult, error) {
+	reply, err := c.Request("SCAN_RESULTS")
+	if err != nil {
+		return nil, err
+	}
+	return parseScanResults(reply), nil
+}
+
+func parseScanResults(reply string) []*WPAScanResult {
+	results := make([]*WPAScanResult, 0)
+	lines := strings.Split(reply, "\n")
+	// The first line is the header: bssid / frequency / signal level / flags / ssid
+	for _, line := range lines[1:] {
+		fields := strings.SplitN(line, "\t", 5)
+		if len(fields) < 4 {
+			continue
+		}
+		result := &WPAScanResult{
+			BSSID: fields[0],
+			Flags: fields[3],
+		}
+		result.Frequency, _ = strconv.Atoi(fields[1])
+		result.Signal, _ = strconv.Atoi(fields[2])
+		if len(fields) == 5 {
+			result.SSID = fields[4]
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// AddNetwork creates an empty network and returns its id
+func (c *WPACtrl) AddNetwork() (int, error) {
+	reply, err := c.Request("ADD_NETWORK")
+	if err != nil {
+		return -1, err
+	}
+	id, err := strconv.Atoi(strings.TrimSpace(reply))
+	if err != nil {
+		return -1, fmt.Errorf("Unexpected reply to ADD_NETWORK: %v", strings.TrimSpace(reply))
+	}
+	return id, nil
+}
+
+// SetNetwork sets an option of network id. value is in conf syntax, so
+// strings must be quoted.
+func (c *WPACtrl) SetNetwork(id int, key, value string) error {
+	return c.requestOK(fmt.Sprintf("SET_NETWORK %d %v %v", id, key, value))
+}
+
+// AddWPANetwork adds network to the running supplicant without touching
+// any conf file and returns its id
+func (c *WPACtrl) AddWPANetwork(network *WPANetwork) (int, error) {
+	id, err := c.AddNetwork()
+	if err != nil {
+		return -1, err
+	}
+	for _, field := range networkFields {
+		if field.key == "#psk" {
+			continue
+		}
+		if value, ok := network.Get(field.key); ok {
+			if err = c.SetNetwork(id, field.key, value); err != nil {
+				return -1, err
+			}
+		}
+	}
+	keys := make([]string, 0, len(network.Options))
+	for key := range network.Options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err = c.SetNetwork(id, key, network.Options[key]); err != nil {
+			return -1, err
+		}
+	}
+	return id, nil
+}
+
+// NetworkID returns the id of the configured network with the given SSID
+func (c *WPACtrl) NetworkID(ssid string) (int, error) {
+	reply, err := c.Request("LIST_NETWORKS")
+	if err != nil {
+		return -1, err
+	}
+	// The first line is the header: network id / ssid / bssid / flags. The
+	// SSIDs are escaped there, so they are compared in conf syntax instead.
+	for _, line := range strings.Split(reply, "\n")[1:] {
+		id, err := strconv.Atoi(strings.SplitN(line, "\t", 2)[0])
+		if err != nil {
+			continue
+		}
+		value, err := c.Request(fmt.Sprintf("GET_NETWORK %d ssid", id))
+		if err != nil {
+			return -1, err
+		}
+		if s, err := parseString(strings.TrimSpace(value)); err == nil && s == ssid {
+			return id, nil
+		}
+	}
+	return -1, fmt.Errorf("No network with SSID '%v' in wpa_supplicant", ssid)
+}
+
+// SelectNetwork connects to network id and disables all others
+func (c *WPACtrl) SelectNetwork(id int) error {
+	return c.requestOK(fmt.Sprintf("SELECT_NETWORK %d", id))
+}
+
+// Reconfigure makes wpa_supplicant reload its conf file
+func (c *WPACtrl) Reconfigure() error {
+	return c.requestOK("RECONFIGURE")
+}
+
+// Terminate asks wpa_supplicant to deinitialize and exit
+func (c *WPACtrl) Terminate() error {
+	return c.requestOK("TERMINATE")
+}
+
+func (c *WPACtrl) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.conn.Close()
+		os.Remove(c.localPath)
+	})
+	return err
+}
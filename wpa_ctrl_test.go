@@ -0,0 +1,221 @@
+package wifimanager
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSupplicant is a wpa_supplicant control socket that replays canned replies
+type fakeSupplicant struct {
+	dir      string
+	path     string
+	conn     *net.UnixConn
+	replies  map[string]string
+	requests []string
+	attached *net.UnixAddr
+	sync.Mutex
+}
+
+func newFakeSupplicant(require *require.Assertions, replies map[string]string) *fakeSupplicant {
+	dir, err := ioutil.TempDir("", "wpa_ctrl-")
+	require.Nil(err)
+	path := filepath.Join(dir, "wlan0")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.Nil(err)
+
+	fs := &fakeSupplicant{
+		dir:     dir,
+		path:    path,
+		conn:    conn,
+		replies: replies,
+	}
+	go fs.serve()
+	return fs
+}
+
+func (fs *fakeSupplicant) serve() {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := fs.conn.ReadFromUnix(buf)
+		if err != nil {
+			return
+		}
+		cmd := string(buf[:n])
+		fs.Lock()
+		fs.requests = append(fs.requests, cmd)
+		if cmd == "ATTACH" {
+			fs.attached = addr
+		}
+		reply, ok := fs.replies[cmd]
+		fs.Unlock()
+		if !ok {
+			reply = "UNKNOWN COMMAND\n"
+		}
+		if reply == "-" {
+			// Simulate a supplicant that never answers
+			continue
+		}
+		fs.conn.WriteToUnix([]byte(reply), addr)
+	}
+}
+
+// send delivers an unsolicited message to the attached client
+func (fs *fakeSupplicant) send(msg string) {
+	fs.Lock()
+	defer fs.Unlock()
+	if fs.attached != nil {
+		fs.conn.WriteToUnix([]byte(msg), fs.attached)
+	}
+}
+
+func (fs *fakeSupplicant) Requests() []string {
+	fs.Lock()
+	defer fs.Unlock()
+	return append([]string(nil), fs.requests...)
+}
+
+func (fs *fakeSupplicant) Close() {
+	fs.conn.Close()
+	os.RemoveAll(fs.dir)
+}
+
+func TestWPACtrlRequests(t *testing.T) {
+	require := require.New(t)
+
+	fs := newFakeSupplicant(require, map[string]string{
+		"PING":   "PONG\n",
+		"STATUS": "bssid=00:11:22:33:44:55\nfreq=2437\nssid=home\nid=0\nmode=station\nkey_mgmt=WPA2-PSK\nwpa_state=COMPLETED\nip_address=192.168.1.20\n",
+		"SCAN":   "OK\n",
+		"SCAN_RESULTS": "bssid / frequency / signal level / flags / ssid\n" +
+			"00:11:22:33:44:55\t2437\t-45\t[WPA2-PSK-CCMP][ESS]\thome\n" +
+			"66:77:88:99:aa:bb\t5180\t-70\t[ESS]\t\n",
+		"ADD_NETWORK":                 "1\n",
+		`SET_NETWORK 1 ssid "guest"`:  "OK\n",
+		"SET_NETWORK 1 key_mgmt NONE": "OK\n",
+		"SET_NETWORK 1 priority 3":    "OK\n",
+		"SET_NETWORK 1 bogus 1":       "FAIL\n",
+		"SELECT_NETWORK 1":            "OK\n",
+		"RECONFIGURE":                 "OK\n",
+		"TERMINATE":                   "OK\n",
+	})
+	defer fs.Close()
+
+	ctrl, err := DialWPACtrl(fs.path)
+	require.Nil(err)
+	defer ctrl.Close()
+
+	require.Nil(ctrl.Ping())
+
+	status, err := ctrl.Status()
+	require.Nil(err)
+	require.Equal("COMPLETED", status["wpa_state"])
+	require.Equal("home", status["ssid"])
+
+	require.Nil(ctrl.Scan())
+	results, err := ctrl.ScanResults()
+	require.Nil(err)
+	require.Equal(2, len(results))
+	require.Equal(&WPAScanResult{"00:11:22:33:44:55", 2437, -45, "[WPA2-PSK-CCMP][ESS]", "home"}, results[0])
+	require.Equal("", results[1].SSID)
+	require.Equal(5180, results[1].Frequency)
+
+	id, err := ctrl.AddWPANetwork(&WPANetwork{SSID: "guest", KeyMgmt: "NONE", Priority: 3})
+	require.Nil(err)
+	require.Equal(1, id)
+	require.Nil(ctrl.SelectNetwork(id))
+	require.NotNil(ctrl.SetNetwork(id, "bogus", "1"))
+
+	require.Nil(ctrl.Reconfigure())
+	require.Nil(ctrl.Terminate())
+
+	require.Equal([]string{
+		"PING", "STATUS", "SCAN", "SCAN_RESULTS", "ADD_NETWORK",
+		`SET_NETWORK 1 ssid "guest"`, "SET_NETWORK 1 key_mgmt NONE", "SET_NETWORK 1 priority 3",
+		"SELECT_NETWORK 1", "SET_NETWORK 1 bogus 1", "RECONFIGURE", "TERMINATE",
+	}, fs.Requests())
+}
+
+func TestWPACtrlNetworkID(t *testing.T) {
+	require := require.New(t)
+
+	fs := newFakeSupplicant(require, map[string]string{
+		"LIST_NETWORKS": "network id / ssid / bssid / flags\n" +
+			"0\thome\tany\t\n" +
+			"1\tcaf\\xc3\\xa9\tany\t[CURRENT]\n",
+		"GET_NETWORK 0 ssid": `"home"` + "\n",
+		"GET_NETWORK 1 ssid": "636166c3a9\n",
+		"SELECT_NETWORK 1":   "OK\n",
+	})
+	defer fs.Close()
+
+	ctrl, err := DialWPACtrl(fs.path)
+	require.Nil(err)
+	defer ctrl.Close()
+	id, err := ctrl.NetworkID("home")
+	require.Nil(err)
+	require.Equal(0, id)
+	id, err = ctrl.NetworkID("café")
+	require.Nil(err)
+	require.Equal(1, id)
+	_, err = ctrl.NetworkID("office")
+	require.NotNil(err)
+
+	// The manager selects saved networks by SSID
+	wm := &WifiManager{CtrlDir: fs.dir}
+	require.Nil(wm.SelectSavedNetwork("wlan0", "café"))
+	require.Equal("SELECT_NETWORK 1", fs.Requests()[len(fs.Requests())-1])
+	require.NotNil(wm.SelectSavedNetwork("wlan1", "café"))
+}
+
+func TestWPACtrlMessages(t *testing.T) {
+	require := require.New(t)
+
+	fs := newFakeSupplicant(require, map[string]string{
+		"ATTACH": "OK\n",
+		"PING":   "PONG\n",
+	})
+	defer fs.Close()
+
+	ctrl, err := DialWPACtrl(fs.path)
+	require.Nil(err)
+	defer ctrl.Close()
+
+	require.Nil(ctrl.Attach())
+	fs.send("<3>CTRL-EVENT-SCAN-RESULTS ")
+
+	// Unsolicited messages must not be mistaken for replies
+	require.Nil(ctrl.Ping())
+
+	select {
+	case msg := <-ctrl.Messages():
+		require.Equal("<3>CTRL-EVENT-SCAN-RESULTS ", msg)
+	case <-time.After(time.Second):
+		require.Fail("Did not receive unsolicited message")
+	}
+}
+
+func TestWPACtrlTimeout(t *testing.T) {
+	require := require.New(t)
+
+	fs := newFakeSupplicant(require, map[string]string{
+		"SCAN": "-",
+	})
+	defer fs.Close()
+
+	ctrl, err := DialWPACtrl(fs.path)
+	require.Nil(err)
+	defer ctrl.Close()
+
+	ctrl.Timeout = 100 * time.Millisecond
+	require.NotNil(ctrl.Scan())
+
+	_, err = DialWPACtrl(filepath.Join(fs.dir, "wlan1"))
+	require.NotNil(err)
+}
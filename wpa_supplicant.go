@@ -1,97 +1,204 @@
 package wifimanager
 
 import (
-	"bytes"
+	"context"
 	"fmt"
-	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
-	"github.com/gurupras/go-easyfiles"
-	"github.com/gurupras/go-simpleexec"
 	log "github.com/sirupsen/logrus"
 )
 
+// WPAPassphrase returns a network block for ssid in the format of the
+// wpa_passphrase tool. psk may be a passphrase of 8 to 63 characters, a raw
+// 64 digit hex PSK, or empty for an open network.
 func WPAPassphrase(ssid, psk string) (string, error) {
-	var wpaBlock string
-	if strings.Compare(psk, "") == 0 {
+	if err := validateSSID(ssid); err != nil {
+		return "", err
+	}
+	if len(psk) == 0 {
 		// There is no psk..open network
-		// Generate a block for this by-hand
-		wpaBlock = fmt.Sprintf(`
-network={
-	ssid="%v"
+		return fmt.Sprintf(`network={
+	ssid=%v
 	key_mgmt=NONE
 	priority=-1
-}`, ssid)
-	} else {
-		cmdlineStr := fmt.Sprintf(`/usr/bin/wpa_passphrase "%v" "%v"`, ssid, psk)
-		cmd := simpleexec.ParseCmd(cmdlineStr)
-		stdout := bytes.NewBuffer(nil)
-		stderr := bytes.NewBuffer(nil)
-		cmd.Stdout = stdout
-		cmd.Stderr = stderr
-		if err := cmd.Start(); err != nil {
-			return "", fmt.Errorf("Failed to run command :%v (stderr: %v)", err, stderr.String())
-		}
-		if err := cmd.Wait(); err != nil {
-			return "", fmt.Errorf("Failed to wait for command :%v (stderr: %v)", err, stderr.String())
-		}
-		wpaBlock = stdout.String()
+}`, quoteString(ssid)), nil
+	}
+	if isRawPSK(psk) {
+		return fmt.Sprintf(`network={
+	ssid=%v
+	psk=%v
+}`, quoteString(ssid), strings.ToLower(psk)), nil
+	}
+	key, err := PSK(ssid, psk)
+	if err != nil {
+		return "", err
 	}
-	return strings.TrimSpace(wpaBlock), nil
+	return fmt.Sprintf(`network={
+	ssid=%v
+	#psk=%v
+	psk=%v
+}`, quoteString(ssid), quoteComment(psk), key), nil
 }
 
 func (wm *WifiManager) StartWPASupplicant(iface, confPath string) error {
-	err := wm.ResetWifiInterface(iface)
+	return wm.StartWPASupplicantContext(context.Background(), iface, confPath)
+}
+
+// StartWPASupplicantContext is StartWPASupplicant, giving up with ctx.Err()
+// once ctx is done
+func (wm *WifiManager) StartWPASupplicantContext(ctx context.Context, iface, confPath string) error {
+	ic := wm.controller(iface)
+	if err := ic.lock(ctx); err != nil {
+		return err
+	}
+	defer ic.unlock()
+	if wm.isClosed() {
+		return ErrClosed
+	}
+	return wm.startWPASupplicant(ctx, ic, confPath)
+}
+
+func (wm *WifiManager) startWPASupplicant(ctx context.Context, ic *ifaceController, confPath string) error {
+	iface := ic.name
+	// wpa_supplicant replaces whatever ran on the interface
+	if err := wm.stopHotspot(ctx, ic); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Warnf("Failed to stop the running hotspot on %v: %v", iface, err)
+	}
+	if ic.wpaSupplicantCmd != nil {
+		if err := wm.stopWPASupplicant(ctx, ic); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Warnf("Failed to stop the running wpa_supplicant on %v: %v", iface, err)
+		}
+	}
+	err := wm.resetWifiInterface(ctx, iface)
 	if err != nil {
-		return fmt.Errorf("Failed to reset wifi interface: %v", err)
+		return fmt.Errorf("Failed to reset wifi interface: %w", err)
 	}
 
+	wm.enableDHCP(iface)
 	cmdlineStr := fmt.Sprintf("/sbin/wpa_supplicant -Dnl80211 -i%v -c%v", iface, confPath)
-	wm.wpaSupplicantCmd = WrapCmd(cmdlineStr, "wpa_supplicant")
-	wm.wpaSupplicantCmd.Start()
-	log.Infoln("Started wpa_supplicant")
+	cmd, err := wm.supervise("wpa_supplicant", iface, cmdlineStr, wm.supplicantLineHandler(iface))
+	if err != nil {
+		return fmt.Errorf("Failed to start wpa_supplicant: %v", err)
+	}
+	ic.mutex.Lock()
+	ic.wpaSupplicantCmd = cmd
+	ic.role = RoleClient
+	ic.mutex.Unlock()
+	log.Infof("Started wpa_supplicant on %v", iface)
 	return nil
 }
 
-func (wm *WifiManager) StopWPASupplicant(iface string) (err error) {
-	if wm.wpaSupplicantCmd != nil {
-		if err = wm.wpaSupplicantCmd.Process.Kill(); err != nil {
-			return fmt.Errorf("Failed to interrupt wpa_supplicant: %v\n", err)
+// supplicantLineHandler publishes the events in the output of the
+// wpa_supplicant on iface and configures its address once it has associated
+func (wm *WifiManager) supplicantLineHandler(iface string) func(line string) {
+	return func(line string) {
+		e := ParseEvent(iface, line)
+		if e == nil {
+			return
 		}
-		wm.wpaSupplicantCmd.Wait()
-		if !wm.wpaSupplicantCmd.ProcessState.Exited() {
-			log.Warnf("Failed to wait for wpa_supplicant process to terminate")
+		wm.publish(e)
+		if e.Type == EventConnected {
+			if err := wm.configureAddress(iface, e.IDStr); err != nil {
+				log.Errorf("%v", err)
+			}
 		}
-		wm.wpaSupplicantCmd = nil
 	}
-	log.Infoln("Stopped wpa_supplicant")
-	return
 }
 
-func (wm *WifiManager) AddNetworkConf(ssid, password string) error {
-	f, err := easyfiles.Open(wm.WPAConfPath, os.O_APPEND|os.O_WRONLY, easyfiles.GZ_FALSE)
+// DialSupplicant connects to the control socket of the wpa_supplicant
+// running on iface, whether or not this manager started it
+func (wm *WifiManager) DialSupplicant(iface string) (*WPACtrl, error) {
+	return DialWPACtrl(filepath.Join(wm.CtrlDir, iface))
+}
+
+// SelectSavedNetwork makes the wpa_supplicant running on iface connect to the
+// saved network with the given SSID instead of one of its own choosing
+func (wm *WifiManager) SelectSavedNetwork(iface, ssid string) error {
+	ctrl, err := wm.DialSupplicant(iface)
 	if err != nil {
-		return fmt.Errorf("Failed to open WPA conf file to append: %v\n", err)
+		return err
+	}
+	defer ctrl.Close()
+	id, err := ctrl.NetworkID(ssid)
+	if err != nil {
+		return err
+	}
+	return ctrl.SelectNetwork(id)
+}
+
+// StopWPASupplicant asks wpa_supplicant on iface to terminate through its
+// control socket, falling back to SIGTERM and then SIGKILL for the process
+// we started
+func (wm *WifiManager) StopWPASupplicant(iface string) error {
+	return wm.StopWPASupplicantContext(context.Background(), iface)
+}
+
+// StopWPASupplicantContext is StopWPASupplicant, killing the process right
+// away and returning ctx.Err() once ctx is done
+func (wm *WifiManager) StopWPASupplicantContext(ctx context.Context, iface string) error {
+	ic := wm.controller(iface)
+	if err := ic.lock(ctx); err != nil {
+		return err
 	}
-	defer f.Close()
+	defer ic.unlock()
+	return wm.stopWPASupplicant(ctx, ic)
+}
 
-	if _, err = f.Seek(0, os.SEEK_END); err != nil {
-		return fmt.Errorf("Failed to seek to end of WPA conf file")
+func (wm *WifiManager) stopWPASupplicant(ctx context.Context, ic *ifaceController) error {
+	iface := ic.name
+	// The lease has to be released while we are still associated
+	dhcpErr := wm.StopDHCPContext(ctx, iface)
+	if err := wm.clearStatic(ctx, iface); err != nil && dhcpErr == nil {
+		dhcpErr = err
 	}
 
-	writer, err := f.Writer(0)
-	if err != nil {
-		return fmt.Errorf("Failed to get writer to WPA conf file: %v\n", err)
+	if ic.wpaSupplicantCmd != nil {
+		// It is about to exit on purpose
+		ic.wpaSupplicantCmd.StopRestarting()
+	}
+	terminated := false
+	if ctrl, err := wm.DialSupplicant(iface); err == nil {
+		if err = ctrl.Terminate(); err != nil {
+			log.Warnf("Failed to terminate wpa_supplicant gracefully: %v", err)
+		} else {
+			terminated = true
+		}
+		ctrl.Close()
 	}
-	defer writer.Close()
-	defer writer.Flush()
 
-	data, err := WPAPassphrase(ssid, password)
-	if err != nil {
-		return err
+	var err error
+	if ic.wpaSupplicantCmd != nil {
+		if terminated {
+			timer := time.NewTimer(wm.gracePeriod())
+			select {
+			case <-ic.wpaSupplicantCmd.Done():
+			case <-timer.C:
+				log.Warnf("wpa_supplicant did not exit after TERMINATE")
+				terminated = false
+			case <-ctx.Done():
+				terminated = false
+			}
+			timer.Stop()
+		}
+		if !terminated {
+			err = stopProcess(ctx, ic.wpaSupplicantCmd, wm.gracePeriod())
+		}
+		ic.mutex.Lock()
+		ic.wpaSupplicantCmd = nil
+		ic.role = RoleIdle
+		ic.mutex.Unlock()
 	}
-	if _, err = writer.Write([]byte("\n" + data + "\n")); err != nil {
-		return fmt.Errorf("Failed to update WPA conf file: %v", err)
+	log.Infof("Stopped wpa_supplicant on %v", iface)
+	if err == nil && dhcpErr != nil {
+		err = fmt.Errorf("Failed to deconfigure %v: %v", iface, dhcpErr)
 	}
-	return nil
+	return err
 }
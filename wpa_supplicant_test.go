@@ -161,12 +161,12 @@ func TestStopWPASupplicant(t *testing.T) {
 func TestCurrentSSID(t *testing.T) {
 	require := require.New(t)
 
-	wm, err := New("/etc/wpa_supplicant/wpa_supplicant.conf")
-	require.Nil(err)
-	require.NotNil(wm)
+	wm, executor, cleanup := newFakeWifiManager(require)
+	defer cleanup()
+	iface := "wlan0"
 
-	iface, err := getWifiInterface(wm)
-	require.Nil(err)
+	// Not associated yet, then associated
+	executor.On("/sbin/iwgetid -r wlan0", FakeResult{}, FakeResult{Stdout: "test\n"})
 
 	testConf := createTestConf(require, wm)
 	defer os.Remove(testConf)
@@ -202,7 +202,7 @@ func TestCurrentSSID(t *testing.T) {
 	wg.Wait()
 	log.Infoln("Current SSID:", ssid)
 	require.True(ssidSet.Has(ssid))
-
+	require.Contains(executor.Calls(), "/sbin/wpa_supplicant -Dnl80211 -iwlan0 -c"+testConf)
 }
 
 func TestWPAPassphrase(t *testing.T) {